@@ -0,0 +1,58 @@
+// Package ansi finds the ANSI escape sequences in text, like the ones that
+// color the output of `grep --color=always`.
+package ansi
+
+// The byte that starts an escape sequence.
+const escape = 0x1b
+
+// Len returns the length of the CSI ("\x1b[" and then parameters) sequence at
+// the start of s, or 0 if s doesn't start with one. If the sequence is cut off
+// by the end of s, its length is that of s and complete is false.
+func Len[T string | []byte](s T) (n int, complete bool) {
+	if len(s) == 0 || s[0] != escape {
+		return 0, false
+	}
+	if len(s) == 1 {
+		return 1, false
+	}
+	if s[1] != '[' {
+		return 0, false
+	}
+	for i := 2; i < len(s); i++ {
+		switch c := s[i]; {
+		case c >= 0x20 && c <= 0x3f:
+			// Parameter (like "31;1") and intermediate bytes.
+		case c >= 0x40 && c <= 0x7e:
+			return i + 1, true
+		default:
+			return 0, false
+		}
+	}
+	return len(s), false
+}
+
+// Strip returns s without its escape sequences (see Len), along with the
+// offset in s of each byte of the result.
+func Strip(s string) (string, []int) {
+	stripped := make([]byte, 0, len(s))
+	offsets := make([]int, 0, len(s))
+	for i := 0; i < len(s); {
+		if n, _ := Len(s[i:]); n > 0 {
+			i += n
+			continue
+		}
+		stripped = append(stripped, s[i])
+		offsets = append(offsets, i)
+		i++
+	}
+	return string(stripped), offsets
+}
+
+// SGR returns the parameters of the sequence if it's an SGR ("Select Graphic
+// Rendition", like "\x1b[1;31m" for bold and red) sequence.
+func SGR(seq string) (params string, ok bool) {
+	if n, complete := Len(seq); n != len(seq) || !complete || seq[n-1] != 'm' {
+		return "", false
+	}
+	return seq[2 : len(seq)-1], true
+}
@@ -0,0 +1,73 @@
+package ansi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLen(t *testing.T) {
+	for _, tc := range []struct {
+		s            string
+		want         int
+		wantComplete bool
+	}{
+		{"", 0, false},
+		{"abc", 0, false},
+		{"\x1b[31mFAIL", 5, true},
+		{"\x1b[01;31m\x1b[K", 8, true},
+		{"\x1b[m", 3, true},
+		{"\x1b[K", 3, true},
+		// Cut off by the end of a block.
+		{"\x1b", 1, false},
+		{"\x1b[", 2, false},
+		{"\x1b[31", 4, false},
+		// Not CSI sequences.
+		{"\x1bM", 0, false},
+		{"\x1b[31\n", 0, false},
+	} {
+		got, complete := Len(tc.s)
+		if got != tc.want || complete != tc.wantComplete {
+			t.Errorf("Len(%q): got %d, %v, want %d, %v", tc.s, got, complete, tc.want, tc.wantComplete)
+		}
+		if got, _ := Len([]byte(tc.s)); got != tc.want {
+			t.Errorf("Len([]byte(%q)): got %d, want %d", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestStrip(t *testing.T) {
+	for _, tc := range []struct {
+		s           string
+		want        string
+		wantOffsets []int
+	}{
+		{"", "", []int{}},
+		{"ab", "ab", []int{0, 1}},
+		{"\x1b[31mFA\x1b[1mIL\x1b[0m", "FAIL", []int{5, 6, 11, 12}},
+		{"a\x1b[3", "a", []int{0}},
+	} {
+		got, offsets := Strip(tc.s)
+		if got != tc.want || !reflect.DeepEqual(offsets, tc.wantOffsets) {
+			t.Errorf("Strip(%q): got %q, %v, want %q, %v", tc.s, got, offsets, tc.want, tc.wantOffsets)
+		}
+	}
+}
+
+func TestSGR(t *testing.T) {
+	for _, tc := range []struct {
+		seq        string
+		wantParams string
+		wantOK     bool
+	}{
+		{"\x1b[1;31m", "1;31", true},
+		{"\x1b[m", "", true},
+		{"\x1b[K", "", false},
+		{"\x1b[31", "", false},
+		{"\x1b[31mx", "", false},
+	} {
+		params, ok := SGR(tc.seq)
+		if params != tc.wantParams || ok != tc.wantOK {
+			t.Errorf("SGR(%q): got %q, %v, want %q, %v", tc.seq, params, ok, tc.wantParams, tc.wantOK)
+		}
+	}
+}
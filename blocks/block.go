@@ -2,11 +2,21 @@ package blocks
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
+	"github.com/ewaters/meno/ansi"
 	"github.com/ewaters/meno/trigram"
 	"github.com/golang/glog"
 )
@@ -15,19 +25,72 @@ import (
 type ConfigSource struct {
 	Input io.Reader
 	Size  int
+
+	// The path of the file that Input reads from, if any. In follow mode, it's
+	// used to detect that the file was truncated or replaced (e.g. by log
+	// rotation) so that it can be reopened.
+	Path string
+
+	// Set by Decompress() if Input is decompressed.
+	Compression Compression
 }
 
+const defaultPollInterval = 250 * time.Millisecond
+
+// How many of the bytes read last are checked to still be there when polling
+// a file in follow mode.
+const tailCheckBytes = 64
+
+var defaultLineSeparator = []byte("\n")
+
 // The Reader config.
 type Config struct {
 	Source    ConfigSource
 	BlockSize int
 
+	// The bytes that end each line (or record), like "\r\n" or "\x00".
+	// Defaults to "\n".
+	LineSeparator []byte
+
 	// How many bytes should we read into the next block to build the index for
 	// the given block.
 	// Must be > 0 and < BlockSize.
 	// This enables us to say that block "abc" contains "bcde" if the next block
 	// contains "def" and IndexNextBytes is at least 2.
 	IndexNextBytes int
+
+	// If true, keep polling Input for appended bytes after reaching EOF (like
+	// `tail -f`). The RemainingBytes of the ReadStatus is then always -1.
+	// See also Reader.Follow().
+	Follow bool
+
+	// How often to poll Input for more bytes in follow mode. Defaults to
+	// 250ms.
+	PollInterval time.Duration
+
+	// If > 0, read bytes which don't fill a block yet are emitted as a short
+	// block once no more bytes have been read for this long. Without it, a
+	// slowly growing input isn't seen until a whole block has been read.
+	FlushAfter time.Duration
+
+	// If set, the index of the file at Source.Path is cached in this directory
+	// once the file has been read. The next time the file is read, the index
+	// is loaded from the cache instead of being built again, as long as the
+	// file hasn't changed (see CacheKey).
+	CacheDir string
+
+	// The most bytes that the files in CacheDir take. Past it, the least
+	// recently used ones are removed. An index that would take more than a
+	// quarter of it isn't cached. Defaults to 1 GiB.
+	CacheMaxBytes int64
+
+	// How many goroutines index the blocks. Defaults to the number of CPUs.
+	IndexWorkers int
+
+	// If true, ANSI escape sequences (see the ansi package) are left out of
+	// the index, so that colored text (like "\x1b[31mFA\x1b[1mIL") is found by
+	// searches for the text alone ("FAIL"). The blocks are unchanged.
+	IgnoreEscapes bool
 }
 
 // A block reader and indexer.
@@ -37,6 +100,18 @@ type Reader struct {
 	reqC  chan chanRequest
 	readC chan readData
 	doneC chan bool
+	stopC chan bool
+
+	follow atomic.Bool
+
+	// Only used by read(); there is at most one of them running.
+	input       io.Reader
+	inputOffset int64
+	// The last bytes read from the input (up to tailCheckBytes of them), to
+	// tell whether the file was truncated and has grown again since.
+	lastRead []byte
+	// The file we opened ourselves when reopening Source.Path.
+	reopened *os.File
 }
 
 // An indexed block.
@@ -108,15 +183,65 @@ func (bior BlockIDOffsetRange) Contains(bio BlockIDOffset) bool {
 	return bior.Start.LTE(bio) && bior.End.GTE(bio)
 }
 
-func (b *Block) findNewlines() []BlockIDOffset {
+// findNewlines returns where the line separators (sep) that end in the block
+// end (the offset of their last byte). A separator of more than one byte may
+// start in the blocks before it, so tail is the bytes before the block that
+// may be the start of one (the bytes after the last separator, up to
+// len(sep)-1 of them), and the tail for the next block is returned.
+func (b *Block) findNewlines(sep, tail []byte) ([]BlockIDOffset, []byte) {
+	buf := b.Bytes
+	if len(tail) > 0 {
+		buf = append(append([]byte{}, tail...), b.Bytes...)
+	}
 	var result []BlockIDOffset
-	for i, bite := range b.Bytes {
-		if bite == 10 {
-			result = append(result, BlockIDOffset{b.ID, i})
+	// The offset in buf after the last separator.
+	last := 0
+	for {
+		i := bytes.Index(buf[last:], sep)
+		if i == -1 {
+			break
 		}
+		last += i + len(sep)
+		result = append(result, BlockIDOffset{b.ID, last - 1 - len(tail)})
 	}
 	b.Newlines = len(result)
-	return result
+
+	rest := buf[last:]
+	if keep := len(sep) - 1; len(rest) > keep {
+		rest = rest[len(rest)-keep:]
+	}
+	return result, append([]byte(nil), rest...)
+}
+
+// lineSpans returns, for each of the blocks, the first block that the line
+// in progress at its start may have started in, and the block that the line
+// in progress at its end ends in (or the last block, if it hasn't ended yet).
+// The newlines are those of the blocks (see findNewlines).
+func lineSpans(blocks []*Block, newlines []BlockIDOffset) (starts, ends []int) {
+	starts = make([]int, len(blocks))
+	ends = make([]int, len(blocks))
+	start, next := 0, 0
+	for id := range blocks {
+		for ; next < len(newlines) && newlines[next].BlockID < id; next++ {
+			nl := newlines[next]
+			start = nl.BlockID
+			if nl.Offset == len(blocks[nl.BlockID].Bytes)-1 {
+				start++
+			}
+		}
+		starts[id] = start
+	}
+	next = 0
+	for id := range blocks {
+		for next < len(newlines) && newlines[next].BlockID <= id {
+			next++
+		}
+		ends[id] = len(blocks) - 1
+		if next < len(newlines) {
+			ends[id] = newlines[next].BlockID
+		}
+	}
+	return starts, ends
 }
 
 // The running status of the reading from Input.
@@ -141,6 +266,11 @@ type Event struct {
 	// A new block has been read.
 	NewBlock *Block
 
+	// The file at Source.Path was truncated or replaced (in follow mode), so
+	// the blocks read before are dropped. The next block read from the start
+	// of the file has ID 0.
+	Reset bool
+
 	// The current read status.
 	Status ReadStatus
 }
@@ -150,6 +280,9 @@ func (e Event) String() string {
 	if e.NewBlock != nil {
 		sb.WriteString(e.NewBlock.String())
 	}
+	if e.Reset {
+		sb.WriteString("reset")
+	}
 	if e.Status.BytesRead != 0 {
 		if sb.Len() > 0 {
 			sb.WriteString("; ")
@@ -166,6 +299,8 @@ func (e Event) Equals(other Event) bool {
 type readData struct {
 	bytesRead []byte
 	readDone  bool
+	// The input is read again from its start.
+	reset bool
 }
 
 func (rd readData) String() string {
@@ -177,6 +312,9 @@ func (rd readData) String() string {
 	if rd.readDone {
 		sb.WriteString("read done")
 	}
+	if rd.reset {
+		sb.WriteString("reset")
+	}
 	return sb.String()
 }
 
@@ -190,9 +328,18 @@ type chanRequest struct {
 	// GetLine(idx)
 	getLine *int
 
+	// GetOffset(offset)
+	getOffset *int
+
 	// BlockIDsContaining(string)
 	blockIDsContaining *string
 
+	// BlockIDsMatching(regexp)
+	blockIDsMatching *regexpQuery
+
+	// Follow()
+	follow bool
+
 	respC chan chanResponse
 }
 
@@ -205,23 +352,46 @@ func (cr chanRequest) String() string {
 	if id := cr.getLine; id != nil {
 		fmt.Fprintf(&sb, "get line %d", *id)
 	}
+	if offset := cr.getOffset; offset != nil {
+		fmt.Fprintf(&sb, "get offset %d", *offset)
+	}
 	if str := cr.blockIDsContaining; str != nil {
 		fmt.Fprintf(&sb, "block IDs containing %q", *str)
 	}
+	if rq := cr.blockIDsMatching; rq != nil {
+		fmt.Fprintf(&sb, "block IDs matching /%v/", rq.re)
+	}
+	if cr.follow {
+		sb.WriteString("follow")
+	}
 	return sb.String()
 }
 
+// A regexp along with the trigram query plan to find its candidate blocks.
+type regexpQuery struct {
+	re   *regexp.Regexp
+	plan *trigram.QueryPlan
+}
+
 // A response from the internal Run() event loop, passed to chanRequest.respC
 type chanResponse struct {
 	// getBlockRange
 	blocks []*Block
 
-	// blockIDsContaining
-	blockIDs []BlockIDOffset
+	// blockIDsContaining and blockIDsMatching: the IDs of the blocks in
+	// which the index found the query, in order, which are then checked
+	// against the blocks.
+	candidates []int
+	// blockIDsMatching: for each block, the block that the line in progress
+	// at its end ends in (see lineSpans).
+	lineEnds []int
 
 	// getLine start and end
 	blockIDOffsetRange *BlockIDOffsetRange
 
+	// getOffset
+	blockIDOffset *BlockIDOffset
+
 	err error
 }
 
@@ -230,33 +400,146 @@ func NewReader(config Config) (*Reader, error) {
 	if next := config.IndexNextBytes; next <= 0 || next > config.BlockSize {
 		return nil, fmt.Errorf("Invalid IndexNextBytes %d -- must be > 0 and < BlockSize", next)
 	}
-	return &Reader{
+	if len(config.LineSeparator) == 0 {
+		config.LineSeparator = defaultLineSeparator
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultPollInterval
+	}
+	if config.IndexWorkers <= 0 {
+		config.IndexWorkers = runtime.NumCPU()
+	}
+	if config.CacheMaxBytes <= 0 {
+		config.CacheMaxBytes = defaultCacheMaxBytes
+	}
+	r := &Reader{
 		Config: config,
 		reqC:   make(chan chanRequest),
 		readC:  make(chan readData),
 		doneC:  make(chan bool),
-	}, nil
+		stopC:  make(chan bool),
+		input:  config.Source.Input,
+	}
+	r.follow.Store(config.Follow)
+	return r, nil
 }
 
+// read sends what's read from the input to readC until EOF. In follow mode,
+// it instead keeps polling the input for more.
 func (r *Reader) read() {
 	buf := make([]byte, r.BlockSize+r.IndexNextBytes)
 	for {
-		n, err := r.Source.Input.Read(buf)
+		n, err := r.input.Read(buf)
 		if n > 0 {
-			r.readC <- readData{
+			r.inputOffset += int64(n)
+			r.lastRead = append(r.lastRead, buf[:n]...)
+			if extra := len(r.lastRead) - tailCheckBytes; extra > 0 {
+				r.lastRead = append([]byte(nil), r.lastRead[extra:]...)
+			}
+			select {
+			case r.readC <- readData{
 				bytesRead: append([]byte{}, buf[:n]...),
+			}:
+			case <-r.stopC:
+				return
 			}
 		}
-		if err != nil {
-			if err == io.EOF {
-				break
+		if err == nil {
+			continue
+		}
+		if err != io.EOF {
+			select {
+			case <-r.stopC:
+				// The input may have been closed by Stop().
+				return
+			default:
 			}
 			glog.Fatal(err)
 		}
+		if !r.follow.Load() {
+			break
+		}
+		if r.reopenIfChanged() {
+			select {
+			case r.readC <- readData{
+				reset: true,
+			}:
+			case <-r.stopC:
+				return
+			}
+			continue
+		}
+		select {
+		case <-time.After(r.PollInterval):
+		case <-r.stopC:
+			return
+		}
 	}
-	r.readC <- readData{
+	select {
+	case r.readC <- readData{
 		readDone: true,
+	}:
+	case <-r.stopC:
+	}
+}
+
+// reopenIfChanged checks whether the file at Source.Path was truncated or
+// replaced since we opened it. If so, it returns true and the input is read
+// again from the start of the file. A file that was truncated and has grown
+// past our offset since the last poll is told apart by the bytes that we read
+// last no longer being there.
+func (r *Reader) reopenIfChanged() bool {
+	path := r.Source.Path
+	file, ok := r.input.(*os.File)
+	if path == "" || !ok {
+		return false
+	}
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		// The file may be in the middle of being rotated.
+		glog.V(1).Infof("Stat(%q): %v", path, err)
+		return false
+	}
+	fileInfo, err := file.Stat()
+	if err == nil && os.SameFile(fileInfo, pathInfo) {
+		if pathInfo.Size() >= r.inputOffset && r.lastReadUnchanged(file) {
+			return false
+		}
+		glog.Infof("%q was truncated to %d bytes; reading from the start", path, pathInfo.Size())
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			glog.Errorf("Seek(%q): %v", path, err)
+			return false
+		}
+		r.inputOffset = 0
+		r.lastRead = nil
+		return true
+	}
+
+	glog.Infof("%q was replaced; reopening it", path)
+	newFile, err := os.Open(path)
+	if err != nil {
+		glog.Errorf("Open(%q): %v", path, err)
+		return false
 	}
+	if r.reopened != nil {
+		r.reopened.Close()
+	}
+	r.reopened = newFile
+	r.input = newFile
+	r.inputOffset = 0
+	r.lastRead = nil
+	return true
+}
+
+// lastReadUnchanged returns whether the file still has the bytes that we read
+// last where we read them.
+func (r *Reader) lastReadUnchanged(file *os.File) bool {
+	if len(r.lastRead) == 0 {
+		return true
+	}
+	buf := make([]byte, len(r.lastRead))
+	_, err := file.ReadAt(buf, r.inputOffset-int64(len(buf)))
+	return err == nil && bytes.Equal(buf, r.lastRead)
 }
 
 func (r *Reader) Run(eventC chan Event) {
@@ -266,32 +549,119 @@ func (r *Reader) Run(eventC chan Event) {
 	var mu sync.Mutex
 	var blocks []*Block
 	var readStatus ReadStatus
-	index := trigram.NewIndex()
 	var newlines []BlockIDOffset
+	// The offset in the input of the first byte of each block.
+	var blockOffsets []int
+	// Whether read() has sent readDone (and so is no longer running).
+	readFinished := false
 	// End protected by mutex
 
-	if r.Source.Size > 0 {
+	// Has its own locking. Blocks are added under the mutex, but the index
+	// can be queried without it. index.binary is protected by the mutex.
+	index := newShardedIndex(r.IndexWorkers)
+	defer index.stop()
+
+	if r.Source.Size > 0 && !r.follow.Load() {
 		readStatus.RemainingBytes = r.Source.Size
 	} else {
 		readStatus.RemainingBytes = -1
 	}
 
-	newBlock := func(buf, next []byte) {
+	// Whether the last block was indexed without IndexNextBytes of the next
+	// block (since it wasn't read yet). Only used by newBlock.
+	lastBlockShort := false
+
+	// If the index was cached, the blocks covered by the cache don't have to
+	// be indexed again. Only used by newBlock and readDone.
+	var cacheKey *CacheKey
+	var cached *cachedIndex
+	if r.CacheDir != "" && r.Source.Path != "" {
+		if key, err := NewCacheKey(r.Source.Path, r.Config); err != nil {
+			glog.Warningf("NewCacheKey(%q): %v", r.Source.Path, err)
+		} else {
+			cacheKey = &key
+			if cached = loadCache(r.CacheDir, key); cached != nil {
+				index.reset(cached.index)
+			}
+		}
+	}
+	var blockLengths []int
+	// The next of cached.Newlines to use.
+	cachedNewline := 0
+	// The bytes at the end of the last block that may start a line separator
+	// (see findNewlines).
+	var sepTail []byte
+
+	sendEvent := func(event Event) {
+		select {
+		case eventC <- event:
+		case <-r.stopC:
+		}
+	}
+
+	// addBlock adds the block and returns the event for it, which the caller
+	// sends (see newBlock).
+	addBlock := func(buf, next []byte) Event {
 		mu.Lock()
+		blockOffsets = append(blockOffsets, readStatus.BytesRead)
 		readStatus.BytesRead += len(buf)
 		if readStatus.RemainingBytes > 0 {
 			readStatus.RemainingBytes -= len(buf)
+			if readStatus.RemainingBytes <= 0 && !readFinished {
+				// The Size was wrong, like the estimated size of a
+				// compressed input. Only readDone can say that we're done.
+				readStatus.RemainingBytes = -1
+			}
 		}
 		id := len(blocks)
 		block := &Block{
 			ID:    id,
 			Bytes: buf,
 		}
-		nls := block.findNewlines()
+		blockLengths = append(blockLengths, len(buf))
+
+		if cached != nil && id >= len(cached.BlockLengths) {
+			// The file has grown since it was cached (in follow mode).
+			cached = nil
+		} else if cached != nil && len(buf) != cached.BlockLengths[id] {
+			glog.Warningf("Block %d has %d bytes but %d were cached; indexing again", id, len(buf), cached.BlockLengths[id])
+			cached = nil
+			index.reset(trigram.NewIndex())
+			for i := range blocks {
+				index.add(r.indexed(r.blockWithNext(i, blocks)), uint64(i))
+			}
+			// The last one didn't have the bytes of this block yet.
+			lastBlockShort = id > 0
+		}
+
+		var nls []BlockIDOffset
+		// The cached newlines can't tell us the sepTail, which is only used
+		// by separators of more than one byte.
+		if cached != nil && len(r.LineSeparator) == 1 {
+			for ; cachedNewline < len(cached.Newlines) && cached.Newlines[cachedNewline].BlockID == id; cachedNewline++ {
+				nls = append(nls, cached.Newlines[cachedNewline])
+			}
+			block.Newlines = len(nls)
+		} else {
+			nls, sepTail = block.findNewlines(r.LineSeparator, sepTail)
+		}
 		newlines = append(newlines, nls...)
 
-		//glog.Infof("Indexing %q:%q to %d", string(buf), string(next), id)
-		index.AddWithID(string(buf)+string(next), uint64(id))
+		if cached == nil {
+			if lastBlockShort {
+				// Index the last block again with the next bytes, as if they
+				// had been available at the time.
+				head := buf
+				if len(head) > r.IndexNextBytes {
+					head = head[:r.IndexNextBytes]
+				}
+				index.add(r.indexed(string(blocks[id-1].Bytes)+string(head)), uint64(id-1))
+			}
+
+			//glog.Infof("Indexing %q:%q to %d", string(buf), string(next), id)
+			index.add(r.indexed(string(buf)+string(next)), uint64(id))
+		}
+		lastBlockShort = len(next) < r.IndexNextBytes
 		readStatus.Newlines += block.Newlines
 		readStatus.Blocks++
 		blocks = append(blocks, block)
@@ -300,18 +670,73 @@ func (r *Reader) Run(eventC chan Event) {
 			Status:   readStatus,
 		}
 		mu.Unlock()
+		return event
+	}
+	newBlock := func(buf, next []byte) {
+		sendEvent(addBlock(buf, next))
+	}
 
-		eventC <- event
+	var flushC <-chan time.Time
+	flushTimer := time.NewTimer(r.FlushAfter)
+	flushTimer.Stop()
+	if r.FlushAfter > 0 {
+		flushC = flushTimer.C
 	}
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		var pendingBytes []byte
-		for req := range r.readC {
+		for {
+			var req readData
+			select {
+			case <-r.stopC:
+				return
+			case <-flushC:
+				if len(pendingBytes) > 0 {
+					glog.V(1).Infof("Reader.Run flushing %d pending bytes", len(pendingBytes))
+					newBlock(pendingBytes, nil)
+					pendingBytes = nil
+				}
+				continue
+			case req = <-r.readC:
+			}
 			glog.V(2).Infof("Reader.Run readC %v", req)
+			if req.reset {
+				// Start over, as if nothing had been read.
+				mu.Lock()
+				blocks = nil
+				newlines = nil
+				blockOffsets = nil
+				readStatus = ReadStatus{RemainingBytes: -1}
+				index.reset(trigram.NewIndex())
+				lastBlockShort = false
+				cacheKey = nil
+				cached = nil
+				blockLengths = nil
+				cachedNewline = 0
+				sepTail = nil
+				event := Event{
+					Reset:  true,
+					Status: readStatus,
+				}
+				mu.Unlock()
+				pendingBytes = nil
+				sendEvent(event)
+				continue
+			}
 			if req.bytesRead != nil {
 				pendingBytes = append(pendingBytes, req.bytesRead...)
+				if flushC != nil {
+					if !flushTimer.Stop() {
+						select {
+						case <-flushTimer.C:
+						default:
+						}
+					}
+					flushTimer.Reset(r.FlushAfter)
+				}
 				block, next := r.BlockSize, r.IndexNextBytes
 				if len(pendingBytes) < block+next {
 					continue
@@ -321,17 +746,66 @@ func (r *Reader) Run(eventC chan Event) {
 				continue
 			}
 			if req.readDone {
-				glog.Infof("Reader.Run read done")
 				mu.Lock()
+				if r.follow.Load() {
+					// Follow() was called after read() decided to stop.
+					mu.Unlock()
+					go r.read()
+					continue
+				}
+				glog.Infof("Reader.Run read done")
+				readFinished = true
 				readStatus.RemainingBytes = 0
 				mu.Unlock()
-				newBlock(pendingBytes, []byte{})
+				event := addBlock(pendingBytes, []byte{})
+				pendingBytes = nil
+
+				// The cache is saved before the last event is sent, so
+				// that it's there once the input is done. It's saved
+				// without holding the mutex, which would block the
+				// requests of the UI. Only this goroutine adds to the
+				// index, so it doesn't change in the meantime.
+				if cacheKey != nil && cached == nil {
+					mu.Lock()
+					c := &cachedIndex{
+						cacheHeader: cacheHeader{
+							Key:          *cacheKey,
+							BlockLengths: append([]int{}, blockLengths...),
+							Newlines:     append([]BlockIDOffset{}, newlines...),
+						},
+					}
+					mu.Unlock()
+					c.index = index.merged()
+					if err := c.save(r.CacheDir, r.CacheMaxBytes); err != nil {
+						glog.Warningf("Failed to save the index cache to %q: %v", r.CacheDir, err)
+					}
+				}
+				// The file may grow from here (in follow mode).
+				cacheKey = nil
+				sendEvent(event)
 				continue
 			}
 		}
-		wg.Done()
 	}()
 
+	// candidateBlocks returns the blocks read so far and the IDs of those in
+	// the index query results, in order. They're checked by streamBlocks,
+	// outside of this loop.
+	candidateBlocks := func(results []trigram.QueryResult) ([]*Block, []int) {
+		mu.Lock()
+		blocks := blocks
+		mu.Unlock()
+
+		var ids []int
+		for _, qr := range results {
+			if id := int(qr.DocID); id < len(blocks) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Ints(ids)
+		return blocks, ids
+	}
+
 	for req := range r.reqC {
 		glog.V(2).Infof("Reader.Run reqC %v", req)
 		resp := chanResponse{}
@@ -358,47 +832,81 @@ func (r *Reader) Run(eventC chan Event) {
 		if req.blockIDsContaining != nil {
 			query := *req.blockIDsContaining
 
+			binary := binaryQuery(query)
+			if binary {
+				mu.Lock()
+				if !index.binary {
+					// The blocks so far weren't indexed for binary queries.
+					index.binary = true
+					for i := range blocks {
+						index.addBinary(r.indexed(r.blockWithNext(i, blocks)), uint64(i))
+					}
+				}
+				mu.Unlock()
+			}
+			results := index.query(func(idx *trigram.Index) []trigram.QueryResult {
+				if binary {
+					return idx.QueryBinary(query)
+				}
+				return idx.Query(query)
+			})
+			resp.blocks, resp.candidates = candidateBlocks(results)
+			req.respC <- resp
+			continue
+		}
+		if rq := req.blockIDsMatching; rq != nil {
+			// A match may go on past the end of the block it starts in,
+			// to the end of its line.
 			mu.Lock()
-			results := index.Query(query)
+			blocks := blocks
+			lineStarts, lineEnds := lineSpans(blocks, newlines)
 			mu.Unlock()
 
-			for _, qr := range results {
-				id := int(qr.DocID)
-
-				offset := r.blockIDContains(id, blocks, query)
-				if offset == -1 {
-					continue
+			ids := trigram.QueryPlanSpans(rq.plan, len(blocks), index.docs, func(id int) int {
+				return lineStarts[id]
+			})
+			resp.blocks = blocks
+			for _, id := range ids {
+				resp.candidates = append(resp.candidates, int(id))
+			}
+			resp.lineEnds = lineEnds
+			glog.Infof("Query plan %v may be in %d of %d blocks", rq.plan, len(ids), len(blocks))
+			req.respC <- resp
+			continue
+		}
+		if req.follow {
+			mu.Lock()
+			if !r.follow.Load() {
+				r.follow.Store(true)
+				readStatus.RemainingBytes = -1
+				if readFinished {
+					glog.Infof("Reader.Run resuming read to follow the input")
+					readFinished = false
+					go r.read()
 				}
-				resp.blockIDs = append(resp.blockIDs, BlockIDOffset{
-					BlockID: id,
-					Offset:  offset,
-				})
 			}
-			glog.Infof("Search %q found %d possible blocks and %d matching", query, len(results), len(resp.blockIDs))
-
+			mu.Unlock()
 			req.respC <- resp
 			continue
 		}
 		if req.getLine != nil {
 			mu.Lock()
-			idx := *req.getLine
-			if idx < 0 || idx > len(newlines)-1 {
-				resp.err = fmt.Errorf("Invalid getLine idx %d; can't exceed %d", idx, len(newlines))
-				mu.Unlock()
-				req.respC <- resp
-				continue
-			}
-
-			start, end := BlockIDOffset{0, 0}, newlines[idx]
-			if idx > 0 {
-				start = newlines[idx-1]
-				start.Offset++
-				if start.Offset > r.BlockSize {
-					start.Offset = 0
-					start.BlockID++
-				}
+			resp.blockIDOffsetRange, resp.err = lineRange(*req.getLine, blocks, newlines)
+			mu.Unlock()
+			req.respC <- resp
+			continue
+		}
+		if req.getOffset != nil {
+			mu.Lock()
+			offset := *req.getOffset
+			if offset < 0 || offset >= readStatus.BytesRead {
+				resp.err = fmt.Errorf("Invalid offset %d; only %d bytes were read", offset, readStatus.BytesRead)
+			} else {
+				id := sort.Search(len(blockOffsets), func(i int) bool {
+					return blockOffsets[i] > offset
+				}) - 1
+				resp.blockIDOffset = &BlockIDOffset{id, offset - blockOffsets[id]}
 			}
-			resp.blockIDOffsetRange = &BlockIDOffsetRange{start, end}
 			mu.Unlock()
 			req.respC <- resp
 			continue
@@ -409,15 +917,120 @@ func (r *Reader) Run(eventC chan Event) {
 	r.doneC <- true
 }
 
-// Returns the index of the string in the block. -1 if it's not found.
-func (r *Reader) blockIDContains(id int, blocks []*Block, query string) int {
+// lineRange returns the range of the line with the index, which ends with a
+// newline unless it's the last line.
+func lineRange(idx int, blocks []*Block, newlines []BlockIDOffset) (*BlockIDOffsetRange, error) {
+	if idx < 0 || idx > len(newlines) {
+		return nil, fmt.Errorf("Invalid getLine idx %d; can't exceed %d", idx, len(newlines))
+	}
+	start := BlockIDOffset{0, 0}
+	if idx > 0 {
+		start = newlines[idx-1]
+		start.Offset++
+	}
+	// The line starts in the next (non-empty) block if the newline was the
+	// last byte of its block.
+	for start.BlockID < len(blocks) && start.Offset >= len(blocks[start.BlockID].Bytes) {
+		start = BlockIDOffset{start.BlockID + 1, 0}
+	}
+	if idx < len(newlines) {
+		return &BlockIDOffsetRange{start, newlines[idx]}, nil
+	}
+	// The last line doesn't end with a newline (yet), if there is one.
+	if start.BlockID >= len(blocks) {
+		return nil, fmt.Errorf("Invalid getLine idx %d; can't exceed %d", idx, len(newlines)-1)
+	}
+	last := blocks[len(blocks)-1]
+	end := BlockIDOffset{last.ID, len(last.Bytes) - 1}
+	for end.Offset < 0 {
+		last = blocks[end.BlockID-1]
+		end = BlockIDOffset{last.ID, len(last.Bytes) - 1}
+	}
+	return &BlockIDOffsetRange{start, end}, nil
+}
+
+// Returns the bytes of the block followed by IndexNextBytes of the next block
+// (if present); this is what was indexed for the block.
+func (r *Reader) blockWithNext(id int, blocks []*Block) string {
 	var sb strings.Builder
 	sb.Write(blocks[id].Bytes)
 	if id < len(blocks)-1 {
-		sb.Write(blocks[id+1].Bytes[:r.IndexNextBytes])
+		next := blocks[id+1].Bytes
+		if len(next) > r.IndexNextBytes {
+			next = next[:r.IndexNextBytes]
+		}
+		sb.Write(next)
+	}
+	return sb.String()
+}
+
+// binaryQuery returns true if the index is queried for the bytes of the
+// query rather than its runes (see trigram.ToBinaryTrigram). The runes of a
+// query for binary data may be decoded differently in a block, along with the
+// bytes next to them, and a query for a few runes of more than one byte (like
+// "日本") has no trigrams of runes.
+func binaryQuery(query string) bool {
+	return !utf8.ValidString(query) || len(trigram.ToTrigram(query)) == 0
+}
+
+// indexed returns the text of the doc that is indexed (and searched).
+func (r *Reader) indexed(doc string) string {
+	if !r.IgnoreEscapes {
+		return doc
 	}
-	// glog.Infof("blockIDContains(%d, %q) checking %q", id, query, sb.String())
-	return strings.Index(sb.String(), query)
+	stripped, _ := ansi.Strip(doc)
+	return stripped
+}
+
+// Returns the text of the blocks from id to end followed by IndexNextBytes of
+// the next block that is searched (see indexed), along with the offset from
+// the start of the first block of each byte of it (or nil if they're the
+// same).
+func (r *Reader) searchedText(id, end int, blocks []*Block) (string, []int) {
+	var text string
+	if id == end {
+		text = r.blockWithNext(id, blocks)
+	} else {
+		var sb strings.Builder
+		for i := id; i < end; i++ {
+			sb.Write(blocks[i].Bytes)
+		}
+		sb.WriteString(r.blockWithNext(end, blocks))
+		text = sb.String()
+	}
+	if !r.IgnoreEscapes {
+		return text, nil
+	}
+	return ansi.Strip(text)
+}
+
+// Returns the index of the string in the block. -1 if it's not found.
+func (r *Reader) blockIDContains(id int, blocks []*Block, query string) int {
+	// glog.Infof("blockIDContains(%d, %q) checking %q", id, query, r.blockWithNext(id, blocks))
+	text, offsets := r.searchedText(id, id, blocks)
+	idx := strings.Index(text, query)
+	if idx == -1 || offsets == nil {
+		return idx
+	}
+	return offsets[idx]
+}
+
+// Returns the index of the first match of the regexp that starts in the block,
+// which may go on until the end block. -1 if there is none.
+func (r *Reader) blockIDMatches(id, end int, blocks []*Block, re *regexp.Regexp) int {
+	text, offsets := r.searchedText(id, end, blocks)
+	loc := re.FindStringIndex(text)
+	if loc == nil || loc[0] == len(text) {
+		return -1
+	}
+	start := loc[0]
+	if offsets != nil {
+		start = offsets[start]
+	}
+	if start >= len(blocks[id].Bytes) {
+		return -1
+	}
+	return start
 }
 
 func (r *Reader) sendRequest(req chanRequest) chanResponse {
@@ -473,15 +1086,108 @@ func (r *Reader) GetBytes(loc BlockIDOffsetRange) ([]byte, error) {
 	return bb.Bytes(), nil
 }
 
+// BlockIDsContaining returns the blocks in which the query starts. Candidate
+// blocks are found with the trigram index and then confirmed by reading them.
 func (r *Reader) BlockIDsContaining(query string) ([]BlockIDOffset, error) {
+	return collectBlockIDs(func(resultC chan<- BlockIDOffset) error {
+		return r.StreamBlockIDsContaining(context.Background(), query, resultC)
+	})
+}
+
+// BlockIDsMatching returns the blocks in which a match of the regexp starts.
+// Candidate blocks are found with the trigram index and then confirmed with
+// the regexp. Unlike with BlockIDsContaining(), a match may go on past the
+// next block, to the end of the line it's in (as far as it has been read).
+func (r *Reader) BlockIDsMatching(re *regexp.Regexp) ([]BlockIDOffset, error) {
+	return collectBlockIDs(func(resultC chan<- BlockIDOffset) error {
+		return r.StreamBlockIDsMatching(context.Background(), re, resultC)
+	})
+}
+
+// StreamBlockIDsContaining is like BlockIDsContaining, but each block is sent
+// on resultC (in order) as soon as it's confirmed. resultC is closed when the
+// search ends, which is early (with the error) if the context is canceled.
+func (r *Reader) StreamBlockIDsContaining(ctx context.Context, query string, resultC chan<- BlockIDOffset) error {
 	resp := r.sendRequest(chanRequest{
 		blockIDsContaining: &query,
 	})
-	return resp.blockIDs, resp.err
+	return r.streamBlocks(ctx, fmt.Sprintf("%q", query), resp, func(id, end int, blocks []*Block) int {
+		return r.blockIDContains(id, blocks, query)
+	}, resultC)
+}
+
+// StreamBlockIDsMatching is like BlockIDsMatching, but streams the blocks
+// (see StreamBlockIDsContaining).
+func (r *Reader) StreamBlockIDsMatching(ctx context.Context, re *regexp.Regexp, resultC chan<- BlockIDOffset) error {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		close(resultC)
+		return fmt.Errorf("syntax.Parse(%q): %w", re, err)
+	}
+	resp := r.sendRequest(chanRequest{
+		blockIDsMatching: &regexpQuery{
+			re:   re,
+			plan: trigram.RegexpQuery(parsed.Simplify()),
+		},
+	})
+	return r.streamBlocks(ctx, fmt.Sprintf("/%v/", re), resp, func(id, end int, blocks []*Block) int {
+		return r.blockIDMatches(id, end, blocks, re)
+	}, resultC)
+}
+
+// streamBlocks sends the candidate blocks of the response for which offsetIn
+// (like blockIDMatches) returns an offset, and then closes resultC. A match
+// may go on until the end block, which is the block itself unless the response
+// has the lineEnds.
+func (r *Reader) streamBlocks(ctx context.Context, desc string, resp chanResponse, offsetIn func(id, end int, blocks []*Block) int, resultC chan<- BlockIDOffset) error {
+	defer close(resultC)
+	if resp.err != nil {
+		return resp.err
+	}
+	found := 0
+	for _, id := range resp.candidates {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := id
+		if resp.lineEnds != nil {
+			end = resp.lineEnds[id]
+		}
+		offset := offsetIn(id, end, resp.blocks)
+		if offset == -1 {
+			continue
+		}
+		select {
+		case resultC <- BlockIDOffset{BlockID: id, Offset: offset}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		found++
+	}
+	glog.Infof("Search %s found %d possible blocks and %d matching", desc, len(resp.candidates), found)
+	return nil
+}
+
+// collectBlockIDs returns all of the blocks that the stream sends.
+func collectBlockIDs(stream func(resultC chan<- BlockIDOffset) error) ([]BlockIDOffset, error) {
+	resultC := make(chan BlockIDOffset)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- stream(resultC)
+	}()
+	var result []BlockIDOffset
+	for bio := range resultC {
+		result = append(result, bio)
+	}
+	if err := <-errC; err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 // GetLine returns the range of block + offset that contain the bytes of the
-// given line (which is byte range terminated by '\n').
+// given line (which is byte range terminated by the LineSeparator, except for
+// the last line of the input read so far).
 func (r *Reader) GetLine(idx int) (*BlockIDOffsetRange, error) {
 	resp := r.sendRequest(chanRequest{
 		getLine: &idx,
@@ -489,8 +1195,28 @@ func (r *Reader) GetLine(idx int) (*BlockIDOffsetRange, error) {
 	return resp.blockIDOffsetRange, resp.err
 }
 
+// GetOffset returns the block + offset of the byte at the given offset in the
+// input.
+func (r *Reader) GetOffset(offset int) (*BlockIDOffset, error) {
+	resp := r.sendRequest(chanRequest{
+		getOffset: &offset,
+	})
+	return resp.blockIDOffset, resp.err
+}
+
+// Follow puts the reader into follow mode (see Config.Follow). If the input
+// had already been read completely, reading resumes from where it stopped.
+func (r *Reader) Follow() {
+	r.sendRequest(chanRequest{
+		follow: true,
+	})
+}
+
 func (r *Reader) Stop() {
-	close(r.readC)
+	close(r.stopC)
 	close(r.reqC)
 	<-r.doneC
+	if r.reopened != nil {
+		r.reopened.Close()
+	}
 }
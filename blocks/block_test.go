@@ -1,8 +1,14 @@
 package blocks
 
 import (
+	"context"
 	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"testing"
+	"time"
 )
 
 type blockIDsContainsTest struct {
@@ -209,6 +215,164 @@ func TestNewlines(t *testing.T) {
 	}
 }
 
+func TestLineSeparator(t *testing.T) {
+	r := func(fromID, fromOffset, toID, toOffset int) BlockIDOffsetRange {
+		return BlockIDOffsetRange{BlockIDOffset{fromID, fromOffset}, BlockIDOffset{toID, toOffset}}
+	}
+	for _, tc := range []struct {
+		sep   string
+		input string
+		want  []BlockIDOffsetRange
+	}{
+		// The blocks are "ab\r\nc" and "d\r\nef".
+		{"\r\n", "ab\r\ncd\r\nef", []BlockIDOffsetRange{r(0, 0, 0, 3), r(0, 4, 1, 2), r(1, 3, 1, 4)}},
+		// The blocks are "a\x00bcd" and "ef\x00g".
+		{"\x00", "a\x00bcdef\x00g", []BlockIDOffsetRange{r(0, 0, 0, 1), r(0, 2, 1, 2), r(1, 3, 1, 3)}},
+		// The separators are split across the blocks "abcd-", "-efg-" and
+		// "-h".
+		{"--", "abcd--efg--h", []BlockIDOffsetRange{r(0, 0, 1, 0), r(1, 1, 2, 0), r(2, 1, 2, 1)}},
+		// The bytes of a separator aren't used again for the next one.
+		{"aa", "xxxxaaab", []BlockIDOffsetRange{r(0, 0, 1, 0), r(1, 1, 1, 2)}},
+	} {
+		config := defaultConfig
+		config.LineSeparator = []byte(tc.sep)
+		h := newHarness(t, config)
+		h.runAndSendOnly(t, tc.input)
+
+		for i, want := range tc.want {
+			got, err := h.r.GetLine(i)
+			if err != nil {
+				t.Errorf("%q: GetLine(%d): %v", tc.sep, i, err)
+			} else if *got != want {
+				t.Errorf("%q: GetLine(%d): got %v, want %v", tc.sep, i, got, want)
+			}
+		}
+		if got, err := h.r.GetLine(len(tc.want)); err == nil {
+			t.Errorf("%q: GetLine(%d): got %v, wanted err", tc.sep, len(tc.want), got)
+		}
+		h.r.Stop()
+	}
+}
+
+func TestGetOffset(t *testing.T) {
+	h := newHarness(t, defaultConfig)
+	h.runAndSendOnly(t, "abc\n12345\n67")
+	defer h.r.Stop()
+
+	// The blocks are "abc\n1", "2345\n" and "67".
+	for _, tc := range []struct {
+		offset  int
+		want    BlockIDOffset
+		wantErr bool
+	}{
+		{0, BlockIDOffset{0, 0}, false},
+		{4, BlockIDOffset{0, 4}, false},
+		{5, BlockIDOffset{1, 0}, false},
+		{11, BlockIDOffset{2, 1}, false},
+		{12, BlockIDOffset{}, true},
+		{-1, BlockIDOffset{}, true},
+	} {
+		got, err := h.r.GetOffset(tc.offset)
+		if err != nil {
+			if !tc.wantErr {
+				t.Errorf("GetOffset(%d): %v", tc.offset, err)
+			}
+			continue
+		}
+		if tc.wantErr {
+			t.Errorf("GetOffset(%d): got %v, wanted err", tc.offset, got)
+		} else if *got != tc.want {
+			t.Errorf("GetOffset(%d): got %v, want %v", tc.offset, got, tc.want)
+		}
+	}
+
+	// The last line starts in the block after its newline, and doesn't end
+	// with one.
+	for _, tc := range []struct {
+		line int
+		want BlockIDOffsetRange
+	}{
+		{1, BlockIDOffsetRange{BlockIDOffset{0, 4}, BlockIDOffset{1, 4}}},
+		{2, BlockIDOffsetRange{BlockIDOffset{2, 0}, BlockIDOffset{2, 1}}},
+	} {
+		got, err := h.r.GetLine(tc.line)
+		if err != nil {
+			t.Errorf("GetLine(%d): %v", tc.line, err)
+		} else if *got != tc.want {
+			t.Errorf("GetLine(%d): got %v, want %v", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestIgnoreEscapes(t *testing.T) {
+	const input = "ok\n\x1b[31mFA\x1b[1mIL\x1b[0m\nok\n"
+	for _, tc := range []struct {
+		ignoreEscapes bool
+		tests         []blockIDsContainsTest
+	}{
+		{false, []blockIDsContainsTest{
+			{"FAIL", []int{}},
+			{"[31m", []int{0}},
+		}},
+		{true, []blockIDsContainsTest{
+			{"FAIL", []int{0}},
+			{"ok\nFAIL\nok", []int{0}},
+			{"[31m", []int{}},
+		}},
+	} {
+		config := Config{
+			BlockSize:      20,
+			IndexNextBytes: 10,
+			IgnoreEscapes:  tc.ignoreEscapes,
+		}
+		h := newHarness(t, config)
+		h.runAndSendOnly(t, input)
+		for _, test := range tc.tests {
+			test.run(t, h.r)
+		}
+
+		// The match starts at the F, after the escape sequence.
+		ids, err := h.r.BlockIDsMatching(regexp.MustCompile("F.IL"))
+		if err != nil {
+			t.Errorf("BlockIDsMatching(): %v", err)
+		} else if tc.ignoreEscapes && (len(ids) != 1 || ids[0] != (BlockIDOffset{0, 8})) {
+			t.Errorf("BlockIDsMatching(): got %v, want [{0, 8}]", ids)
+		} else if !tc.ignoreEscapes && len(ids) != 0 {
+			t.Errorf("BlockIDsMatching(): got %v, want none", ids)
+		}
+		h.r.Stop()
+	}
+}
+
+func TestBinaryQuery(t *testing.T) {
+	// The bytes of the queries are decoded as other runes in the blocks: like
+	// "\xe6\x97\xa5" at the end of the first block, and "\xbe" after
+	// "\xe6\x97" in the second. So the index is queried for the bytes.
+	const input = "\x00\x01\xde\xad\xbe\xef\x02\xe6\x97\xa5\xe6\x97\xbe\xef\x00\x00"
+	config := Config{
+		BlockSize:      8,
+		IndexNextBytes: 4,
+	}
+	h := newHarness(t, config)
+	h.runAndSendOnly(t, input)
+	defer h.r.Stop()
+	for _, test := range []blockIDsContainsTest{
+		{"\xde\xad\xbe\xef", []int{0}},
+		{"\xad\xbe\xef\x02", []int{0}},
+		{"\x02\xe6\x97", []int{0}},
+		{"\x97\xbe\xef", []int{1}},
+		{"\xbe\xef\x02", []int{0}},
+		// A single rune.
+		{"\xe6\x97\xa5", []int{0}},
+		// Too short for a trigram.
+		{"\xbe\xef", []int{}},
+		{"\xef\x00\x00", []int{1}},
+		{"\xde\xad\xbe\xee", []int{}},
+	} {
+		test.run(t, h.r)
+	}
+}
+
 func TestGetBlockRange(t *testing.T) {
 	h := newHarness(t, defaultConfig)
 	h.runAndSendOnly(t, "abc\n123\n")
@@ -231,3 +395,222 @@ func TestGetBlockRange(t *testing.T) {
 		}
 	}
 }
+
+func TestBlockIDsMatchingAcrossBlocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "input.log")
+	// The blocks are "x req_id", "=deadbee", "f y\nreq_" and "id=12\n".
+	if err := os.WriteFile(path, []byte("x req_id=deadbeef y\nreq_id=12\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := readFile(t, path, Config{
+		BlockSize:      8,
+		IndexNextBytes: 2,
+	})
+
+	for _, tc := range []struct {
+		expr string
+		want []BlockIDOffset
+	}{
+		// A match goes on to the end of its line, past the next block.
+		{`req_id=[0-9a-f]{8}`, []BlockIDOffset{{0, 2}}},
+		{`x.*y`, []BlockIDOffset{{0, 0}}},
+		{`deadbeef y`, []BlockIDOffset{{1, 1}}},
+		{`(?m)^req_id=\d+$`, []BlockIDOffset{{2, 4}}},
+		{`req_id=\d+`, []BlockIDOffset{{2, 4}}},
+		{`deadbeef z`, nil},
+	} {
+		got, err := r.BlockIDsMatching(regexp.MustCompile(tc.expr))
+		if err != nil {
+			t.Errorf("BlockIDsMatching(%q): %v", tc.expr, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("BlockIDsMatching(%q): got %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestLineSpans(t *testing.T) {
+	var blocks []*Block
+	var newlines []BlockIDOffset
+	var sepTail []byte
+	// The last line hasn't ended.
+	for i, str := range []string{"ab\ncd", "efghi", "j\nk\nl", "mnop\n", "qrs"} {
+		block := &Block{ID: i, Bytes: []byte(str)}
+		var nls []BlockIDOffset
+		nls, sepTail = block.findNewlines([]byte("\n"), sepTail)
+		newlines = append(newlines, nls...)
+		blocks = append(blocks, block)
+	}
+	starts, ends := lineSpans(blocks, newlines)
+	if want := []int{0, 0, 0, 2, 4}; !reflect.DeepEqual(starts, want) {
+		t.Errorf("Starts: got %v, want %v", starts, want)
+	}
+	if want := []int{2, 2, 3, 4, 4}; !reflect.DeepEqual(ends, want) {
+		t.Errorf("Ends: got %v, want %v", ends, want)
+	}
+}
+
+func TestStreamBlockIDsCanceled(t *testing.T) {
+	h := newHarness(t, defaultConfig)
+	// The blocks are "abc\na", "bc\nab" and "c\n", the first two of which
+	// start the query.
+	h.runAndSendOnly(t, "abc\nabc\nabc\n")
+	defer h.r.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resultC := make(chan BlockIDOffset)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- h.r.StreamBlockIDsContaining(ctx, "abc", resultC)
+	}()
+
+	if got, want := <-resultC, (BlockIDOffset{0, 0}); got != want {
+		t.Errorf("First block: got %v, want %v", got, want)
+	}
+	cancel()
+	if err := <-errC; err != context.Canceled {
+		t.Errorf("StreamBlockIDsContaining() after cancel: got %v, want %v", err, context.Canceled)
+	}
+	for bio := range resultC {
+		t.Errorf("Got block %v after cancel", bio)
+	}
+
+	// A search that isn't canceled finds all of the blocks.
+	bios, err := h.r.BlockIDsContaining("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []BlockIDOffset{{0, 0}, {1, 3}}; !reflect.DeepEqual(bios, want) {
+		t.Errorf("BlockIDsContaining(): got %v, want %v", bios, want)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "follow.log")
+	write := func(str string, flag int) {
+		t.Helper()
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|flag, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(str); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("abc\n", os.O_TRUNC)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := NewReader(Config{
+		Source: ConfigSource{
+			Input: f,
+			Size:  4,
+			Path:  path,
+		},
+		BlockSize:      5,
+		IndexNextBytes: 2,
+		Follow:         true,
+		PollInterval:   5 * time.Millisecond,
+		FlushAfter:     5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventC := make(chan Event, 10)
+	go r.Run(eventC)
+	defer r.Stop()
+
+	assertNextBlock := func(want string) {
+		t.Helper()
+		select {
+		case event := <-eventC:
+			if event.NewBlock == nil || string(event.NewBlock.Bytes) != want {
+				t.Fatalf("Got event %v, want block %q", event, want)
+			}
+			if got := event.Status.RemainingBytes; got != -1 {
+				t.Errorf("Got %d remaining bytes, want -1", got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for block %q", want)
+		}
+	}
+
+	assertReset := func() {
+		t.Helper()
+		select {
+		case event := <-eventC:
+			if !event.Reset || event.Status.BytesRead != 0 {
+				t.Fatalf("Got event %v, want a reset", event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for a reset")
+		}
+	}
+
+	assertNextBlock("abc\n")
+
+	write("def\n", os.O_APPEND)
+	assertNextBlock("def\n")
+
+	// The first block was indexed before the second was read.
+	blockIDsContainsTest{"c\nd", []int{0}}.run(t, r)
+
+	// Truncate the file.
+	write("gh\n", os.O_TRUNC)
+	assertReset()
+	assertNextBlock("gh\n")
+	// The blocks of before are gone.
+	blockIDsContainsTest{"c\nd", []int{}}.run(t, r)
+	if block, err := r.GetBlock(0); err != nil || string(block.Bytes) != "gh\n" {
+		t.Errorf("GetBlock(0): got %v, %v; want %q", block, err, "gh\n")
+	}
+
+	// Truncate the file, and write more than was read before (between two
+	// polls).
+	write("klmn\n", os.O_TRUNC)
+	assertReset()
+	assertNextBlock("klmn\n")
+	if lr, err := r.GetLine(0); err != nil || lr.End.BlockID != 0 || lr.End.Offset != 4 {
+		t.Errorf("GetLine(0): got %v, %v; want it to end at offset 4 of block 0", lr, err)
+	}
+
+	// Rotate the file.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	write("ij\n", 0)
+	assertReset()
+	assertNextBlock("ij\n")
+}
+
+func TestFollowAfterEOF(t *testing.T) {
+	h := newHarness(t, defaultConfig)
+	h.r.PollInterval = 5 * time.Millisecond
+	eventC := make(chan Event, 10)
+	go h.r.Run(eventC)
+	defer h.r.Stop()
+
+	h.send(t, "abc\n")
+	h.writer.Close()
+
+	event := <-eventC
+	if got := event.Status.RemainingBytes; got != 0 {
+		t.Fatalf("Got %d remaining bytes, want 0", got)
+	}
+
+	// Following a closed pipe is pointless, but it exercises resuming the read.
+	h.r.Follow()
+	select {
+	case event := <-eventC:
+		t.Errorf("Got unexpected event %v", event)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if _, err := h.r.GetBlock(0); err != nil {
+		t.Errorf("GetBlock(0): %v", err)
+	}
+}
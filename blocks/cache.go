@@ -0,0 +1,229 @@
+package blocks
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ewaters/meno/trigram"
+	"github.com/golang/glog"
+)
+
+// How many bytes from the start of the file are hashed for the CacheKey.
+const cacheHeadBytes = 64 * 1024
+
+// Bumped whenever the format of a cache file changes.
+const cacheVersion = 3
+
+const defaultCacheMaxBytes = 1 << 30
+
+// A CacheKey identifies the file (and Config) that a cached index was built
+// from. A cache is only used if its key is equal to that of the file now.
+type CacheKey struct {
+	Path     string
+	Size     int64
+	ModTime  time.Time
+	HeadHash [sha256.Size]byte
+
+	BlockSize      int
+	IndexNextBytes int
+	IgnoreEscapes  bool
+	LineSeparator  string
+}
+
+// NewCacheKey returns the key for the file at path as it is now.
+func NewCacheKey(path string, config Config) (CacheKey, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return CacheKey{}, err
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		return CacheKey{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return CacheKey{}, err
+	}
+	key := CacheKey{
+		Path:           abs,
+		Size:           info.Size(),
+		ModTime:        info.ModTime(),
+		BlockSize:      config.BlockSize,
+		IndexNextBytes: config.IndexNextBytes,
+		IgnoreEscapes:  config.IgnoreEscapes,
+		LineSeparator:  string(config.LineSeparator),
+	}
+	if key.LineSeparator == "" {
+		key.LineSeparator = string(defaultLineSeparator)
+	}
+	h := sha256.New()
+	if _, err := io.CopyN(h, f, cacheHeadBytes); err != nil && err != io.EOF {
+		return CacheKey{}, err
+	}
+	copy(key.HeadHash[:], h.Sum(nil))
+	return key, nil
+}
+
+func (ck CacheKey) equal(other CacheKey) bool {
+	return ck.Path == other.Path &&
+		ck.Size == other.Size &&
+		ck.ModTime.Equal(other.ModTime) &&
+		ck.HeadHash == other.HeadHash &&
+		ck.BlockSize == other.BlockSize &&
+		ck.IndexNextBytes == other.IndexNextBytes &&
+		ck.IgnoreEscapes == other.IgnoreEscapes &&
+		ck.LineSeparator == other.LineSeparator
+}
+
+// The file in dir that the index of the file is cached in.
+func (ck CacheKey) cachePath(dir string) string {
+	sum := sha256.Sum256([]byte(ck.Path))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".idx")
+}
+
+// The header of a cache file, which is followed by the encoded index.
+type cacheHeader struct {
+	Version int
+	Key     CacheKey
+
+	// The length of each block, to check that the file is being read into
+	// the same blocks as when it was cached.
+	BlockLengths []int
+	Newlines     []BlockIDOffset
+}
+
+// A cachedIndex is everything Reader.Run() builds from the blocks of a file.
+type cachedIndex struct {
+	cacheHeader
+	index *trigram.Index
+}
+
+// loadCache returns the index cached in dir for the key, or nil if there is no
+// valid cache.
+func loadCache(dir string, key CacheKey) *cachedIndex {
+	path := key.cachePath(dir)
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("Open(%q): %v", path, err)
+		}
+		return nil
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var c cachedIndex
+	if err := gob.NewDecoder(br).Decode(&c.cacheHeader); err != nil {
+		glog.Warningf("Failed to decode cache header from %q: %v", path, err)
+		return nil
+	}
+	if c.Version != cacheVersion || !c.Key.equal(key) {
+		glog.Infof("Cache %q is stale", path)
+		return nil
+	}
+	if c.index, err = trigram.DecodeIndex(br); err != nil {
+		glog.Warningf("Cache %q: %v", path, err)
+		return nil
+	}
+	glog.Infof("Loaded index of %d blocks from cache %q", len(c.BlockLengths), path)
+	// The modification time says when it was used last (see pruneCache).
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		glog.Warningf("Chtimes(%q): %v", path, err)
+	}
+	return &c
+}
+
+// save writes the cache to dir, unless it would take more than a quarter of
+// maxBytes, and then prunes the cache to maxBytes. It's written to a temporary
+// file first so that a concurrent loadCache() never sees a partial file.
+func (c *cachedIndex) save(dir string, maxBytes int64) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "tmp-*.idx")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	c.Version = cacheVersion
+	bw := bufio.NewWriter(f)
+	if err := gob.NewEncoder(bw).Encode(&c.cacheHeader); err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to encode cache header: %w", err)
+	}
+	if err := c.index.Encode(bw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		return err
+	}
+	if size := info.Size(); size > maxBytes/4 {
+		glog.Infof("Not caching the index of %q: it takes %d bytes", c.Key.Path, size)
+		return nil
+	}
+	if err := os.Rename(f.Name(), c.Key.cachePath(dir)); err != nil {
+		return err
+	}
+	return pruneCache(dir, maxBytes)
+}
+
+// pruneCache removes the cache files in dir that were used least recently
+// (modified longest ago) until the others take at most maxBytes.
+func pruneCache(dir string, maxBytes int64) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || filepath.Ext(name) != ".idx" || strings.HasPrefix(name, "tmp-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// It was removed since.
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, info := range files {
+		if total <= maxBytes {
+			break
+		}
+		path := filepath.Join(dir, info.Name())
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		glog.Infof("Removed %q (%d bytes) from the cache", path, info.Size())
+		total -= info.Size()
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package blocks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readFile reads the file at path to the end with a new Reader. By then, its
+// index is cached if config.CacheDir is set.
+func readFile(t *testing.T, path string, config Config) *Reader {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Source = ConfigSource{
+		Input: f,
+		Size:  int(info.Size()),
+		Path:  path,
+	}
+	r, err := NewReader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventC := make(chan Event, 10)
+	go r.Run(eventC)
+	t.Cleanup(r.Stop)
+	for e := range eventC {
+		if e.Status.RemainingBytes == 0 {
+			break
+		}
+	}
+	return r
+}
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.log")
+	if err := os.WriteFile(path, []byte("abc\n123\nxyz\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := defaultConfig
+	config.CacheDir = filepath.Join(dir, "cache")
+
+	key, err := NewCacheKey(path, config)
+	if err != nil {
+		t.Fatalf("NewCacheKey(): %v", err)
+	}
+	if c := loadCache(config.CacheDir, key); c != nil {
+		t.Fatalf("loadCache() before reading the file: got %v, want nil", c)
+	}
+
+	assertReader := func(r *Reader) {
+		t.Helper()
+		for _, tc := range []blockIDsContainsTest{
+			{"bc\n1", []int{0}},
+			{"c\n12", []int{0}},
+			{"23\n", []int{1}},
+			{"xyz", []int{1}},
+		} {
+			tc.run(t, r)
+		}
+		got, err := r.GetLine(2)
+		if err != nil {
+			t.Fatalf("GetLine(2): %v", err)
+		}
+		if want := (BlockIDOffsetRange{BlockIDOffset{1, 3}, BlockIDOffset{2, 1}}); got.String() != want.String() {
+			t.Errorf("GetLine(2): got %v, want %v", got, want)
+		}
+	}
+
+	assertReader(readFile(t, path, config))
+	c := loadCache(config.CacheDir, key)
+	if c == nil {
+		t.Fatalf("loadCache() after reading the file: got nil")
+	}
+	if got, want := len(c.BlockLengths), 3; got != want {
+		t.Errorf("Cached %d block lengths, want %d", got, want)
+	}
+
+	// This time, the index comes from the cache.
+	assertReader(readFile(t, path, config))
+
+	// If the blocks don't match, the index is built again.
+	c.BlockLengths[1] = 1
+	if err := c.save(config.CacheDir, defaultCacheMaxBytes); err != nil {
+		t.Fatalf("save(): %v", err)
+	}
+	assertReader(readFile(t, path, config))
+
+	// Nor is the cache used for a file that changed.
+	if err := os.WriteFile(path, []byte("abc\n123\nxyz\n..."), 0644); err != nil {
+		t.Fatal(err)
+	}
+	key, err = NewCacheKey(path, config)
+	if err != nil {
+		t.Fatalf("NewCacheKey(): %v", err)
+	}
+	if c := loadCache(config.CacheDir, key); c != nil {
+		t.Errorf("loadCache() of a changed file: got a cache, want nil")
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	dir := t.TempDir()
+	config := defaultConfig
+	config.CacheDir = filepath.Join(dir, "cache")
+
+	var paths []string
+	for i, name := range []string{"a.log", "b.log", "c.log"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(strings.Repeat("abc\n", 100*(i+1))), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	keys := make(map[string]CacheKey)
+	sizes := make(map[string]int64)
+	for i, path := range paths {
+		readFile(t, path, config)
+		key, err := NewCacheKey(path, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(key.cachePath(config.CacheDir))
+		if err != nil {
+			t.Fatalf("Stat() of the cache of %q: %v", path, err)
+		}
+		keys[path], sizes[path] = key, info.Size()
+		// The files are used in order, a second apart.
+		used := time.Now().Add(time.Duration(i-len(paths)) * time.Second)
+		if err := os.Chtimes(key.cachePath(config.CacheDir), used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b, c := paths[0], paths[1], paths[2]
+
+	// Loading a.log makes it the most recently used one.
+	if loadCache(config.CacheDir, keys[a]) == nil {
+		t.Fatalf("loadCache(%q): got nil", a)
+	}
+	if err := pruneCache(config.CacheDir, sizes[a]+sizes[c]); err != nil {
+		t.Fatalf("pruneCache(): %v", err)
+	}
+	for path, want := range map[string]bool{a: true, b: false, c: true} {
+		if got := loadCache(config.CacheDir, keys[path]) != nil; got != want {
+			t.Errorf("After pruneCache(): cache of %q: got %v, want %v", path, got, want)
+		}
+	}
+
+	// An index that would take too much of the cache isn't cached.
+	if sizes[c] <= sizes[b] {
+		t.Fatalf("The cache of %q takes %d bytes, want more than the %d of %q", c, sizes[c], sizes[b], b)
+	}
+	config.CacheMaxBytes = 4 * sizes[b]
+	if err := os.Remove(keys[c].cachePath(config.CacheDir)); err != nil {
+		t.Fatal(err)
+	}
+	readFile(t, b, config)
+	readFile(t, c, config)
+	for path, want := range map[string]bool{b: true, c: false} {
+		if got := loadCache(config.CacheDir, keys[path]) != nil; got != want {
+			t.Errorf("With CacheMaxBytes %d: cache of %q: got %v, want %v", config.CacheMaxBytes, path, got, want)
+		}
+	}
+}
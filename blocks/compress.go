@@ -0,0 +1,162 @@
+package blocks
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/golang/glog"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// The compression format of an input.
+type Compression string
+
+const (
+	CompressionNone  Compression = ""
+	CompressionGzip  Compression = "gzip"
+	CompressionZstd  Compression = "zstd"
+	CompressionBzip2 Compression = "bzip2"
+	CompressionXz    Compression = "xz"
+)
+
+// The magic bytes at the start of each compression format, and a check of the
+// rest of its header (which may be cut short at zstd.HeaderMaxSize bytes). A
+// plain input may start with the magic bytes too, so it's only decompressed
+// if the header is valid.
+var compressionMagic = []struct {
+	compression Compression
+	magic       []byte
+	validHeader func(head []byte) bool
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}, func(head []byte) bool {
+		_, err := gzip.NewReader(bytes.NewReader(head))
+		// The header may have a file name that goes on past the head (but not
+		// past the end of the input).
+		return err == nil || (err == io.ErrUnexpectedEOF && len(head) == zstd.HeaderMaxSize)
+	}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}, func(head []byte) bool {
+		var h zstd.Header
+		return h.Decode(head) == nil
+	}},
+	{CompressionBzip2, []byte("BZh"), func(head []byte) bool {
+		// The block size ('1'-'9'), then the magic of the first block or of
+		// the end of the stream.
+		if len(head) < 10 || head[3] < '1' || head[3] > '9' {
+			return false
+		}
+		magic := string(head[4:10])
+		return magic == "\x31\x41\x59\x26\x53\x59" || magic == "\x17\x72\x45\x38\x50\x90"
+	}},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, func(head []byte) bool {
+		// The stream flags and their CRC32.
+		if len(head) < 12 || head[6] != 0 || head[7]&0xf0 != 0 {
+			return false
+		}
+		return crc32.ChecksumIEEE(head[6:8]) == binary.LittleEndian.Uint32(head[8:12])
+	}},
+}
+
+// Decompress returns the source with its Input replaced by a reader of the
+// decompressed bytes, if the Input starts with the magic bytes and a valid
+// header of one of the Compression formats. The Size of the source is then the uncompressed size if
+// the format records it (and 0 otherwise), and Compression is set.
+func (cs ConfigSource) Decompress() (ConfigSource, error) {
+	result := cs
+	var head []byte
+	if rs, ok := seeker(cs.Input); ok {
+		// Keep the file as it is if it's not compressed, so that it can be
+		// followed (see Reader.reopenIfChanged).
+		head = make([]byte, zstd.HeaderMaxSize)
+		n, err := io.ReadFull(rs, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return cs, err
+		}
+		head = head[:n]
+		if _, err := rs.Seek(int64(-n), io.SeekCurrent); err != nil {
+			return cs, err
+		}
+	} else {
+		br := bufio.NewReader(cs.Input)
+		// Peek returns what it can before an error, like EOF for a short
+		// input.
+		head, _ = br.Peek(zstd.HeaderMaxSize)
+		result.Input = br
+	}
+	in := result.Input
+
+	for _, cm := range compressionMagic {
+		if !bytes.HasPrefix(head, cm.magic) {
+			continue
+		}
+		if cm.validHeader(head) {
+			result.Compression = cm.compression
+		} else {
+			glog.Warningf("Input starts with the magic bytes of %s, but its header isn't valid; reading it as it is", cm.compression)
+		}
+		break
+	}
+
+	var err error
+	switch result.Compression {
+	case CompressionNone:
+		return result, nil
+	case CompressionGzip:
+		result.Input, err = gzip.NewReader(in)
+		result.Size = gzipSize(cs)
+	case CompressionZstd:
+		var d *zstd.Decoder
+		d, err = zstd.NewReader(in, zstd.WithDecoderConcurrency(1))
+		if err == nil {
+			result.Input = d.IOReadCloser()
+		}
+		result.Size = 0
+		var h zstd.Header
+		if h.Decode(head) == nil && h.HasFCS {
+			result.Size = int(h.FrameContentSize)
+		}
+	case CompressionBzip2:
+		result.Input = bzip2.NewReader(in)
+		result.Size = 0
+	case CompressionXz:
+		result.Input, err = xz.NewReader(in)
+		result.Size = 0
+	}
+	if err != nil {
+		return cs, fmt.Errorf("Failed to read %s input: %w", result.Compression, err)
+	}
+	return result, nil
+}
+
+// seeker returns the input as an io.ReadSeeker if it can seek (unlike a pipe).
+func seeker(input io.Reader) (io.ReadSeeker, bool) {
+	rs, ok := input.(io.ReadSeeker)
+	if !ok {
+		return nil, false
+	}
+	if _, err := rs.Seek(0, io.SeekCurrent); err != nil {
+		return nil, false
+	}
+	return rs, true
+}
+
+// gzipSize returns the uncompressed size from the gzip trailer, or 0 if the
+// input can't be read from the end. The trailer only has the size modulo 2^32
+// (of the last member), so it's only an estimate.
+func gzipSize(cs ConfigSource) int {
+	ra, ok := cs.Input.(io.ReaderAt)
+	if !ok || cs.Size < 18 {
+		return 0
+	}
+	var trailer [4]byte
+	if _, err := ra.ReadAt(trailer[:], int64(cs.Size-4)); err != nil {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint32(trailer[:]))
+}
@@ -0,0 +1,157 @@
+package blocks
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const compressTestInput = "hello world\n"
+
+// compressTestInput compressed with `bzip2`, since there's no encoder in the
+// standard library.
+var bzip2TestInput = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x4e, 0xec, 0xe8,
+	0x36, 0x00, 0x00, 0x02, 0x51, 0x80, 0x00, 0x10, 0x40, 0x00, 0x06, 0x44, 0x90,
+	0x80, 0x20, 0x00, 0x31, 0x06, 0x4c, 0x41, 0x01, 0xa7, 0xa9, 0xa5, 0x80, 0xbb,
+	0x94, 0x31, 0xf8, 0xbb, 0x92, 0x29, 0xc2, 0x84, 0x82, 0x77, 0x67, 0x41, 0xb0,
+}
+
+func compressWith(t *testing.T, newWriter func(w io.Writer) (io.WriteCloser, error)) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := newWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, compressTestInput); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zstdEncodeAll compresses compressTestInput into a single frame which has the
+// uncompressed size in its header.
+func zstdEncodeAll(t *testing.T) []byte {
+	t.Helper()
+	enc, err := zstd.NewWriter(nil, zstd.WithSingleSegment(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	return enc.EncodeAll([]byte(compressTestInput), nil)
+}
+
+// A reader which can't seek, like a pipe.
+type onlyReader struct {
+	io.Reader
+}
+
+func TestDecompress(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		input    []byte
+		want     Compression
+		wantSize int
+	}{
+		{"plain", []byte(compressTestInput), CompressionNone, len(compressTestInput)},
+		{"gzip", compressWith(t, func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		}), CompressionGzip, len(compressTestInput)},
+		{"gzip with a long file name", compressWith(t, func(w io.Writer) (io.WriteCloser, error) {
+			gw := gzip.NewWriter(w)
+			gw.Name = "a-file-name-longer-than-the-head.log"
+			return gw, nil
+		}), CompressionGzip, len(compressTestInput)},
+		{"zstd", compressWith(t, func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		}), CompressionZstd, 0},
+		{"zstd with size", zstdEncodeAll(t), CompressionZstd, len(compressTestInput)},
+		{"bzip2", bzip2TestInput, CompressionBzip2, 0},
+		{"xz", compressWith(t, func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		}), CompressionXz, 0},
+	} {
+		for _, seekable := range []bool{true, false} {
+			source := ConfigSource{
+				Input: bytes.NewReader(tc.input),
+				Size:  len(tc.input),
+			}
+			wantSize := tc.wantSize
+			if !seekable {
+				source.Input = onlyReader{source.Input}
+				if tc.want == CompressionGzip {
+					// The size is read from the end of the input.
+					wantSize = 0
+				}
+			}
+			got, err := source.Decompress()
+			if err != nil {
+				t.Errorf("%s (seekable %v): Decompress(): %v", tc.name, seekable, err)
+				continue
+			}
+			if got.Compression != tc.want {
+				t.Errorf("%s (seekable %v): got compression %q, want %q", tc.name, seekable, got.Compression, tc.want)
+			}
+			if got.Size != wantSize {
+				t.Errorf("%s (seekable %v): got size %d, want %d", tc.name, seekable, got.Size, wantSize)
+			}
+			if tc.want == CompressionNone && seekable && got.Input != source.Input {
+				t.Errorf("%s (seekable %v): got a new Input for an uncompressed input", tc.name, seekable)
+			}
+			b, err := io.ReadAll(got.Input)
+			if err != nil {
+				t.Errorf("%s (seekable %v): ReadAll(): %v", tc.name, seekable, err)
+			} else if string(b) != compressTestInput {
+				t.Errorf("%s (seekable %v): read %q, want %q", tc.name, seekable, b, compressTestInput)
+			}
+		}
+	}
+}
+
+func TestDecompressInvalidHeader(t *testing.T) {
+	// Each starts with the magic bytes of a format, but isn't compressed.
+	for _, input := range []string{
+		"\x1f\x8b is not gzip\n",
+		"\x28\xb5\x2f\xfd\xff is not zstd\n",
+		"BZh is not bzip2\n",
+		"BZh9 is not bzip2 either\n",
+		"\xfd7zXZ\x00 is not xz\n",
+		// Too short to have a header.
+		"\x1f\x8b",
+	} {
+		for _, seekable := range []bool{true, false} {
+			source := ConfigSource{
+				Input: bytes.NewReader([]byte(input)),
+				Size:  len(input),
+			}
+			if !seekable {
+				source.Input = onlyReader{source.Input}
+			}
+			got, err := source.Decompress()
+			if err != nil {
+				t.Errorf("%q (seekable %v): Decompress(): %v", input, seekable, err)
+				continue
+			}
+			if got.Compression != CompressionNone {
+				t.Errorf("%q (seekable %v): got compression %q, want none", input, seekable, got.Compression)
+			}
+			if got.Size != len(input) {
+				t.Errorf("%q (seekable %v): got size %d, want %d", input, seekable, got.Size, len(input))
+			}
+			b, err := io.ReadAll(got.Input)
+			if err != nil {
+				t.Errorf("%q (seekable %v): ReadAll(): %v", input, seekable, err)
+			} else if string(b) != input {
+				t.Errorf("%q (seekable %v): read %q", input, seekable, b)
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package blocks
+
+import (
+	"sync"
+
+	"github.com/ewaters/meno/trigram"
+)
+
+// A shardedIndex indexes blocks in parallel. Each block is indexed by one of
+// its shards (by block ID), each with its own goroutine and trigram.Index, and
+// queries are run against all of them.
+type shardedIndex struct {
+	shards []*indexShard
+	// Whether add() indexes the docs for binary queries too (see
+	// trigram.Index.AddBinaryWithID). It's set by the caller of add, once the
+	// index is first queried for binary data, since most inputs never are.
+	binary bool
+}
+
+type indexShard struct {
+	jobC chan indexJob
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	index *trigram.Index
+	// How many jobs were sent on jobC but not indexed yet.
+	pending int
+}
+
+type indexJob struct {
+	doc string
+	id  uint64
+	// Which trigrams of the doc are indexed.
+	text, binary bool
+}
+
+func newShardedIndex(shards int) *shardedIndex {
+	if shards < 1 {
+		shards = 1
+	}
+	si := &shardedIndex{}
+	for i := 0; i < shards; i++ {
+		s := &indexShard{
+			jobC:  make(chan indexJob, 16),
+			index: trigram.NewIndex(),
+		}
+		s.cond = sync.NewCond(&s.mu)
+		si.shards = append(si.shards, s)
+		go s.run()
+	}
+	return si
+}
+
+func (s *indexShard) run() {
+	for job := range s.jobC {
+		s.mu.Lock()
+		if job.text {
+			s.index.AddWithID(job.doc, job.id)
+		}
+		if job.binary {
+			s.index.AddBinaryWithID(job.doc, job.id)
+		}
+		s.pending--
+		if s.pending == 0 {
+			s.cond.Broadcast()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// wait returns once all the docs sent to the shard are indexed. It's called
+// with s.mu held.
+func (s *indexShard) wait() {
+	for s.pending > 0 {
+		s.cond.Wait()
+	}
+}
+
+// add queues the doc to be indexed with the ID. The doc is always indexed by
+// the same shard for the ID, so adding it again is safe.
+func (si *shardedIndex) add(doc string, id uint64) {
+	si.queue(indexJob{doc: doc, id: id, text: true, binary: si.binary})
+}
+
+// addBinary queues the doc to be indexed for binary queries only, like a doc
+// that was added before binary was set.
+func (si *shardedIndex) addBinary(doc string, id uint64) {
+	si.queue(indexJob{doc: doc, id: id, binary: true})
+}
+
+func (si *shardedIndex) queue(job indexJob) {
+	s := si.shards[job.id%uint64(len(si.shards))]
+	s.mu.Lock()
+	s.pending++
+	s.mu.Unlock()
+	s.jobC <- job
+}
+
+// query runs the query against each shard once it has caught up with the
+// docs added so far. The results of the shards are merged in order of ID.
+func (si *shardedIndex) query(fn func(idx *trigram.Index) []trigram.QueryResult) []trigram.QueryResult {
+	var result []trigram.QueryResult
+	for _, s := range si.shards {
+		s.mu.Lock()
+		s.wait()
+		result = mergeResults(result, fn(s.index))
+		s.mu.Unlock()
+	}
+	return result
+}
+
+// docs returns the IDs of the docs with the trigram, once each shard has
+// caught up with the docs added so far. They're in order of shard, not ID.
+func (si *shardedIndex) docs(tg trigram.Trigram) []uint64 {
+	var result []uint64
+	for _, s := range si.shards {
+		s.mu.Lock()
+		s.wait()
+		result = append(result, s.index.Docs(tg)...)
+		s.mu.Unlock()
+	}
+	return result
+}
+
+// mergeResults merges two lists of results sorted by DocID.
+func mergeResults(a, b []trigram.QueryResult) []trigram.QueryResult {
+	if len(a) == 0 {
+		return b
+	}
+	result := make([]trigram.QueryResult, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i].DocID < b[j].DocID:
+			result = append(result, a[i])
+			i++
+		case a[i].DocID > b[j].DocID:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+// merged returns a single index of all the docs added so far.
+func (si *shardedIndex) merged() *trigram.Index {
+	if len(si.shards) == 1 {
+		s := si.shards[0]
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.wait()
+		return s.index
+	}
+	idx := trigram.NewIndex()
+	for _, s := range si.shards {
+		s.mu.Lock()
+		s.wait()
+		idx.Merge(s.index)
+		s.mu.Unlock()
+	}
+	return idx
+}
+
+// reset replaces the index of the first shard with idx, and that of the others
+// with an empty one.
+func (si *shardedIndex) reset(idx *trigram.Index) {
+	for i, s := range si.shards {
+		s.mu.Lock()
+		s.wait()
+		if i == 0 {
+			s.index = idx
+		} else {
+			s.index = trigram.NewIndex()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// stop stops the goroutines of the shards. The index must not be added to
+// after that.
+func (si *shardedIndex) stop() {
+	for _, s := range si.shards {
+		close(s.jobC)
+	}
+}
@@ -0,0 +1,98 @@
+package blocks
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/ewaters/meno/trigram"
+)
+
+func TestShardedIndex(t *testing.T) {
+	for _, shards := range []int{1, 3} {
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			si := newShardedIndex(shards)
+			defer si.stop()
+
+			for i := 0; i < 10; i++ {
+				doc := "abc"
+				if i%2 == 1 {
+					doc = "xyz"
+				}
+				si.add(fmt.Sprintf("%s %d", doc, i), uint64(i))
+			}
+			// Indexing the same ID again only adds trigrams.
+			si.add("abc 1", 1)
+
+			query := func(q string) []uint64 {
+				var ids []uint64
+				for _, qr := range si.query(func(idx *trigram.Index) []trigram.QueryResult {
+					return idx.Query(q)
+				}) {
+					ids = append(ids, qr.DocID)
+				}
+				return ids
+			}
+			for _, tc := range []struct {
+				query string
+				want  []uint64
+			}{
+				{"abc", []uint64{0, 1, 2, 4, 6, 8}},
+				{"xyz", []uint64{1, 3, 5, 7, 9}},
+				{"z 7", []uint64{7}},
+				{"nope", nil},
+			} {
+				if got := query(tc.query); !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("query(%q): got %v, want %v", tc.query, got, tc.want)
+				}
+			}
+
+			merged := si.merged()
+			var got []uint64
+			for _, qr := range merged.Query("xyz") {
+				got = append(got, qr.DocID)
+			}
+			if want := []uint64{1, 3, 5, 7, 9}; !reflect.DeepEqual(got, want) {
+				t.Errorf("merged().Query(%q): got %v, want %v", "xyz", got, want)
+			}
+		})
+	}
+}
+
+func TestShardedIndexBinary(t *testing.T) {
+	si := newShardedIndex(2)
+	defer si.stop()
+
+	query := func(q string) []uint64 {
+		var ids []uint64
+		for _, qr := range si.query(func(idx *trigram.Index) []trigram.QueryResult {
+			return idx.QueryBinary(q)
+		}) {
+			ids = append(ids, qr.DocID)
+		}
+		return ids
+	}
+
+	si.add("\x00\xde\xad\xbe\xef", 0)
+	if got := query("\xde\xad\xbe"); got != nil {
+		t.Errorf("query before binary: got %v, want none", got)
+	}
+
+	si.binary = true
+	si.addBinary("\x00\xde\xad\xbe\xef", 0)
+	si.add("\xde\xad\xbe abc", 1)
+	si.addBinary("\xde\xad\xbe abc", 2)
+	if got, want := query("\xde\xad\xbe"), []uint64{0, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("query: got %v, want %v", got, want)
+	}
+	// addBinary doesn't add the trigrams of runes.
+	var got []uint64
+	for _, qr := range si.query(func(idx *trigram.Index) []trigram.QueryResult {
+		return idx.Query("abc")
+	}) {
+		got = append(got, qr.DocID)
+	}
+	if want := []uint64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Query(abc): got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+package blocks
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ParseLineSeparator parses a LineSeparator written with backslash escapes,
+// like `\r\n` or `\0` (for NUL-delimited records, like the output of
+// `find -print0`). The escapes are `\n`, `\r`, `\t`, `\0`, `\\` and `\xHH`
+// (for any byte); other characters stand for themselves.
+func ParseLineSeparator(s string) ([]byte, error) {
+	var sep []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sep = append(sep, s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return nil, fmt.Errorf("Invalid separator %q: ends with a backslash", s)
+		}
+		switch s[i] {
+		case 'n':
+			sep = append(sep, '\n')
+		case 'r':
+			sep = append(sep, '\r')
+		case 't':
+			sep = append(sep, '\t')
+		case '0':
+			sep = append(sep, 0)
+		case '\\':
+			sep = append(sep, '\\')
+		case 'x':
+			if i+2 >= len(s) {
+				return nil, fmt.Errorf("Invalid separator %q: \\x needs two hex digits", s)
+			}
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid separator %q: \\x needs two hex digits", s)
+			}
+			sep = append(sep, byte(b))
+			i += 2
+		default:
+			return nil, fmt.Errorf("Invalid separator %q: unknown escape \\%c", s, s[i])
+		}
+	}
+	if len(sep) == 0 {
+		return nil, fmt.Errorf("Invalid separator %q: it's empty", s)
+	}
+	return sep, nil
+}
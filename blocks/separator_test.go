@@ -0,0 +1,39 @@
+package blocks
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseLineSeparator(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		want    []byte
+		wantErr bool
+	}{
+		{`\n`, []byte("\n"), false},
+		{`\r\n`, []byte("\r\n"), false},
+		{`\0`, []byte{0}, false},
+		{`\x1e`, []byte{0x1e}, false},
+		{`---\n`, []byte("---\n"), false},
+		{`a\\b`, []byte(`a\b`), false},
+		{``, nil, true},
+		{`\`, nil, true},
+		{`\q`, nil, true},
+		{`\x1`, nil, true},
+		{`\xzz`, nil, true},
+	} {
+		got, err := ParseLineSeparator(tc.s)
+		if err != nil {
+			if !tc.wantErr {
+				t.Errorf("ParseLineSeparator(%q): %v", tc.s, err)
+			}
+			continue
+		}
+		if tc.wantErr {
+			t.Errorf("ParseLineSeparator(%q): got %q, wanted err", tc.s, got)
+		} else if !bytes.Equal(got, tc.want) {
+			t.Errorf("ParseLineSeparator(%q): got %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
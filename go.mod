@@ -2,14 +2,18 @@ module github.com/ewaters/meno
 
 go 1.20
 
-require github.com/gdamore/tcell/v2 v2.6.0
+require (
+	github.com/gdamore/tcell/v2 v2.6.0
+	github.com/golang/glog v1.1.2
+	github.com/klauspost/compress v1.17.4
+	github.com/rivo/uniseg v0.4.3
+	github.com/ulikunitz/xz v0.5.12
+)
 
 require (
 	github.com/gdamore/encoding v1.0.0 // indirect
-	github.com/golang/glog v1.1.2 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.14 // indirect
-	github.com/rivo/uniseg v0.4.3 // indirect
 	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/term v0.5.0 // indirect
 	golang.org/x/text v0.7.0 // indirect
@@ -4,6 +4,8 @@ import (
 	"flag"
 	"log"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/ewaters/meno/blocks"
 	"github.com/ewaters/meno/term"
@@ -11,37 +13,121 @@ import (
 )
 
 var (
-	maxQuery = flag.Int("max_query", 10, "Limit the size of the index by supporting indexed queries only up to this length. Anything longer will resort to brute force searching.")
+	maxQuery      = flag.Int("max_query", 10, "Limit the size of the index by supporting indexed queries only up to this length. Anything longer will resort to brute force searching.")
+	incSearch     = flag.Bool("incsearch", false, "Search as the query is typed, like vim's incsearch: the view moves to the nearest match, and goes back to where it was on Escape.")
+	caseSensitive = flag.Bool("case_sensitive", false, "Make all searches case-sensitive. By default, a search ignores case unless it has an upper case letter.")
+	follow        = flag.Bool("follow", false, "Keep reading the file as it grows, like `tail -f`. Same as pressing F.")
+	lineNumbers   = flag.Bool("N", false, "Show the number of each line of the file in a gutter on the left. Same as pressing -N.")
+	chop          = flag.Bool("S", false, "Chop long lines at the edge of the screen instead of wrapping them, and scroll left and right with the arrow keys. Same as pressing -S.")
+	rawControl    = flag.Bool("R", false, "Show the colors that ANSI escape sequences in the file set (like in the output of `grep --color=always`) instead of the sequences themselves. Searches ignore the sequences.")
+	separator     = flag.String("separator", `\n`, "The bytes that end each line (or record) of the file, with backslash escapes: like \\r\\n for Windows line endings, \\0 for the output of find -print0, or any other string.")
+	hexDump       = flag.Bool("hex", false, "Show the file as a hex dump, like hexdump -C does. Same as pressing -H. A file that starts with a NUL byte (in its first block) is shown as one anyway.")
+	tabs          = flag.Int("tabs", 8, "Put a tab stop every this many columns.")
+	cache         = flag.Bool("cache", false, "Cache the index of each file in --cache_dir once it has been read, so that it's not built again when the same file is opened.")
+	cacheDir      = flag.String("cache_dir", defaultCacheDir(), "The directory that --cache keeps the indexes in. The least recently used ones are removed once they take more than --cache_max_mb.")
+	cacheMaxMB    = flag.Int64("cache_max_mb", 1024, "The most megabytes that --cache_dir takes. The index of a file that would take more than a quarter of it isn't cached.")
+	historyFile   = flag.String("history_file", defaultHistoryFile(), "Keep the queries of past searches in this file, to go back to with Up or CtrlR at the search prompt. Set to empty to forget them on exit.")
 )
 
+// defaultCacheDir is meno in the user's cache directory ($XDG_CACHE_HOME on
+// Linux), if there is one.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "meno")
+}
+
+// defaultHistoryFile is meno/history in the user's state directory
+// ($XDG_STATE_HOME, or else ~/.local/state), if there is one.
+func defaultHistoryFile() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "meno", "history")
+}
+
 func main() {
 	flag.Parse()
 	path := flag.Arg(0)
 
-	inFile, err := os.Open(path)
+	lineSep, err := blocks.ParseLineSeparator(*separator)
 	if err != nil {
-		log.Fatalf("Open(%q): %v", path, err)
+		log.Fatal(err)
 	}
-	defer inFile.Close()
 
-	stat, err := os.Stat(path)
+	// With no file (or "-"), read from STDIN, like `cmd | meno`. The size
+	// isn't known, so blocks.Reader reports -1 remaining bytes until the pipe
+	// is closed.
+	source := blocks.ConfigSource{
+		Input: os.Stdin,
+	}
+	fromStdin := path == "" || path == "-"
+	if fromStdin {
+		if stat, err := os.Stdin.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+			log.Fatalf("Missing filename (meno FILE or CMD | meno)")
+		}
+	} else {
+		inFile, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Open(%q): %v", path, err)
+		}
+		defer inFile.Close()
+
+		stat, err := inFile.Stat()
+		if err != nil {
+			log.Fatalf("Stat(%q): %v", path, err)
+		}
+		source = blocks.ConfigSource{
+			Input: inFile,
+			Size:  int(stat.Size()),
+			Path:  path,
+		}
+	}
+
+	// Compressed files (like archived logs) are read decompressed.
+	source, err = source.Decompress()
 	if err != nil {
-		log.Fatalf("Stat(%q): %v", path, err)
+		log.Fatal(err)
 	}
 
 	config := term.MenoConfig{
 		Config: blocks.Config{
-			Source: blocks.ConfigSource{
-				Input: inFile,
-				Size:  int(stat.Size()),
-			},
+			Source:         source,
 			BlockSize:      1024,
 			IndexNextBytes: *maxQuery - 1,
+			Follow:         *follow,
+			FlushAfter:     100 * time.Millisecond,
+			CacheMaxBytes:  *cacheMaxMB << 20,
 		},
-		LineSeperator: []byte("\n"),
+		LineSeperator:   lineSep,
+		CaseSensitive:   *caseSensitive,
+		LineNumbers:     *lineNumbers,
+		ChopLongLines:   *chop,
+		TabWidth:        *tabs,
+		RawControlChars: *rawControl,
+		Hex:             *hexDump,
+		IncSearch:       *incSearch,
+		HistoryFile:     *historyFile,
+	}
+	if *cache {
+		config.CacheDir = *cacheDir
 	}
 
-	screen, err := tcell.NewScreen()
+	var screen tcell.Screen
+	if fromStdin {
+		// STDIN is the input, so read keys from the terminal instead. A nil
+		// Tty means /dev/tty.
+		screen, err = tcell.NewTerminfoScreenFromTty(nil)
+	} else {
+		screen, err = tcell.NewScreen()
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,48 @@
+package term
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Where a `:` command jumps to.
+type gotoKind int
+
+const (
+	// `:N` goes to the (1-based) line N of the input.
+	gotoLine gotoKind = iota
+	// `:N%` goes to N percent of the way through the input.
+	gotoPercent
+	// `:@N` goes to the line with the byte at offset N of the input.
+	gotoOffset
+)
+
+type gotoCommand struct {
+	kind gotoKind
+	n    int
+}
+
+// parseGoto parses the input of a `:` command.
+func parseGoto(input string) (gotoCommand, error) {
+	input = strings.TrimSpace(input)
+	cmd := gotoCommand{kind: gotoLine}
+	number := input
+	switch {
+	case strings.HasPrefix(input, "@"):
+		cmd.kind = gotoOffset
+		number = strings.TrimPrefix(input, "@")
+	case strings.HasSuffix(input, "%"):
+		cmd.kind = gotoPercent
+		number = strings.TrimSuffix(input, "%")
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 0 {
+		return cmd, fmt.Errorf("Invalid command %q (try :N, :N%% or :@OFFSET)", input)
+	}
+	if cmd.kind == gotoPercent && n > 100 {
+		n = 100
+	}
+	cmd.n = n
+	return cmd, nil
+}
@@ -0,0 +1,35 @@
+package term
+
+import "testing"
+
+func TestParseGoto(t *testing.T) {
+	for _, tc := range []struct {
+		input   string
+		want    gotoCommand
+		wantErr bool
+	}{
+		{"1234567", gotoCommand{gotoLine, 1234567}, false},
+		{" 12 ", gotoCommand{gotoLine, 12}, false},
+		{"50%", gotoCommand{gotoPercent, 50}, false},
+		{"150%", gotoCommand{gotoPercent, 100}, false},
+		{"@4096", gotoCommand{gotoOffset, 4096}, false},
+		{"", gotoCommand{}, true},
+		{"abc", gotoCommand{}, true},
+		{"-1", gotoCommand{}, true},
+		{"@", gotoCommand{}, true},
+		{"%", gotoCommand{}, true},
+	} {
+		got, err := parseGoto(tc.input)
+		if err != nil {
+			if !tc.wantErr {
+				t.Errorf("parseGoto(%q): %v", tc.input, err)
+			}
+			continue
+		}
+		if tc.wantErr {
+			t.Errorf("parseGoto(%q): got %v, wanted err", tc.input, got)
+		} else if got != tc.want {
+			t.Errorf("parseGoto(%q): got %v, want %v", tc.input, got, tc.want)
+		}
+	}
+}
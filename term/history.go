@@ -0,0 +1,137 @@
+package term
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// The number of searches that the history keeps. Older ones are dropped.
+const maxHistory = 500
+
+// A searchHistory is the queries of past searches, which are kept in a file
+// (one per line) so that they're there in the next session.
+type searchHistory struct {
+	// The file, or empty to keep the history only in memory.
+	path string
+	// Oldest first, without duplicates.
+	queries []string
+}
+
+// loadHistory returns the history kept in the file, which is empty if the
+// file doesn't exist (or can't be read).
+func loadHistory(path string) *searchHistory {
+	h := &searchHistory{path: path}
+	if path == "" {
+		return h
+	}
+	queries, err := readHistory(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("Reading search history: %v", err)
+		}
+		return h
+	}
+	for _, query := range queries {
+		h.insert(query)
+	}
+	glog.Infof("Loaded %d searches from %q", len(h.queries), path)
+	return h
+}
+
+func readHistory(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var queries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if query := scanner.Text(); query != "" {
+			queries = append(queries, query)
+		}
+	}
+	return queries, scanner.Err()
+}
+
+// insert makes the query the newest one, dropping the oldest ones past
+// maxHistory.
+func (h *searchHistory) insert(query string) {
+	for i, q := range h.queries {
+		if q == query {
+			h.queries = append(h.queries[:i], h.queries[i+1:]...)
+			break
+		}
+	}
+	h.queries = append(h.queries, query)
+	if extra := len(h.queries) - maxHistory; extra > 0 {
+		h.queries = append([]string{}, h.queries[extra:]...)
+	}
+}
+
+// add makes the query the newest one, and saves the history. The searches
+// that other sessions saved since it was loaded are kept.
+func (h *searchHistory) add(query string) error {
+	if query == "" || strings.ContainsAny(query, "\r\n") {
+		return nil
+	}
+	if h.path == "" {
+		h.insert(query)
+		return nil
+	}
+	if queries, err := readHistory(h.path); err == nil {
+		h.queries = nil
+		for _, q := range queries {
+			h.insert(q)
+		}
+	}
+	h.insert(query)
+	return h.save()
+}
+
+// save writes the history to its file. It's written to a temporary file
+// first so that another session never reads a partial file.
+func (h *searchHistory) save() error {
+	dir := filepath.Dir(h.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "tmp-history-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	bw := bufio.NewWriter(f)
+	for _, query := range h.queries {
+		bw.WriteString(query)
+		bw.WriteByte('\n')
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), h.path)
+}
+
+// search returns the index of the newest query before `before` that contains
+// the text, or -1.
+func (h *searchHistory) search(text string, before int) int {
+	if before > len(h.queries) {
+		before = len(h.queries)
+	}
+	for i := before - 1; i >= 0; i-- {
+		if strings.Contains(h.queries[i], text) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,83 @@
+package term
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSearchHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meno", "history")
+	h := loadHistory(path)
+	if len(h.queries) != 0 {
+		t.Fatalf("loadHistory() before there's a file: got %q, want none", h.queries)
+	}
+
+	for _, query := range []string{"error", "timeout", "", "a\nb", "error", "re:^WARN"} {
+		if err := h.add(query); err != nil {
+			t.Fatalf("add(%q): %v", query, err)
+		}
+	}
+	want := []string{"timeout", "error", "re:^WARN"}
+	if !reflect.DeepEqual(h.queries, want) {
+		t.Errorf("After add(): got %q, want %q", h.queries, want)
+	}
+	if got := loadHistory(path).queries; !reflect.DeepEqual(got, want) {
+		t.Errorf("loadHistory(): got %q, want %q", got, want)
+	}
+
+	// The searches of another session are kept.
+	other := loadHistory(path)
+	if err := other.add("panic"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.add("timeout"); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"error", "re:^WARN", "panic", "timeout"}
+	if got := loadHistory(path).queries; !reflect.DeepEqual(got, want) {
+		t.Errorf("loadHistory() after two sessions: got %q, want %q", got, want)
+	}
+
+	for _, tc := range []struct {
+		text   string
+		before int
+		want   int
+	}{
+		{"r", 4, 1},
+		{"r", 1, 0},
+		{"r", 0, -1},
+		{"time", 10, 3},
+		{"nope", 4, -1},
+	} {
+		if got := h.search(tc.text, tc.before); got != tc.want {
+			t.Errorf("search(%q, %d): got %d, want %d", tc.text, tc.before, got, tc.want)
+		}
+	}
+}
+
+func TestSearchHistoryMax(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	var lines []byte
+	for i := 0; i < maxHistory+10; i++ {
+		lines = append(lines, fmt.Sprintf("query %d\n", i)...)
+	}
+	if err := os.WriteFile(path, lines, 0600); err != nil {
+		t.Fatal(err)
+	}
+	h := loadHistory(path)
+	if got := len(h.queries); got != maxHistory {
+		t.Fatalf("loadHistory(): got %d queries, want %d", got, maxHistory)
+	}
+	if got, want := h.queries[0], "query 10"; got != want {
+		t.Errorf("Oldest query: got %q, want %q", got, want)
+	}
+	if err := h.add("query 10"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := h.queries[0], "query 11"; got != want {
+		t.Errorf("Oldest query after adding it again: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package term
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// applySGR returns the style after the parameters of an SGR escape sequence
+// (like "1;31" for bold and red) are applied to it. A reset (like "0") goes
+// back to base. Parameters that aren't supported are ignored.
+func applySGR(style, base tcell.Style, params string) tcell.Style {
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		// An empty parameter is the same as 0.
+		code, err := strconv.Atoi(codes[i])
+		if codes[i] != "" && err != nil {
+			continue
+		}
+		switch {
+		case code == 0:
+			style = base
+		case code == 1:
+			style = style.Bold(true)
+		case code == 2:
+			style = style.Dim(true)
+		case code == 3:
+			style = style.Italic(true)
+		case code == 4:
+			style = style.Underline(true)
+		case code == 5:
+			style = style.Blink(true)
+		case code == 7:
+			style = style.Reverse(true)
+		case code == 9:
+			style = style.StrikeThrough(true)
+		case code == 22:
+			style = style.Bold(false).Dim(false)
+		case code == 23:
+			style = style.Italic(false)
+		case code == 24:
+			style = style.Underline(false)
+		case code == 25:
+			style = style.Blink(false)
+		case code == 27:
+			style = style.Reverse(false)
+		case code == 29:
+			style = style.StrikeThrough(false)
+		case code >= 30 && code <= 37:
+			style = style.Foreground(tcell.PaletteColor(code - 30))
+		case code == 38:
+			var color tcell.Color
+			if color, i = extendedColor(codes, i); color != tcell.ColorDefault {
+				style = style.Foreground(color)
+			}
+		case code == 39:
+			fg, _, _ := base.Decompose()
+			style = style.Foreground(fg)
+		case code >= 40 && code <= 47:
+			style = style.Background(tcell.PaletteColor(code - 40))
+		case code == 48:
+			var color tcell.Color
+			if color, i = extendedColor(codes, i); color != tcell.ColorDefault {
+				style = style.Background(color)
+			}
+		case code == 49:
+			_, bg, _ := base.Decompose()
+			style = style.Background(bg)
+		case code >= 90 && code <= 97:
+			style = style.Foreground(tcell.PaletteColor(code - 90 + 8))
+		case code >= 100 && code <= 107:
+			style = style.Background(tcell.PaletteColor(code - 100 + 8))
+		}
+	}
+	return style
+}
+
+// extendedColor returns the color of the 38 (or 48) code at codes[i], which
+// is followed by "5;N" for color N of the 256 color palette or by "2;R;G;B",
+// along with the index of the last code of it. The color is
+// tcell.ColorDefault if the codes are invalid.
+func extendedColor(codes []string, i int) (tcell.Color, int) {
+	var args []int
+	for _, code := range codes[i+1:] {
+		n, err := strconv.Atoi(code)
+		if err != nil || n < 0 || n > 255 {
+			break
+		}
+		args = append(args, n)
+	}
+	switch {
+	case len(args) >= 2 && args[0] == 5:
+		return tcell.PaletteColor(args[1]), i + 2
+	case len(args) >= 4 && args[0] == 2:
+		return tcell.NewRGBColor(int32(args[1]), int32(args[2]), int32(args[3])), i + 4
+	}
+	return tcell.ColorDefault, len(codes)
+}
@@ -0,0 +1,35 @@
+package term
+
+import (
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+func TestApplySGR(t *testing.T) {
+	base := tcell.StyleDefault.Background(tcell.ColorReset).Foreground(tcell.ColorReset)
+	red := base.Foreground(tcell.ColorMaroon)
+	for _, tc := range []struct {
+		style  tcell.Style
+		params string
+		want   tcell.Style
+	}{
+		{base, "31", red},
+		{base, "1;31", red.Bold(true)},
+		{red.Bold(true), "0", base},
+		{red.Bold(true), "", base},
+		{red.Bold(true), "22", red},
+		{red, "39", base},
+		{base, "4;7", base.Underline(true).Reverse(true)},
+		{base, "91;44", base.Foreground(tcell.ColorRed).Background(tcell.ColorNavy)},
+		{base, "38;5;208", base.Foreground(tcell.PaletteColor(208))},
+		{base, "48;2;1;2;3;1", base.Background(tcell.NewRGBColor(1, 2, 3)).Bold(true)},
+		// Invalid or unsupported codes are ignored.
+		{base, "38;5", base},
+		{base, "x;31;6", red},
+	} {
+		if got := applySGR(tc.style, base, tc.params); got != tc.want {
+			t.Errorf("applySGR(%v, %q): got %v, want %v", tc.style, tc.params, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package term
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ewaters/meno/blocks"
+)
+
+// Shown in the status line while the input is still being read, if we don't
+// know how much of it there is (like when it's a pipe).
+const readingIndicator = "(reading...)"
+
+// The width (inside the brackets) of the progress bar in the status line.
+const progressBarWidth = 10
+
+// What the status line shows at the right of the last row in paging mode.
+type status struct {
+	// The name of the file, if it's not STDIN.
+	name        string
+	compression blocks.Compression
+	// The `&` filter that is applied (like "&error"), if any.
+	filter string
+
+	// The (1-based) range of the lines of the input on screen, or 0 if there
+	// are none yet.
+	firstLine, lastLine int
+	totalLines          int
+	// How far through the input the bottom of the screen is, or -1 if
+	// unknown.
+	percent int
+
+	// The number of matches of the last search, the (1-based) number of the
+	// current one, or 0 if there is none, and the number of lines of the
+	// input they're in. While searching, there may be more of them.
+	matches, match int
+	matchedLines   int
+	searching      bool
+
+	readStatus blocks.ReadStatus
+	// The average rate the input was read at.
+	bytesPerSecond float64
+}
+
+func (s status) String() string {
+	var parts []string
+	if s.name != "" {
+		parts = append(parts, s.name)
+	}
+	if s.filter != "" {
+		parts = append(parts, s.filter)
+	}
+	if s.firstLine > 0 {
+		parts = append(parts, fmt.Sprintf("lines %d-%d/%d", s.firstLine, s.lastLine, s.totalLines))
+	}
+	if s.percent >= 0 {
+		parts = append(parts, fmt.Sprintf("%d%%", s.percent))
+	}
+	switch {
+	case s.matches > 0 && s.match > 0 && s.match <= s.matches:
+		parts = append(parts, fmt.Sprintf("match %s of %s in %s", formatCount(s.match), s.count(s.matches, ""), s.count(s.matchedLines, "line")))
+	case s.matches > 0:
+		parts = append(parts, fmt.Sprintf("%s in %s", s.count(s.matches, "match"), s.count(s.matchedLines, "line")))
+	}
+	if s.compression != blocks.CompressionNone {
+		parts = append(parts, "["+string(s.compression)+"]")
+	}
+
+	rs := s.readStatus
+	switch {
+	case rs.RemainingBytes > 0:
+		done := float64(rs.BytesRead) / float64(rs.BytesRead+rs.RemainingBytes)
+		parts = append(parts, "indexing "+progressBar(done, progressBarWidth),
+			fmt.Sprintf("%d%%", int(done*100)),
+			formatBytes(s.bytesPerSecond)+"/s")
+	case rs.RemainingBytes < 0:
+		parts = append(parts, readingIndicator, formatBytes(float64(rs.BytesRead)))
+	}
+	return strings.Join(parts, "  ")
+}
+
+// progressBar returns a bar of the width that is filled to the fraction done.
+func progressBar(done float64, width int) string {
+	filled := int(done * float64(width))
+	if filled > width {
+		filled = width
+	}
+	if filled < 0 {
+		filled = 0
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", width-filled) + "]"
+}
+
+// formatCount returns the number with commas between each group of three
+// digits, like "41,207".
+func formatCount(n int) string {
+	if n < 0 {
+		return "-" + formatCount(-n)
+	}
+	digits := strconv.Itoa(n)
+	var sb strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteRune(d)
+	}
+	return sb.String()
+}
+
+// count returns the number (with the noun, unless it's empty) of matches or
+// lines, with a "+" while there may be more of them, like "523+ matches".
+func (s status) count(n int, noun string) string {
+	if !s.searching {
+		if noun == "" {
+			return formatCount(n)
+		}
+		return plural(n, noun)
+	}
+	if noun == "" {
+		return formatCount(n) + "+"
+	}
+	// The noun is plural, since there may be more than one.
+	return formatCount(n) + "+ " + strings.TrimPrefix(plural(2, noun), "2 ")
+}
+
+// plural returns the count (see formatCount) and the noun, which gets an "s"
+// (or "es") unless there is one.
+func plural(n int, noun string) string {
+	switch {
+	case n == 1:
+	case strings.HasSuffix(noun, "ch"):
+		noun += "es"
+	default:
+		noun += "s"
+	}
+	return formatCount(n) + " " + noun
+}
+
+// formatBytes returns the size with a unit, like "1.5 MB".
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", int(n))
+	}
+	i := 0
+	for n >= unit*unit && i < 3 {
+		n /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %cB", n/unit, "KMGT"[i])
+}
@@ -0,0 +1,168 @@
+package term
+
+import (
+	"testing"
+
+	"github.com/ewaters/meno/blocks"
+)
+
+func TestStatusString(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status status
+		want   string
+	}{
+		{
+			name:   "nothing yet",
+			status: status{percent: -1},
+			want:   "",
+		},
+		{
+			name: "done",
+			status: status{
+				name:       "app.log",
+				firstLine:  11,
+				lastLine:   34,
+				totalLines: 100,
+				percent:    34,
+			},
+			want: "app.log  lines 11-34/100  34%",
+		},
+		{
+			name: "compressed",
+			status: status{
+				name:        "app.log.gz",
+				compression: blocks.CompressionGzip,
+				firstLine:   1,
+				lastLine:    1,
+				totalLines:  1,
+				percent:     100,
+			},
+			want: "app.log.gz  lines 1-1/1  100%  [gzip]",
+		},
+		{
+			name: "filtered",
+			status: status{
+				name:       "app.log",
+				filter:     "&!DEBUG",
+				firstLine:  3,
+				lastLine:   90,
+				totalLines: 100,
+				percent:    100,
+			},
+			want: "app.log  &!DEBUG  lines 3-90/100  100%",
+		},
+		{
+			name: "search",
+			status: status{
+				firstLine:    1,
+				lastLine:     24,
+				totalLines:   100000,
+				percent:      0,
+				matches:      41207,
+				match:        3,
+				matchedLines: 1,
+			},
+			want: "lines 1-24/100000  0%  match 3 of 41,207 in 1 line",
+		},
+		{
+			name: "no current match",
+			status: status{
+				percent:      -1,
+				matches:      1,
+				matchedLines: 1,
+			},
+			want: "1 match in 1 line",
+		},
+		{
+			name: "searching",
+			status: status{
+				percent:      -1,
+				matches:      523,
+				match:        1,
+				matchedLines: 1,
+				searching:    true,
+			},
+			want: "match 1 of 523+ in 1+ lines",
+		},
+		{
+			name: "searching without a current match",
+			status: status{
+				percent:      -1,
+				matches:      1,
+				matchedLines: 1,
+				searching:    true,
+			},
+			want: "1+ matches in 1+ lines",
+		},
+		{
+			name: "indexing",
+			status: status{
+				name:       "app.log",
+				firstLine:  1,
+				lastLine:   24,
+				totalLines: 1000,
+				percent:    2,
+				readStatus: blocks.ReadStatus{
+					BytesRead:      3 << 20,
+					RemainingBytes: 7 << 20,
+				},
+				bytesPerSecond: 1.5 * (1 << 20),
+			},
+			want: "app.log  lines 1-24/1000  2%  indexing [###-------]  30%  1.5 MB/s",
+		},
+		{
+			name: "reading STDIN",
+			status: status{
+				firstLine:  1,
+				lastLine:   2,
+				totalLines: 2,
+				percent:    100,
+				readStatus: blocks.ReadStatus{
+					BytesRead:      2048,
+					RemainingBytes: -1,
+				},
+			},
+			want: "lines 1-2/2  100%  (reading...)  2.0 KB",
+		},
+	} {
+		if got := tc.status.String(); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFormatCount(t *testing.T) {
+	for _, tc := range []struct {
+		n    int
+		want string
+	}{
+		{0, "0"},
+		{999, "999"},
+		{1000, "1,000"},
+		{41207, "41,207"},
+		{1234567, "1,234,567"},
+		{-1234, "-1,234"},
+	} {
+		if got := formatCount(tc.n); got != tc.want {
+			t.Errorf("formatCount(%d): got %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for _, tc := range []struct {
+		n    float64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KB"},
+		{3 << 20, "3.0 MB"},
+		{5 << 30, "5.0 GB"},
+	} {
+		if got := formatBytes(tc.n); got != tc.want {
+			t.Errorf("formatBytes(%v): got %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
@@ -1,9 +1,21 @@
 package term
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
 	"github.com/gdamore/tcell/v2"
 	"github.com/golang/glog"
 
+	"github.com/ewaters/meno/ansi"
 	"github.com/ewaters/meno/blocks"
 	"github.com/ewaters/meno/wrapper"
 )
@@ -15,34 +27,229 @@ const (
 	ModeSearchDown
 	ModeSearchUp
 	ModeSearchActive
+	// Typing a `:` command (see parseGoto).
+	ModeCommand
+	// After `-`, the next key toggles an option (like `-N`).
+	ModeOption
+	// Typing the pattern of a `&` filter (see applyFilter).
+	ModeFilter
 )
 
+// The gutter has room for at least this many digits of line numbers.
+const minGutterDigits = 6
+
+// How often Run() checks on things that change without an event (like the
+// input growing in follow mode).
+const tickInterval = 250 * time.Millisecond
+
+// The number of bytes on each row of a hex dump.
+const hexBytesPerLine = 16
+
+// With IncSearch, how long to wait after a key is typed at the search prompt
+// before searching for what was typed, so that typing a query quickly runs
+// only one search.
+const incSearchDelay = 100 * time.Millisecond
+
 type Meno struct {
 	config MenoConfig
 	screen tcell.Screen
 	style  tcell.Style
 	driver *wrapper.Driver
+	layout wrapper.Layout
+
+	// The style of the line numbers in the gutter.
+	gutterStyle tcell.Style
+	// The style of the characters that are drawn escaped (see drawText).
+	controlStyle tcell.Style
+	// Styles of the search matches on screen.
+	matchStyle        tcell.Style
+	currentMatchStyle tcell.Style
 
 	w, h      int
 	firstLine int
+	// The logical line (see wrapper.VisibleLine) shown on each row, or -1.
+	rowLogicalLines []int
 
 	mode Mode
 
+	// In follow mode, the view scrolls to new lines at the end of the input
+	// as long as it's pinned to the bottom.
+	following bool
+	pinned    bool
+
+	// Whether the gutter with line numbers is shown, and how many digits it
+	// has room for.
+	lineNumbers  bool
+	gutterDigits int
+
+	// Whether long lines are chopped instead of wrapped, and the column of
+	// the lines that the view is scrolled to.
+	chop    bool
+	leftCol int
+
+	// Whether the input is shown as a hex dump, and whether the start of it
+	// has been checked for binary data yet (see detectBinary).
+	hex            bool
+	detectedBinary bool
+
+	// The input of the `&` filter that is applied, if any.
+	filter string
+
+	// With RawControlChars, the style set by the escape sequences of each
+	// visible line that is wrapped, as of the end of it. Only the lines near
+	// the screen are kept (see pruneEndStyles).
+	endStyles map[int]tcell.Style
+
+	// Whether the input is still being read (like when it's a pipe), as of
+	// the last tick.
+	reading bool
+	// When Run() started reading the input.
+	readStart time.Time
+
 	quitC  chan struct{}
 	eventC chan tcell.Event
 
+	// Shown in the status line until the next key press.
+	message string
+	// The status (see status()) last shown in the status line.
+	shownStatus string
+
 	done            bool
 	searchInput     []rune
+	commandInput    []rune
+	filterInput     []rune
 	lastSearchInput []rune
 	lastSearchMode  Mode
 
+	// The digits typed while paging, which are the count of the next key
+	// (like `50%`).
+	count []rune
+
 	activeSearch *activeSearch
+
+	// With IncSearch, the view (and search) from before the search prompt,
+	// which Escape goes back to, and when to search for what was typed.
+	searchOrigin   searchOrigin
+	incSearchTimer *time.Timer
+	incSearchC     <-chan time.Time
+
+	// The queries of past searches. At the search prompt, Up goes back
+	// through them: historyIndex is how many it went back (or 0, for what
+	// was typed, which is kept in historyDraft).
+	history      *searchHistory
+	historyIndex int
+	historyDraft []rune
+	// While searching the history (after CtrlR), what it's searched for, and
+	// the index of the newest query that has it, or -1.
+	historySearch *historySearch
+}
+
+type historySearch struct {
+	text  []rune
+	match int
+}
+
+// prompt returns what's shown instead of the search prompt, like
+// "(reverse-i-search)`err': error: timeout".
+func (hs *historySearch) prompt(history *searchHistory) string {
+	if hs.match < 0 {
+		if len(hs.text) == 0 {
+			return "(reverse-i-search)`': "
+		}
+		return fmt.Sprintf("(failed reverse-i-search)`%s': ", string(hs.text))
+	}
+	return fmt.Sprintf("(reverse-i-search)`%s': %s", string(hs.text), history.queries[hs.match])
+}
+
+type searchOrigin struct {
+	firstLine, leftCol int
+	search             *activeSearch
 }
 
 type activeSearch struct {
 	request       wrapper.SearchRequest
 	startFromLine int
 	searchDown    bool
+
+	// The ID of the driver's search, and what stops it.
+	id     int
+	cancel context.CancelFunc
+	// Whether every result has been found.
+	complete bool
+	// The results found so far (nil until there are any, or the search is
+	// complete), sorted by position.
+	results []wrapper.LineOffsetRange
+	// The number of lines of the input that the results are in.
+	lines int
+	// The index in results of the current match, or -1 if there is none.
+	current int
+	// Whether we've jumped to the first result. Later results (like after a
+	// resize) are only redrawn.
+	positioned bool
+	// Whether it's for the input at the search prompt (see IncSearch), which
+	// may still change.
+	incremental bool
+}
+
+// Messages shown when the search continues at the other end of the input.
+const (
+	searchWrappedDown = "search hit BOTTOM, continuing at TOP"
+	searchWrappedUp   = "search hit TOP, continuing at BOTTOM"
+	searchNotFound    = "Pattern not found"
+	searchIncomplete  = "Still searching..."
+	searchStopped     = "Search stopped"
+)
+
+// resultFrom returns the index of the first result that starts at or after
+// the line (at or before, if searching up). If there is none, the search
+// continues at the other end of the results and wrapped is true.
+func (as *activeSearch) resultFrom(line int, down bool) (i int, wrapped bool) {
+	if down {
+		i = sort.Search(len(as.results), func(i int) bool {
+			return as.results[i].From.Line >= line
+		})
+		if i == len(as.results) {
+			return 0, true
+		}
+		return i, false
+	}
+	i = sort.Search(len(as.results), func(i int) bool {
+		return as.results[i].From.Line > line
+	}) - 1
+	if i < 0 {
+		return len(as.results) - 1, true
+	}
+	return i, false
+}
+
+// resultAfter returns the index of the result after the current one (or
+// before it, if searching up), wrapping around at the ends.
+func (as *activeSearch) resultAfter(down bool) (i int, wrapped bool) {
+	if down {
+		i = as.current + 1
+		if i == len(as.results) {
+			return 0, true
+		}
+		return i, false
+	}
+	i = as.current - 1
+	if i < 0 {
+		return len(as.results) - 1, true
+	}
+	return i, false
+}
+
+// resultAt returns the index in results of the match that covers the offset
+// in the line, or -1.
+func (as *activeSearch) resultAt(line, offset int) int {
+	pos := wrapper.LineOffset{Line: line, Offset: offset}
+	i := sort.Search(len(as.results), func(i int) bool {
+		return !as.results[i].To.Before(pos)
+	})
+	if i == len(as.results) || pos.Before(as.results[i].From) {
+		return -1
+	}
+	return i
 }
 
 func (m *Meno) Close() {
@@ -50,7 +257,33 @@ func (m *Meno) Close() {
 
 type MenoConfig struct {
 	blocks.Config
+	// The bytes that end each line, like "\n" or "\r\n". It's also used as
+	// the LineSeparator of the blocks.Config.
 	LineSeperator []byte
+
+	// By default, searches are smart-case: a query without any upper case
+	// letters ignores case. If set, searches are always case-sensitive.
+	CaseSensitive bool
+
+	// Show the line numbers of the input in a gutter (see also `-N`).
+	LineNumbers bool
+	// Chop long lines instead of wrapping them (see also `-S`).
+	ChopLongLines bool
+	// The number of columns between tab stops, or 0 for the default (8).
+	TabWidth int
+	// Show the colors (and other attributes) that ANSI SGR escape sequences
+	// in the input set, instead of the sequences themselves, like `less -R`.
+	// The sequences are also left out of searches.
+	RawControlChars bool
+	// Show the input as a hex dump (see also `-H`). Otherwise, it's shown as
+	// one if the first block of it has a NUL byte.
+	Hex bool
+	// Search as the query is typed, like vim's `incsearch`: the view moves to
+	// the nearest match, and goes back to where it was on Escape.
+	IncSearch bool
+	// The file that the queries of past searches are kept in, or empty to
+	// keep them only until meno exits.
+	HistoryFile string
 }
 
 func NewMeno(config MenoConfig, s tcell.Screen) (*Meno, error) {
@@ -58,6 +291,8 @@ func NewMeno(config MenoConfig, s tcell.Screen) (*Meno, error) {
 		return nil, err
 	}
 
+	config.Config.LineSeparator = config.LineSeperator
+	config.Config.IgnoreEscapes = config.RawControlChars
 	reader, err := blocks.NewReader(config.Config)
 	if err != nil {
 		return nil, err
@@ -67,15 +302,47 @@ func NewMeno(config MenoConfig, s tcell.Screen) (*Meno, error) {
 	if err != nil {
 		return nil, err
 	}
+	layout := wrapper.Layout{
+		TabWidth: config.TabWidth,
+		Escapes:  config.RawControlChars,
+	}
+	if layout.TabWidth == 0 {
+		layout.TabWidth = wrapper.DefaultTabWidth
+	}
+	if config.Hex {
+		layout.HexBytes = hexBytesPerLine
+	}
+	if err := driver.SetLayout(layout); err != nil {
+		return nil, err
+	}
 
+	style := tcell.StyleDefault.Background(tcell.ColorReset).Foreground(tcell.ColorReset)
 	m := &Meno{
 		config: config,
 		screen: s,
-		style:  tcell.StyleDefault.Background(tcell.ColorReset).Foreground(tcell.ColorReset),
+		style:  style,
 		driver: driver,
+		layout: layout,
+
+		gutterStyle:       style.Foreground(tcell.ColorYellow),
+		controlStyle:      style.Foreground(tcell.ColorBlue),
+		matchStyle:        style.Reverse(true),
+		currentMatchStyle: style.Background(tcell.ColorYellow).Foreground(tcell.ColorBlack),
 
 		quitC:  make(chan struct{}),
 		eventC: make(chan tcell.Event),
+
+		following: config.Follow,
+		pinned:    config.Follow,
+
+		lineNumbers:  config.LineNumbers,
+		gutterDigits: minGutterDigits,
+		chop:         config.ChopLongLines,
+
+		hex:            config.Hex,
+		detectedBinary: config.Hex,
+
+		history: loadHistory(config.HistoryFile),
 	}
 	s.SetStyle(m.style)
 	s.Clear()
@@ -90,11 +357,17 @@ func NewMeno(config MenoConfig, s tcell.Screen) (*Meno, error) {
 
 func (m *Meno) Run() {
 	go m.screen.ChannelEvents(m.eventC, m.quitC)
+	m.readStart = time.Now()
 	go m.driver.Run()
 
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
 outer:
 	for {
 		select {
+		case <-ticker.C:
+			m.tick()
 		case ev, ok := <-m.driver.Events():
 			if !ok {
 				glog.Infof("driver.Events closed; breaking Run")
@@ -105,18 +378,49 @@ outer:
 		case ev := <-m.eventC:
 			glog.V(1).Infof("Run() eventC event %v", ev)
 			m.handleTermEvent(ev)
+		case <-m.incSearchC:
+			m.incSearchC = nil
+			m.incSearch()
 		}
 	}
 }
 
+func (m *Meno) tick() {
+	m.detectBinary()
+	// The status line shows the progress of reading the input.
+	if reading := m.driver.ReadStatus().RemainingBytes != 0; reading || reading != m.reading {
+		m.reading = reading
+		m.showScreen()
+	} else if m.mode == ModePaging && m.status().String() != m.shownStatus {
+		// Like the number of lines, after lines that aren't on screen (or
+		// that are filtered out) were read.
+		m.showScreen()
+	}
+	if digits := len(strconv.Itoa(m.driver.TotalLogicalLines())); m.lineNumbers && digits > m.gutterDigits {
+		// Make room for the longer line numbers.
+		m.gutterDigits = digits
+		m.resized()
+	}
+	if m.following && m.pinned && m.firstLine < m.maxFirstLine() {
+		m.jumpToLastLine()
+	}
+}
+
 func (m *Meno) handleDataEvent(event wrapper.Event) {
 	if line := event.Line; line != nil {
 		row := line.Number - m.firstLine
+		if row >= 0 && row < len(m.rowLogicalLines) {
+			m.rowLogicalLines[row] = line.LogicalLine
+		}
 		//glog.Infof("Writing %q to row %d", line.Line, row)
 		col := 0
-		for _, r := range []rune(line.Line) {
-			m.screen.SetContent(col, row, r, nil, m.style)
-			col++
+		if m.hex {
+			col = m.drawHex(row, line)
+		} else {
+			if m.lineNumbers {
+				col = m.drawGutter(row, line)
+			}
+			col = m.drawText(row, col, line)
 		}
 		for ; col < m.w; col++ {
 			m.screen.SetContent(col, row, ' ', nil, m.style)
@@ -125,11 +429,46 @@ func (m *Meno) handleDataEvent(event wrapper.Event) {
 		return
 	}
 	if status := event.Search; status != nil {
-		if !status.Complete {
+		if status.Complete {
+			glog.Infof("Search status %v", status)
+		}
+		as := m.activeSearch
+		if as == nil || as.id != status.ID {
+			// It's from a search that was canceled.
 			return
 		}
-		glog.Infof("Search status %v", status)
-		m.mode = ModePaging
+		if status.Err != nil {
+			m.stopSearch()
+			if m.mode == ModeSearchActive {
+				m.changeMode(ModePaging)
+			}
+			m.message = fmt.Sprintf("Search failed: %v", status.Err)
+			m.showScreen()
+			return
+		}
+		as.complete = status.Complete
+		as.lines = status.Lines
+		m.setSearchResults(status.Results)
+		if m.mode == ModeSearchActive && as.positioned {
+			m.changeMode(ModePaging)
+		}
+		m.showScreen()
+		return
+	}
+	if event.Reset {
+		glog.Infof("The input was truncated or replaced; starting over")
+		if err := m.driver.Restart(); err != nil {
+			glog.Errorf("Restart(): %v", err)
+			return
+		}
+		// The lines (and the results of the search) are gone.
+		m.stopSearch()
+		if m.mode == ModeSearchActive {
+			m.changeMode(ModePaging)
+		}
+		m.firstLine = 0
+		m.screen.Clear()
+		m.resized()
 		m.showScreen()
 		return
 	}
@@ -145,6 +484,13 @@ func (m *Meno) handleTermEvent(event tcell.Event) {
 		m.showScreen()
 	case *tcell.EventKey:
 		glog.Infof("EventKey %v for mode %v", ev, m.mode)
+		hadMessage := m.message != ""
+		m.message = ""
+		defer func() {
+			if hadMessage && m.message == "" {
+				m.showScreen()
+			}
+		}()
 		switch m.mode {
 		case ModePaging:
 			m.keyDownPaging(ev)
@@ -152,6 +498,12 @@ func (m *Meno) handleTermEvent(event tcell.Event) {
 			m.keyDownSearch(ev)
 		case ModeSearchActive:
 			m.keyDownSearchActive(ev)
+		case ModeCommand:
+			m.keyDownCommand(ev)
+		case ModeOption:
+			m.keyDownOption(ev)
+		case ModeFilter:
+			m.keyDownFilter(ev)
 		default:
 			glog.Errorf("EventKey %v for mode %v not handled", ev, m.mode)
 		}
@@ -198,8 +550,28 @@ func (m *Meno) finish() {
 }
 
 func (m *Meno) keyDownPaging(ev *tcell.EventKey) {
+	// A count only applies to the key right after it.
+	count := m.count
+	m.count = nil
+	if r := ev.Rune(); ev.Key() == tcell.KeyRune && r >= '0' && r <= '9' {
+		m.count = append(count, r)
+		return
+	}
+
 	switch ev.Key() {
 	case tcell.KeyEscape, tcell.KeyCtrlC:
+		if count != nil {
+			// Forget the count.
+			return
+		}
+		if as := m.activeSearch; as != nil && !as.complete {
+			// The first result was shown, but the search is still running.
+			m.stopSearch()
+			m.message = searchStopped
+			m.driver.WatchLines(m.firstLine, m.h-1)
+			m.showScreen()
+			return
+		}
 		m.finish()
 	case tcell.KeyDown:
 		m.jumpLine(1)
@@ -209,6 +581,10 @@ func (m *Meno) keyDownPaging(ev *tcell.EventKey) {
 		m.jumpPage(-1)
 	case tcell.KeyPgDn:
 		m.jumpPage(1)
+	case tcell.KeyLeft:
+		m.scrollColumns(-1)
+	case tcell.KeyRight:
+		m.scrollColumns(1)
 	case tcell.KeyRune:
 		switch ev.Rune() {
 		case 'q':
@@ -217,6 +593,8 @@ func (m *Meno) keyDownPaging(ev *tcell.EventKey) {
 			m.jumpToLine(0)
 		case 'G':
 			m.jumpToLastLine()
+		case 'F':
+			m.startFollowing()
 		case 'j':
 			m.jumpLine(1)
 		case 'k':
@@ -226,21 +604,26 @@ func (m *Meno) keyDownPaging(ev *tcell.EventKey) {
 		case 'b':
 			m.jumpPage(-1)
 		case '/':
-			m.changeMode(ModeSearchDown)
+			m.promptSearch(ModeSearchDown)
 		case '?':
-			m.changeMode(ModeSearchUp)
+			m.promptSearch(ModeSearchUp)
 		case 'n':
-			if len(m.lastSearchInput) > 0 {
-				m.searchInput = m.lastSearchInput
-				m.mode = m.lastSearchMode
-				m.startSearch(false)
-			}
+			m.nextSearchResult(false)
 		case 'N':
-			if len(m.lastSearchInput) > 0 {
-				m.searchInput = m.lastSearchInput
-				m.mode = m.lastSearchMode
-				m.startSearch(true)
+			m.nextSearchResult(true)
+		case '%':
+			// Like `:N%`. Without a count, it goes to the start, like in
+			// less.
+			if count == nil {
+				count = []rune{'0'}
 			}
+			m.runCommand(string(count) + "%")
+		case ':':
+			m.changeMode(ModeCommand)
+		case '&':
+			m.changeMode(ModeFilter)
+		case '-':
+			m.changeMode(ModeOption)
 		default:
 			glog.Errorf("keyDownPaging unhandled rune %q", ev.Rune())
 		}
@@ -250,28 +633,503 @@ func (m *Meno) keyDownPaging(ev *tcell.EventKey) {
 }
 
 func (m *Meno) keyDownSearch(ev *tcell.EventKey) {
+	if m.historySearch != nil {
+		m.keyDownHistorySearch(ev)
+		return
+	}
 	switch ev.Key() {
 	case tcell.KeyEscape, tcell.KeyCtrlC:
+		if m.config.IncSearch {
+			m.cancelIncSearch()
+		}
 		m.changeMode(ModePaging)
 	case tcell.KeyEnter:
+		if err := m.history.add(string(m.searchInput)); err != nil {
+			glog.Errorf("Saving the search history: %v", err)
+		}
+		if m.config.IncSearch {
+			m.acceptIncSearch()
+			return
+		}
 		m.startSearch(false)
+	case tcell.KeyUp:
+		m.browseHistory(1)
+	case tcell.KeyDown:
+		m.browseHistory(-1)
+	case tcell.KeyCtrlR:
+		m.historySearch = &historySearch{match: -1}
+		m.showScreen()
 	case tcell.KeyBackspace, tcell.KeyBackspace2:
 		l := len(m.searchInput)
 		if l == 0 {
 			return
 		}
+		m.historyIndex = 0
 		m.updateSearch(m.searchInput[:l-1])
 	case tcell.KeyRune:
 		newInput := append([]rune{}, m.searchInput...)
+		m.historyIndex = 0
 		m.updateSearch(append(newInput, ev.Rune()))
 	default:
 		glog.Errorf("keyDownSearch unhandled EventKey %v", ev.Key())
 	}
 }
 
+func (m *Meno) keyDownOption(ev *tcell.EventKey) {
+	m.changeMode(ModePaging)
+	if ev.Key() != tcell.KeyRune {
+		return
+	}
+	switch ev.Rune() {
+	case 'N':
+		m.lineNumbers = !m.lineNumbers
+		// The lines are wrapped to a new width, and may not fill the rows
+		// they did.
+		m.screen.Clear()
+		m.resized()
+		m.showScreen()
+	case 'S':
+		m.chop = !m.chop
+		m.leftCol = 0
+		m.screen.Clear()
+		m.resized()
+		m.showScreen()
+	case 'H':
+		m.detectedBinary = true
+		m.setHex(!m.hex)
+	default:
+		m.message = fmt.Sprintf("No option -%c", ev.Rune())
+		m.showScreen()
+	}
+}
+
+// textWidth returns how many columns of each row are left for the text of the
+// lines.
+func (m *Meno) textWidth() int {
+	if width := m.w - m.gutterWidth(); width > 1 {
+		return width
+	}
+	return 1
+}
+
+// scrollColumns scrolls the view by the number of half screens to the right
+// (or left, if negative), if lines are chopped.
+func (m *Meno) scrollColumns(halves int) {
+	if !m.chop || m.hex {
+		return
+	}
+	half := (m.textWidth() + 1) / 2
+	m.setLeftCol(m.leftCol + halves*half)
+}
+
+// scrollToResult scrolls the view horizontally so that the (start of the)
+// result is on screen, if lines are chopped.
+func (m *Meno) scrollToResult(result wrapper.LineOffsetRange) {
+	if !m.chop || m.hex {
+		return
+	}
+	line, err := m.driver.Line(result.From.Line)
+	if err != nil {
+		glog.Errorf("Line(%d): %v", result.From.Line, err)
+		return
+	}
+	from := wrapper.Columns(line.Line[:result.From.Offset], m.layout)
+	to := from
+	if result.To.Line == result.From.Line {
+		to = wrapper.Columns(line.Line[:result.To.Offset+1], m.layout) - 1
+	}
+	m.scrollToColumns(from, to)
+}
+
+// scrollToColumns scrolls the view horizontally so that the columns from and
+// to are on screen, if lines are chopped. The view is scrolled by half
+// screens, like with the arrow keys.
+func (m *Meno) scrollToColumns(from, to int) {
+	if !m.chop || (from >= m.leftCol && to < m.leftCol+m.textWidth()) {
+		return
+	}
+	half := (m.textWidth() + 1) / 2
+	m.setLeftCol(from / half * half)
+}
+
+func (m *Meno) setLeftCol(col int) {
+	if col < 0 {
+		col = 0
+	}
+	if col == m.leftCol {
+		return
+	}
+	m.leftCol = col
+	// Redraw the lines.
+	m.driver.WatchLines(m.firstLine, m.h-1)
+}
+
+// drawText draws the text of the line from the column, and returns the column
+// after it. Each cell (see wrapper.Cells) takes one or two columns, except for
+// tabs, which are drawn as spaces up to the next tab stop, and cells that
+// can't be written to the terminal as is, which are drawn escaped (like "^M")
+// in the control style.
+func (m *Meno) drawText(row, col int, line *wrapper.VisibleLine) int {
+	text := strings.TrimSuffix(line.Line, string(m.config.LineSeperator))
+	skip := 0
+	if m.chop {
+		skip = m.leftCol
+	}
+	textStyle := m.startStyle(line)
+	for _, cell := range wrapper.Cells(text, m.layout) {
+		if cell.Width == 0 {
+			textStyle = m.escapeStyle(textStyle, cell.Text)
+			continue
+		}
+		cellStyle := textStyle
+		if cell.Shown != "" {
+			cellStyle = m.controlStyle
+		}
+		style := m.styleAt(line.Number, cell.Offset, cellStyle)
+		if skip > 0 {
+			// A wide character that is cut by the left edge isn't shown,
+			// but the rest of a tab or an escaped cell is.
+			skip -= cell.Width
+			if skip < 0 {
+				switch {
+				case cell.Shown != "":
+					col = m.drawString(row, col, cell.Shown[len(cell.Shown)+skip:], style)
+				case cell.Text == "\t":
+					col = m.drawString(row, col, strings.Repeat(" ", -skip), style)
+				default:
+					col = m.drawString(row, col, strings.Repeat(" ", -skip), textStyle)
+				}
+				skip = 0
+			}
+			continue
+		}
+		if col+cell.Width > m.w {
+			break
+		}
+		if cell.Shown != "" {
+			col = m.drawString(row, col, cell.Shown, style)
+			continue
+		}
+		if cell.Text == "\t" {
+			col = m.drawString(row, col, strings.Repeat(" ", cell.Width), style)
+			continue
+		}
+		runes := []rune(cell.Text)
+		m.screen.SetContent(col, row, runes[0], runes[1:], style)
+		col += cell.Width
+	}
+	if m.layout.Escapes && !m.chop && len(text) == len(line.Line) {
+		// The line is wrapped, so the next one starts with this style.
+		m.endStyles[line.Number] = textStyle
+	}
+	return col
+}
+
+// startStyle returns the style that the text of the line starts with. With
+// RawControlChars, the style set by the escape sequences of a logical line
+// carries over to the visible lines it's wrapped onto (but not to the next
+// logical line).
+func (m *Meno) startStyle(line *wrapper.VisibleLine) tcell.Style {
+	if !m.layout.Escapes || !line.Continuation {
+		return m.style
+	}
+	if style, ok := m.endStyles[line.Number-1]; ok {
+		return style
+	}
+	// Go back to the last visible line whose style we know, or to the start
+	// of the logical line.
+	var lines []*wrapper.VisibleLine
+	style := m.style
+	for number := line.Number - 1; number >= 0; number-- {
+		if known, ok := m.endStyles[number]; ok {
+			style = known
+			break
+		}
+		prev, err := m.driver.Line(number)
+		if err != nil {
+			glog.Errorf("Line(%d): %v", number, err)
+			return m.style
+		}
+		lines = append(lines, prev)
+		if !prev.Continuation {
+			break
+		}
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		for _, cell := range wrapper.Cells(lines[i].Line, m.layout) {
+			if cell.Width == 0 {
+				style = m.escapeStyle(style, cell.Text)
+			}
+		}
+		m.endStyles[lines[i].Number] = style
+	}
+	return style
+}
+
+// escapeStyle returns the style after the cell, if it's an SGR escape
+// sequence (see wrapper.Layout).
+func (m *Meno) escapeStyle(style tcell.Style, cell string) tcell.Style {
+	if !m.layout.Escapes {
+		return style
+	}
+	if params, ok := ansi.SGR(cell); ok {
+		return applySGR(style, m.style, params)
+	}
+	return style
+}
+
+// drawString draws the string (of characters that each take one column) from
+// the column, and returns the column after it.
+func (m *Meno) drawString(row, col int, s string, style tcell.Style) int {
+	for _, r := range s {
+		m.screen.SetContent(col, row, r, nil, style)
+		col++
+	}
+	return col
+}
+
+// drawHex draws the line of a hex dump like `hexdump -C` does: the offset of
+// its first byte, each byte in hex, and then the bytes that are printable
+// ASCII characters (and a '.' for the rest). It returns the column after it.
+func (m *Meno) drawHex(row int, line *wrapper.VisibleLine) int {
+	col := m.drawString(row, 0, fmt.Sprintf("%08x  ", line.Number*hexBytesPerLine), m.gutterStyle)
+	for i := 0; i < hexBytesPerLine; i++ {
+		if i == hexBytesPerLine/2 {
+			col = m.drawString(row, col, " ", m.style)
+		}
+		if i >= len(line.Line) {
+			col = m.drawString(row, col, "   ", m.style)
+			continue
+		}
+		style := m.styleAt(line.Number, i, m.style)
+		col = m.drawString(row, col, fmt.Sprintf("%02x", line.Line[i]), style)
+		// The space between two bytes of the same match is highlighted too.
+		spaceStyle := m.style
+		if i+1 < len(line.Line) && i+1 != hexBytesPerLine/2 && style != m.style && m.styleAt(line.Number, i+1, m.style) == style {
+			spaceStyle = style
+		}
+		col = m.drawString(row, col, " ", spaceStyle)
+	}
+	col = m.drawString(row, col, " |", m.style)
+	for i := 0; i < len(line.Line); i++ {
+		b := line.Line[i]
+		if b < ' ' || b > '~' {
+			b = '.'
+		}
+		col = m.drawString(row, col, string(b), m.styleAt(line.Number, i, m.style))
+	}
+	return m.drawString(row, col, "|", m.style)
+}
+
+// detectBinary shows the input as a hex dump if the first block of it has a
+// NUL byte, like a binary file does. It only checks once, and not if the hex
+// dump was turned on (or off) already.
+func (m *Meno) detectBinary() {
+	if m.detectedBinary {
+		return
+	}
+	status := m.driver.ReadStatus()
+	if status.BytesRead == 0 {
+		// The input is empty, or nothing has been read yet.
+		m.detectedBinary = status.RemainingBytes == 0
+		return
+	}
+	m.detectedBinary = true
+	block, err := m.driver.Block(0)
+	if err != nil {
+		glog.Errorf("Block(0): %v", err)
+		return
+	}
+	if bytes.IndexByte(block.Bytes, 0) != -1 {
+		glog.Infof("The input has a NUL byte; showing it as a hex dump")
+		m.setHex(true)
+	}
+}
+
+// setHex shows the input as a hex dump, or as text.
+func (m *Meno) setHex(on bool) {
+	layout := m.layout
+	layout.HexBytes = 0
+	if on {
+		layout.HexBytes = hexBytesPerLine
+	}
+	if err := m.driver.SetLayout(layout); err != nil {
+		glog.Errorf("SetLayout(%+v): %v", layout, err)
+		return
+	}
+	m.hex = on
+	m.layout = layout
+	// The lines are of other bytes now, so the view goes back to the start,
+	// and the search (which may be for hex bytes now) is run again by `n`.
+	m.stopSearch()
+	m.firstLine = 0
+	m.leftCol = 0
+	m.screen.Clear()
+	m.resized()
+	m.showScreen()
+}
+
+// gutterWidth returns how many columns at the left of each row are taken by
+// line numbers.
+func (m *Meno) gutterWidth() int {
+	if !m.lineNumbers || m.hex {
+		return 0
+	}
+	return m.gutterDigits + 1
+}
+
+// drawGutter draws the line number of the line, unless it continues the line
+// above it, and returns the column after the gutter.
+func (m *Meno) drawGutter(row int, line *wrapper.VisibleLine) int {
+	text := strings.Repeat(" ", m.gutterDigits)
+	if !line.Continuation {
+		text = fmt.Sprintf("%*d", m.gutterDigits, line.LogicalLine+1)
+	}
+	col := 0
+	for _, r := range text + " " {
+		m.screen.SetContent(col, row, r, nil, m.gutterStyle)
+		col++
+	}
+	return col
+}
+
+func (m *Meno) keyDownCommand(ev *tcell.EventKey) {
+	switch ev.Key() {
+	case tcell.KeyEscape, tcell.KeyCtrlC:
+		m.commandInput = nil
+		m.changeMode(ModePaging)
+	case tcell.KeyEnter:
+		input := string(m.commandInput)
+		m.commandInput = nil
+		m.changeMode(ModePaging)
+		m.runCommand(input)
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		l := len(m.commandInput)
+		if l == 0 {
+			return
+		}
+		m.commandInput = m.commandInput[:l-1]
+		m.showScreen()
+	case tcell.KeyRune:
+		m.commandInput = append(m.commandInput, ev.Rune())
+		m.showScreen()
+	default:
+		glog.Errorf("keyDownCommand unhandled EventKey %v", ev.Key())
+	}
+}
+
+// keyDownFilter handles the keys typed at the `&` prompt.
+func (m *Meno) keyDownFilter(ev *tcell.EventKey) {
+	switch ev.Key() {
+	case tcell.KeyEscape, tcell.KeyCtrlC:
+		m.filterInput = nil
+		m.changeMode(ModePaging)
+	case tcell.KeyEnter:
+		input := string(m.filterInput)
+		m.filterInput = nil
+		m.changeMode(ModePaging)
+		m.applyFilter(input)
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		l := len(m.filterInput)
+		if l == 0 {
+			return
+		}
+		m.filterInput = m.filterInput[:l-1]
+		m.showScreen()
+	case tcell.KeyRune:
+		m.filterInput = append(m.filterInput, ev.Rune())
+		m.showScreen()
+	default:
+		glog.Errorf("keyDownFilter unhandled EventKey %v", ev.Key())
+	}
+}
+
+// The prefix of filter input which shows the lines that don't match.
+const invertFilterPrefix = "!"
+
+// applyFilter shows only the lines that match the input, which is parsed like
+// the input of a search, or the ones that don't if it starts with `!`. Empty
+// input shows every line again.
+func (m *Meno) applyFilter(input string) {
+	var filter wrapper.LineFilter
+	if query := strings.TrimPrefix(input, invertFilterPrefix); query != "" {
+		filter = wrapper.LineFilter{
+			SearchRequest: searchRequestFor(query, !m.config.CaseSensitive, m.hex),
+			Invert:        query != input,
+		}
+	}
+	if err := m.driver.SetLineFilter(filter); err != nil {
+		glog.Errorf("SetLineFilter(%v): %v", filter, err)
+		m.message = err.Error()
+		m.showScreen()
+		return
+	}
+	m.filter = ""
+	if filter.Query != "" {
+		m.filter = input
+	}
+	// Other lines are shown now.
+	m.firstLine = 0
+	m.screen.Clear()
+	m.resized()
+	m.showScreen()
+}
+
+// runCommand jumps to where the `:` command says.
+func (m *Meno) runCommand(input string) {
+	cmd, err := parseGoto(input)
+	if err != nil {
+		m.message = err.Error()
+		m.showScreen()
+		return
+	}
+	line, err := m.lineFor(cmd)
+	if err != nil {
+		glog.Errorf("lineFor(%v): %v", cmd, err)
+		m.message = err.Error()
+		m.showScreen()
+		return
+	}
+	m.jumpToLine(line)
+}
+
+// lineFor returns the visible line that the command goes to. Anything past
+// what has been read goes to the last line.
+func (m *Meno) lineFor(cmd gotoCommand) (int, error) {
+	last := m.driver.TotalLines() - 1
+	status := m.driver.ReadStatus()
+	switch cmd.kind {
+	case gotoLine:
+		if cmd.n < 1 {
+			return 0, nil
+		}
+		if cmd.n > m.driver.TotalLogicalLines() {
+			return last, nil
+		}
+		return m.driver.LogicalLine(cmd.n - 1)
+	case gotoPercent:
+		total := status.BytesRead
+		if status.RemainingBytes > 0 {
+			total += status.RemainingBytes
+		}
+		offset := int(int64(total) * int64(cmd.n) / 100)
+		if offset >= status.BytesRead {
+			return last, nil
+		}
+		return m.driver.LineAtOffset(offset)
+	case gotoOffset:
+		if cmd.n >= status.BytesRead {
+			return last, nil
+		}
+		return m.driver.LineAtOffset(cmd.n)
+	}
+	return 0, fmt.Errorf("Unknown command %v", cmd)
+}
+
 func (m *Meno) keyDownSearchActive(ev *tcell.EventKey) {
 	switch ev.Key() {
 	case tcell.KeyEscape, tcell.KeyCtrlC:
+		m.stopSearch()
 		m.changeMode(ModePaging)
 	default:
 		glog.Errorf("keyDownSearching unhandled EventKey %v", ev.Key())
@@ -292,31 +1150,251 @@ func (m *Meno) startSearch(oppositeDirection bool) {
 	m.mode = ModeSearchActive
 	m.showScreen()
 
-	m.activeSearch = &activeSearch{
-		request: wrapper.SearchRequest{
-			Query: string(m.lastSearchInput),
-		},
+	down := mode != ModeSearchUp
+	if oppositeDirection {
+		down = !down
+		glog.Infof("Search direction flipped (down: %v)", down)
 	}
+	m.stopSearch()
+	m.activeSearch = m.newSearch(m.lastSearchInput, down, m.firstLine)
 
-	if oppositeDirection {
-		if mode == ModeSearchUp {
-			m.activeSearch.searchDown = true
-			glog.Infof("Search was up but flipped to down")
-		} else {
-			m.activeSearch.searchDown = false
-			glog.Infof("Search was down but flipped to up")
+	if err := m.runSearch(m.activeSearch); err != nil {
+		glog.Errorf("Search(%v): %v", m.activeSearch.request, err)
+		m.activeSearch = nil
+		m.changeMode(ModePaging)
+	}
+}
+
+// newSearch returns the search for the input, which starts at the line after
+// (or, if searching up, before) the top line of the view.
+func (m *Meno) newSearch(input []rune, down bool, firstLine int) *activeSearch {
+	as := &activeSearch{
+		request:       searchRequestFor(string(input), !m.config.CaseSensitive, m.hex),
+		searchDown:    down,
+		startFromLine: firstLine + 1,
+		current:       -1,
+	}
+	if !down {
+		as.startFromLine = firstLine - 1
+	}
+	return as
+}
+
+// runSearch starts the driver's search for the active search, canceling the
+// one it had.
+func (m *Meno) runSearch(as *activeSearch) error {
+	if as.cancel != nil {
+		as.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	id, err := m.driver.Search(ctx, as.request)
+	if err != nil {
+		cancel()
+		return err
+	}
+	as.id = id
+	as.cancel = cancel
+	as.complete = false
+	return nil
+}
+
+// stopSearch cancels the active search, if there is one, and forgets it.
+func (m *Meno) stopSearch() {
+	if as := m.activeSearch; as != nil && as.cancel != nil {
+		as.cancel()
+	}
+	m.activeSearch = nil
+}
+
+// setSearchResults stores the results of the active search. The first time
+// that the result to go to is known, it jumps to it: that's the first result
+// from where the search started, which may be known before the search is
+// complete. Otherwise the results are for the same matches (rewrapped), so
+// the current match stays.
+func (m *Meno) setSearchResults(results []wrapper.LineOffsetRange) {
+	as := m.activeSearch
+	as.results = append([]wrapper.LineOffsetRange{}, results...)
+	sort.Slice(as.results, func(i, j int) bool {
+		return as.results[i].From.Before(as.results[j].From)
+	})
+	if as.positioned {
+		if as.complete && as.current >= len(as.results) {
+			as.current = -1
+		}
+		m.driver.WatchLines(m.firstLine, m.h-1)
+		return
+	}
+	i, wrapped := as.resultFrom(as.startFromLine, as.searchDown)
+	if !as.complete {
+		// The results are found from the start of the input, so a later one
+		// may be the one to go to, unless there's one past it.
+		last := len(as.results) - 1
+		settled := !wrapped && (as.searchDown || i < last)
+		if len(as.results) == 0 || !settled {
+			m.driver.WatchLines(m.firstLine, m.h-1)
+			return
 		}
 	}
+	as.positioned = true
+	if len(as.results) == 0 {
+		if as.incremental {
+			m.restoreSearchOrigin()
+			return
+		}
+		m.message = searchNotFound
+		return
+	}
+	m.jumpToResult(i, wrapped, as.searchDown)
+}
 
-	if m.activeSearch.searchDown {
-		m.activeSearch.startFromLine = m.firstLine + 1
+// nextSearchResult makes the next result of the last search the current one,
+// in the direction of the search (or the other way, if oppositeDirection).
+func (m *Meno) nextSearchResult(oppositeDirection bool) {
+	as := m.activeSearch
+	if as == nil {
+		if len(m.lastSearchInput) > 0 {
+			m.searchInput = m.lastSearchInput
+			m.mode = m.lastSearchMode
+			m.startSearch(oppositeDirection)
+		}
+		return
+	}
+	if !as.positioned {
+		// The search is still running.
+		return
+	}
+	if len(as.results) == 0 {
+		m.message = searchNotFound
+		m.showScreen()
+		return
+	}
+	down := as.searchDown != oppositeDirection
+	var i int
+	var wrapped bool
+	if m.resultOnScreen(as.current) {
+		i, wrapped = as.resultAfter(down)
 	} else {
-		m.activeSearch.startFromLine = m.firstLine - 1
+		// We've scrolled away from the current result, so continue the
+		// search from here.
+		from := m.firstLine + 1
+		if !down {
+			from = m.firstLine - 1
+		}
+		i, wrapped = as.resultFrom(from, down)
 	}
+	if wrapped && !as.complete {
+		// There may be more results before the end of the input.
+		m.message = searchIncomplete
+		m.showScreen()
+		return
+	}
+	m.jumpToResult(i, wrapped, down)
+}
+
+func (m *Meno) resultOnScreen(i int) bool {
+	if i < 0 || i >= len(m.activeSearch.results) {
+		return false
+	}
+	line := m.activeSearch.results[i].From.Line
+	return line >= m.firstLine && line < m.firstLine+m.h-1
+}
+
+// jumpToResult makes the result the current one and scrolls the view so that
+// it's at the top. If the search wrapped around (going down or up), it says so
+// in the status line.
+func (m *Meno) jumpToResult(i int, wrapped, down bool) {
+	as := m.activeSearch
+	as.current = i
+	if wrapped {
+		if down {
+			m.message = searchWrappedDown
+		} else {
+			m.message = searchWrappedUp
+		}
+	}
+	m.scrollToResult(as.results[i])
+	prevFirstLine := m.firstLine
+	m.jumpToLine(as.results[i].From.Line)
+	if m.firstLine == prevFirstLine {
+		// Redraw the lines to move the current match.
+		m.driver.WatchLines(m.firstLine, m.h-1)
+	}
+	m.showScreen()
+}
+
+// styleAt returns the style of the byte at the offset in the line, which is
+// textStyle unless it's part of a search match.
+func (m *Meno) styleAt(line, offset int, textStyle tcell.Style) tcell.Style {
+	as := m.activeSearch
+	if as == nil {
+		return textStyle
+	}
+	switch as.resultAt(line, offset) {
+	case -1:
+		return textStyle
+	case as.current:
+		return m.currentMatchStyle
+	default:
+		return m.matchStyle
+	}
+}
+
+// The prefix of search input which makes it a regular expression search.
+const regexpSearchPrefix = "re:"
+
+// searchRequestFor parses the search input into a request. With smartCase,
+// the search ignores case unless the query has an upper case letter (in a
+// regexp, like in vim, not counting the letter after a backslash, as in \S).
+// With hexBytes, input that is only pairs of hex digits (like "de ad be ef")
+// is a search for those bytes.
+func searchRequestFor(input string, smartCase, hexBytes bool) wrapper.SearchRequest {
+	if hexBytes {
+		if query, ok := parseHexBytes(input); ok {
+			return wrapper.SearchRequest{Query: query}
+		}
+	}
+	req := wrapper.SearchRequest{
+		Query: input,
+	}
+	if strings.HasPrefix(input, regexpSearchPrefix) {
+		req.Query = strings.TrimPrefix(input, regexpSearchPrefix)
+		req.Regexp = true
+	}
+	if smartCase {
+		req.IgnoreCase = !hasUpper(req.Query, req.Regexp)
+	}
+	return req
+}
+
+// hasUpper returns whether the query has an upper case letter. If isRegexp,
+// the character after each backslash is skipped.
+func hasUpper(query string, isRegexp bool) bool {
+	escaped := false
+	for _, r := range query {
+		switch {
+		case escaped:
+			escaped = false
+		case isRegexp && r == '\\':
+			escaped = true
+		case unicode.IsUpper(r):
+			return true
+		}
+	}
+	return false
+}
 
-	if err := m.driver.Search(m.activeSearch.request); err != nil {
-		glog.Fatal(err)
+// parseHexBytes returns the bytes of the input if it's pairs of hex digits,
+// which may be separated by spaces.
+func parseHexBytes(input string) (string, bool) {
+	digits := strings.ReplaceAll(input, " ", "")
+	if digits == "" {
+		return "", false
 	}
+	b, err := hex.DecodeString(digits)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
 }
 
 /*
@@ -351,6 +1429,195 @@ func (m *Meno) startSearch(oppositeDirection bool) {
 func (m *Meno) updateSearch(input []rune) {
 	m.searchInput = input
 	m.showScreen()
+	if m.config.IncSearch {
+		m.stopIncSearchTimer()
+		m.incSearchTimer = time.NewTimer(incSearchDelay)
+		m.incSearchC = m.incSearchTimer.C
+	}
+}
+
+// browseHistory shows the query of the search that was that many before (or,
+// if negative, after) the one at the prompt, like a shell does with Up and
+// Down. After the newest one is what was typed.
+func (m *Meno) browseHistory(steps int) {
+	queries := m.history.queries
+	i := m.historyIndex + steps
+	if i < 0 || i > len(queries) {
+		return
+	}
+	if m.historyIndex == 0 {
+		m.historyDraft = m.searchInput
+	}
+	m.historyIndex = i
+	if i == 0 {
+		m.updateSearch(m.historyDraft)
+		return
+	}
+	m.updateSearch([]rune(queries[len(queries)-i]))
+}
+
+// keyDownHistorySearch searches the history for what's typed, like a shell's
+// reverse-i-search: CtrlR goes to an older match (or, with nothing typed, to
+// the newest query), Enter searches for the match, Escape goes back to the
+// prompt as it was, and any other key goes back to it with the match and is
+// then handled by the prompt (so Up and Down go on from the match).
+func (m *Meno) keyDownHistorySearch(ev *tcell.EventKey) {
+	hs := m.historySearch
+	switch ev.Key() {
+	case tcell.KeyCtrlR:
+		before := hs.match
+		if before < 0 && len(hs.text) == 0 {
+			before = len(m.history.queries)
+		}
+		if i := m.history.search(string(hs.text), before); i >= 0 {
+			hs.match = i
+		}
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if len(hs.text) > 0 {
+			hs.text = hs.text[:len(hs.text)-1]
+			hs.match = m.history.search(string(hs.text), len(m.history.queries))
+		}
+	case tcell.KeyRune:
+		hs.text = append(hs.text, ev.Rune())
+		hs.match = m.history.search(string(hs.text), len(m.history.queries))
+	case tcell.KeyEscape, tcell.KeyCtrlC, tcell.KeyCtrlG:
+		m.historySearch = nil
+	case tcell.KeyEnter:
+		m.historySearch = nil
+		if hs.match >= 0 {
+			m.historyIndex = 0
+			m.searchInput = []rune(m.history.queries[hs.match])
+		}
+		m.keyDownSearch(ev)
+		return
+	default:
+		m.historySearch = nil
+		if hs.match >= 0 {
+			if m.historyIndex == 0 {
+				m.historyDraft = m.searchInput
+			}
+			m.historyIndex = len(m.history.queries) - hs.match
+			m.updateSearch([]rune(m.history.queries[hs.match]))
+		}
+		m.keyDownSearch(ev)
+	}
+	m.showScreen()
+}
+
+// promptSearch shows the prompt of a search down or up, and remembers the
+// view (and the search) so that an incremental search can go back to it.
+func (m *Meno) promptSearch(mode Mode) {
+	m.searchOrigin = searchOrigin{
+		firstLine: m.firstLine,
+		leftCol:   m.leftCol,
+		search:    m.activeSearch,
+	}
+	// Like after the prompt was left with Escape.
+	m.searchInput = nil
+	m.historyIndex = 0
+	m.historySearch = nil
+	m.changeMode(mode)
+}
+
+func (m *Meno) stopIncSearchTimer() {
+	if m.incSearchTimer != nil {
+		m.incSearchTimer.Stop()
+		m.incSearchTimer = nil
+	}
+	m.incSearchC = nil
+}
+
+// incSearch searches for the input at the search prompt, from where the view
+// was before the prompt, and the view moves to the first result (see
+// setSearchResults). If the input can't be searched for yet (like when it's
+// shorter than a trigram), the view goes back to where it was.
+func (m *Meno) incSearch() {
+	if m.mode != ModeSearchDown && m.mode != ModeSearchUp {
+		return
+	}
+	as := m.newSearch(m.searchInput, m.mode != ModeSearchUp, m.searchOrigin.firstLine)
+	as.incremental = true
+	if cur := m.activeSearch; cur != nil && cur.incremental && cur.request == as.request {
+		return
+	}
+	m.stopSearch()
+	m.activeSearch = as
+	// Like a plain query that's too short, a regexp that the index can't
+	// narrow down (like "re:a.") isn't searched for as it's typed, since
+	// each key would read the whole input.
+	var err error
+	if as.request.Indexed() {
+		err = m.runSearch(as)
+	} else {
+		err = fmt.Errorf("The index can't narrow down the search")
+	}
+	if err != nil {
+		glog.V(1).Infof("Incremental Search(%v): %v", as.request, err)
+		m.activeSearch = nil
+		m.restoreSearchOrigin()
+	}
+	m.showScreen()
+}
+
+// acceptIncSearch makes the incremental search the last search, as if it had
+// been started with Enter.
+func (m *Meno) acceptIncSearch() {
+	m.stopIncSearchTimer()
+	as := m.activeSearch
+	input := string(m.searchInput)
+	if as == nil || !as.incremental || as.request != searchRequestFor(input, !m.config.CaseSensitive, m.hex) {
+		// Like when the query was typed faster than incSearchDelay.
+		m.restoreSearchOrigin()
+		m.startSearch(false)
+		return
+	}
+	as.incremental = false
+	m.lastSearchInput = m.searchInput
+	m.lastSearchMode = m.mode
+	if !as.positioned {
+		// The first result is shown once it's found.
+		m.changeMode(ModeSearchActive)
+		return
+	}
+	if len(as.results) == 0 {
+		m.message = searchNotFound
+	} else if _, wrapped := as.resultFrom(as.startFromLine, as.searchDown); wrapped {
+		// The message that jumpToResult set was cleared by this key.
+		m.message = searchWrappedDown
+		if !as.searchDown {
+			m.message = searchWrappedUp
+		}
+	}
+	m.searchInput = nil
+	m.changeMode(ModePaging)
+}
+
+// cancelIncSearch stops the incremental search, and goes back to the view
+// and the search from before the search prompt.
+func (m *Meno) cancelIncSearch() {
+	m.stopIncSearchTimer()
+	origin := m.searchOrigin.search
+	if m.activeSearch == origin {
+		return
+	}
+	m.stopSearch()
+	m.restoreSearchOrigin()
+	if origin != nil && origin.positioned {
+		// It was canceled, so it's run again (and stays where it was).
+		m.activeSearch = origin
+		if err := m.runSearch(origin); err != nil {
+			glog.Errorf("Search(%v): %v", origin.request, err)
+			m.activeSearch = nil
+		}
+	}
+}
+
+// restoreSearchOrigin scrolls back to the view from before the search prompt.
+func (m *Meno) restoreSearchOrigin() {
+	m.leftCol = m.searchOrigin.leftCol
+	m.jumpToLine(m.searchOrigin.firstLine)
+	// Redraw the lines without the matches of the incremental search.
+	m.driver.WatchLines(m.firstLine, m.h-1)
 }
 
 func (m *Meno) changeMode(mode Mode) {
@@ -383,31 +1650,75 @@ func (m *Meno) jumpLine(distance int) {
 }
 
 func (m *Meno) jumpToLine(newPos int) {
+	if newPos > m.maxFirstLine() {
+		newPos = m.maxFirstLine()
+	}
 	if newPos < 0 {
 		newPos = 0
-	} else if newPos > m.maxFirstLine() {
-		newPos = m.maxFirstLine()
 	}
 	glog.Infof("jumpToLine %d", newPos)
+	m.pinned = newPos >= m.maxFirstLine()
 	if newPos == m.firstLine {
 		return
 	}
 	m.firstLine = newPos
+	m.resetRowLogicalLines()
+	m.pruneEndStyles()
 	m.driver.WatchLines(m.firstLine, m.h-1)
 }
 
+// pruneEndStyles forgets the end styles of the lines more than a screen away
+// from the one on screen, so that they don't pile up as the view moves. Those
+// that are needed again are found again by startStyle.
+func (m *Meno) pruneEndStyles() {
+	for number := range m.endStyles {
+		if number < m.firstLine-m.h || number >= m.firstLine+2*m.h {
+			delete(m.endStyles, number)
+		}
+	}
+}
+
 func (m *Meno) jumpToLastLine() {
 	m.jumpToLine(m.maxFirstLine())
 }
 
+// startFollowing jumps to the end of the input and keeps the view there as
+// the input grows, like `tail -f`.
+func (m *Meno) startFollowing() {
+	if !m.following {
+		if err := m.driver.Follow(); err != nil {
+			glog.Errorf("Follow(): %v", err)
+			return
+		}
+		m.following = true
+		// Follow() cancelled the lines we were watching.
+		m.driver.WatchLines(m.firstLine, m.h-1)
+	}
+	m.jumpToLastLine()
+	m.pinned = true
+}
+
 func (m *Meno) resized() {
 	// Update every visible cell.
 	m.screen.Sync()
 
-	m.driver.ResizeWindow(m.w)
+	m.driver.ResizeWindow(m.textWidth())
+	if err := m.driver.Chop(m.chop); err != nil {
+		glog.Errorf("Chop(%v): %v", m.chop, err)
+	}
+	m.resetRowLogicalLines()
+	// The lines are wrapped again.
+	m.endStyles = make(map[int]tcell.Style)
 	m.driver.WatchLines(m.firstLine, m.h-1)
 	glog.Infof("Window resized (%d x %d)", m.w, m.h)
 
+	// The results of the last search are for the old line wrapping.
+	if as := m.activeSearch; as != nil {
+		if err := m.runSearch(as); err != nil {
+			glog.Errorf("Search(%v): %v", as.request, err)
+		}
+	}
+
 	// TODO: Adjust first line so that the first character of the previously
 	// visible first line is still in the visible first line (somewhere, not
 	// necessarily in at 0,0).
@@ -426,6 +1737,56 @@ func (m *Meno) resized() {
 	*/
 }
 
+// resetRowLogicalLines forgets what's on each row, since other lines are about
+// to be shown.
+func (m *Meno) resetRowLogicalLines() {
+	m.rowLogicalLines = make([]int, m.pageSize())
+	for i := range m.rowLogicalLines {
+		m.rowLogicalLines[i] = -1
+	}
+}
+
+// status returns what the status line shows now.
+func (m *Meno) status() status {
+	s := status{
+		name:        filepath.Base(m.config.Source.Path),
+		compression: m.config.Source.Compression,
+		totalLines:  m.driver.TotalLogicalLines(),
+		percent:     -1,
+		readStatus:  m.driver.ReadStatus(),
+	}
+	if m.config.Source.Path == "" {
+		s.name = ""
+	}
+	if m.filter != "" {
+		s.filter = "&" + m.filter
+	}
+	if as := m.activeSearch; as != nil && as.results != nil {
+		s.matches = len(as.results)
+		s.match = as.current + 1
+		s.matchedLines = as.lines
+		s.searching = !as.complete
+	}
+	lastRow := -1
+	for row, line := range m.rowLogicalLines {
+		if line == -1 {
+			continue
+		}
+		if s.firstLine == 0 {
+			s.firstLine = line + 1
+		}
+		s.lastLine = line + 1
+		lastRow = row
+	}
+	if total := m.driver.TotalLines(); lastRow >= 0 && total > 0 {
+		s.percent = (m.firstLine + lastRow + 1) * 100 / total
+	}
+	if elapsed := time.Since(m.readStart).Seconds(); elapsed > 0 {
+		s.bytesPerSecond = float64(s.readStatus.BytesRead) / elapsed
+	}
+	return s
+}
+
 func (m *Meno) showScreen() {
 	// Show only the last row
 	row := m.h - 1
@@ -435,13 +1796,26 @@ func (m *Meno) showScreen() {
 	switch m.mode {
 	case ModeSearchDown:
 		operator = '/'
+		showOperator = m.historySearch == nil
 	case ModeSearchUp:
 		operator = '?'
+		showOperator = m.historySearch == nil
+	case ModeOption:
+		operator = '-'
+	case ModeFilter:
+		operator = '&'
 	case ModeSearchActive:
 		showOperator = false
 	}
 
 	col := 0
+	if m.mode == ModePaging && m.message != "" {
+		for _, r := range m.message {
+			m.screen.SetContent(col, row, r, nil, m.style)
+			col++
+		}
+		showOperator = false
+	}
 	if showOperator {
 		m.screen.SetContent(col, row, operator, nil, m.style)
 		col++
@@ -449,10 +1823,24 @@ func (m *Meno) showScreen() {
 
 	switch m.mode {
 	case ModeSearchDown, ModeSearchUp:
+		if hs := m.historySearch; hs != nil {
+			col = m.drawString(row, col, hs.prompt(m.history), m.style)
+			break
+		}
 		for _, r := range m.searchInput {
 			m.screen.SetContent(col, row, r, nil, m.style)
 			col++
 		}
+	case ModeCommand:
+		for _, r := range m.commandInput {
+			m.screen.SetContent(col, row, r, nil, m.style)
+			col++
+		}
+	case ModeFilter:
+		for _, r := range m.filterInput {
+			m.screen.SetContent(col, row, r, nil, m.style)
+			col++
+		}
 	case ModeSearchActive:
 		for _, r := range "Searching..." {
 			m.screen.SetContent(col, row, r, nil, m.style)
@@ -461,5 +1849,26 @@ func (m *Meno) showScreen() {
 	}
 
 	m.screen.ShowCursor(col, row)
+	free := m.w - col - 1
+	for ; col < m.w; col++ {
+		m.screen.SetContent(col, row, ' ', nil, m.style)
+	}
+	if m.mode == ModePaging {
+		// Leave a space after what's on the left, and cut the status from
+		// the left if it doesn't fit.
+		m.shownStatus = m.status().String()
+		right := []rune(m.shownStatus)
+		if free < 0 {
+			free = 0
+		}
+		if len(right) > free {
+			right = right[len(right)-free:]
+		}
+		col = m.w - len(right)
+		for _, r := range right {
+			m.screen.SetContent(col, row, r, nil, m.style)
+			col++
+		}
+	}
 	m.screen.Show()
 }
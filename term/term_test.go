@@ -1,9 +1,13 @@
 package term
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -11,6 +15,7 @@ import (
 	"time"
 
 	"github.com/ewaters/meno/blocks"
+	"github.com/ewaters/meno/wrapper"
 	"github.com/gdamore/tcell/v2"
 )
 
@@ -137,6 +142,37 @@ func assertScreen(t *testing.T, screen tcell.SimulationScreen, want lineMatches)
 	}
 }
 
+type cellStyle struct {
+	row, col int
+	style    tcell.Style
+}
+
+func assertStyles(t *testing.T, screen tcell.SimulationScreen, want []cellStyle) {
+	t.Helper()
+
+	const (
+		totalDelay = 1 * time.Second
+		loopDelay  = 10 * time.Millisecond
+	)
+	for remainingDelay := totalDelay; ; remainingDelay -= loopDelay {
+		cells, w, _ := screen.GetContents()
+		var mismatch *cellStyle
+		for _, cs := range want {
+			if cells[cs.col+cs.row*w].Style != cs.style {
+				mismatch = &cs
+				break
+			}
+		}
+		if mismatch == nil {
+			return
+		}
+		if remainingDelay <= 0 {
+			t.Fatalf("Cell at row %d, col %d didn't have style %v after %v:\n%v", mismatch.row, mismatch.col, mismatch.style, totalDelay, getScreenState(screen))
+		}
+		time.Sleep(loopDelay)
+	}
+}
+
 func TestTerm(t *testing.T) {
 	const (
 		w         = 80
@@ -181,6 +217,7 @@ func TestTerm(t *testing.T) {
 		sb.WriteRune('\n')
 		writer.Write([]byte(sb.String()))
 	}
+	writer.Close()
 
 	firstPage := []lineMatch{
 		{0, "000: .+"},
@@ -246,3 +283,1352 @@ func TestTerm(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestTermFollow(t *testing.T) {
+	const (
+		w         = 80
+		h         = 25
+		blockSize = 10
+	)
+	reader, writer := io.Pipe()
+	defer writer.Close()
+
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      blockSize,
+			IndexNextBytes: 2,
+			// The last line is only flushed after a delay, since the next
+			// bytes haven't been read yet.
+			FlushAfter: 10 * time.Millisecond,
+		},
+		LineSeperator: []byte("\n"),
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	writeLines := func(from, to int) {
+		for i := from; i < to; i++ {
+			// Each line is exactly blockSize, so every line is a block.
+			writer.Write([]byte(fmt.Sprintf("%03d: aaaa\n", i)))
+		}
+	}
+
+	writeLines(0, 30)
+	assertScreen(t, screen, []lineMatch{
+		{0, "000: .+"},
+		{23, "023: .+"},
+	})
+
+	screen.InjectKeyBytes([]byte("F"))
+	assertScreen(t, screen, []lineMatch{
+		{0, "006: .+"},
+		{23, "029: .+"},
+	})
+
+	// The view follows new lines while it's at the bottom.
+	writeLines(30, 35)
+	assertScreen(t, screen, []lineMatch{
+		{0, "011: .+"},
+		{23, "034: .+"},
+	})
+
+	// But not once it has been scrolled up.
+	screen.InjectKeyBytes([]byte("k"))
+	assertScreen(t, screen, []lineMatch{
+		{0, "010: .+"},
+	})
+	writeLines(35, 40)
+	time.Sleep(2 * tickInterval)
+	assertScreen(t, screen, []lineMatch{
+		{0, "010: .+"},
+	})
+
+	// Until we jump back to the bottom.
+	screen.InjectKeyBytes([]byte("G"))
+	assertScreen(t, screen, []lineMatch{
+		{0, "016: .+"},
+		{23, "039: .+"},
+	})
+	writeLines(40, 41)
+	assertScreen(t, screen, []lineMatch{
+		{0, "017: .+"},
+		{23, "040: .+"},
+	})
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestTermReading(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      10,
+			IndexNextBytes: 2,
+			FlushAfter:     10 * time.Millisecond,
+		},
+		LineSeperator: []byte("\n"),
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	writer.Write([]byte("abc\n"))
+	assertScreen(t, screen, []lineMatch{
+		{0, "abc"},
+		{24, `: +lines 1-1/1  100%  \(reading\.\.\.\)  4 B$`},
+	})
+
+	writer.Write([]byte("def\n"))
+	writer.Close()
+	assertScreen(t, screen, []lineMatch{
+		{0, "abc"},
+		{1, "def"},
+		{24, ": +lines 1-2/2  100%$"},
+	})
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestTermCompressed(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte("abc\ndef\n"))
+	gw.Close()
+
+	source, err := blocks.ConfigSource{
+		Input: bytes.NewReader(buf.Bytes()),
+		Size:  buf.Len(),
+	}.Decompress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source:         source,
+			BlockSize:      10,
+			IndexNextBytes: 2,
+		},
+		LineSeperator: []byte("\n"),
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	assertScreen(t, screen, []lineMatch{
+		{0, "abc"},
+		{1, "def"},
+		{24, `: +lines 1-2/2  100%  \[gzip\]$`},
+	})
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestTermHighlight(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      10,
+			IndexNextBytes: 2,
+		},
+		LineSeperator: []byte("\n"),
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	writer.Write([]byte("abc foo\nfoo bar\n"))
+	writer.Close()
+	assertScreen(t, screen, []lineMatch{
+		{0, "abc foo"},
+		{1, "foo bar"},
+	})
+
+	// The search starts at the second line on screen.
+	screen.InjectKeyBytes([]byte("/foo\r"))
+	current, match, plain := meno.currentMatchStyle, meno.matchStyle, meno.style
+	assertStyles(t, screen, []cellStyle{
+		{0, 3, plain},
+		{0, 4, match},
+		{0, 6, match},
+		{1, 0, current},
+		{1, 2, current},
+		{1, 3, plain},
+	})
+
+	// The matches are found again in the rewrapped lines.
+	screen.SetSize(5, 25)
+	screen.PostEvent(tcell.NewEventResize(5, 25))
+	assertScreen(t, screen, []lineMatch{
+		{0, "abc f"},
+		{1, "oo"},
+		{2, "foo b"},
+		{3, "ar"},
+	})
+	assertStyles(t, screen, []cellStyle{
+		{0, 3, plain},
+		{0, 4, match},
+		{1, 0, match},
+		{1, 1, match},
+		{2, 0, current},
+		{2, 2, current},
+		{2, 3, plain},
+	})
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestTermWide(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      10,
+			IndexNextBytes: 6,
+		},
+		LineSeperator: []byte("\n"),
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	// Each character takes two columns (the second is blank in the
+	// simulation screen), so 40 of them fill a row. The blocks split the
+	// characters in the middle of their UTF-8 sequences.
+	writer.Write([]byte(strings.Repeat("日本", 20) + "ログx\n"))
+	writer.Close()
+	assertScreen(t, screen, []lineMatch{
+		{0, "^(日 本 ){19}日 本$"},
+		{1, "^ロ グ x$"},
+	})
+
+	screen.InjectKeyBytes([]byte("/ログ\r"))
+	current, plain := meno.currentMatchStyle, meno.style
+	assertStyles(t, screen, []cellStyle{
+		{1, 0, current},
+		{1, 2, current},
+		{1, 4, plain},
+	})
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestTermTabs(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      10,
+			IndexNextBytes: 6,
+		},
+		LineSeperator: []byte("\n"),
+		TabWidth:      4,
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	// Each "x\t" takes 4 columns, so 20 of them fill a row.
+	writer.Write([]byte("a\tbb\tccc\n" + strings.Repeat("x\t", 25) + "\n"))
+	writer.Close()
+	assertScreen(t, screen, []lineMatch{
+		{0, "^a   bb  ccc$"},
+		{1, "^(x   ){19}x$"},
+		{2, "^(x   ){4}x$"},
+	})
+
+	screen.InjectKeyBytes([]byte("/ccc\r"))
+	current, plain := meno.currentMatchStyle, meno.style
+	assertStyles(t, screen, []cellStyle{
+		{0, 7, plain},
+		{0, 8, current},
+		{0, 10, current},
+		{0, 11, plain},
+	})
+
+	// A tab in a match is highlighted up to the tab stop.
+	screen.InjectKeyBytes([]byte("/re:bb\\tc\r"))
+	assertStyles(t, screen, []cellStyle{
+		{0, 3, plain},
+		{0, 4, current},
+		{0, 6, current},
+		{0, 7, current},
+		{0, 8, current},
+		{0, 9, plain},
+	})
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestTermColors(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      10,
+			IndexNextBytes: 6,
+		},
+		LineSeperator:   []byte("\n"),
+		RawControlChars: true,
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	// The second line is wrapped, and stays green on the row after.
+	writer.Write([]byte("\x1b[31mFA\x1b[1mIL\x1b[0m done\n\x1b[32m" + strings.Repeat("x", 100) + "\x1b[0m\n" + strings.Repeat("ok\n", 30)))
+	writer.Close()
+	assertScreen(t, screen, []lineMatch{
+		{0, "^FAIL done$"},
+		{1, "^x{80}$"},
+		{2, "^x{20}$"},
+	})
+
+	plain := meno.style
+	red := plain.Foreground(tcell.ColorMaroon)
+	green := plain.Foreground(tcell.ColorGreen)
+	assertStyles(t, screen, []cellStyle{
+		{0, 0, red},
+		{0, 2, red.Bold(true)},
+		{0, 4, plain},
+		{1, 0, green},
+		{2, 19, green},
+		{2, 20, plain},
+	})
+
+	// The escape sequences in the word are ignored by searches.
+	screen.InjectKeyBytes([]byte("/FAIL\r"))
+	current := meno.currentMatchStyle
+	assertStyles(t, screen, []cellStyle{
+		{0, 0, current},
+		{0, 3, current},
+		{0, 4, plain},
+	})
+
+	// And can't be searched for.
+	screen.InjectKeyBytes([]byte("/[32m\r"))
+	assertScreen(t, screen, []lineMatch{
+		{24, searchNotFound},
+	})
+
+	// The style of a wrapped row is found from the rows before it, even
+	// when they aren't on screen.
+	screen.InjectKeyBytes([]byte("gjj"))
+	screen.PostEvent(tcell.NewEventResize(80, 25))
+	assertScreen(t, screen, []lineMatch{
+		{0, "^x{20}$"},
+	})
+	assertStyles(t, screen, []cellStyle{
+		{0, 0, green},
+	})
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestPruneEndStyles(t *testing.T) {
+	m := &Meno{
+		h:         10,
+		firstLine: 100,
+		endStyles: make(map[int]tcell.Style),
+	}
+	for number := 0; number < 200; number++ {
+		m.endStyles[number] = tcell.StyleDefault
+	}
+	m.pruneEndStyles()
+	if got, want := len(m.endStyles), 30; got != want {
+		t.Errorf("pruneEndStyles(): got %d lines, want %d", got, want)
+	}
+	for _, number := range []int{90, 100, 119} {
+		if _, ok := m.endStyles[number]; !ok {
+			t.Errorf("pruneEndStyles(): line %d was pruned", number)
+		}
+	}
+	for _, number := range []int{89, 120} {
+		if _, ok := m.endStyles[number]; ok {
+			t.Errorf("pruneEndStyles(): line %d was kept", number)
+		}
+	}
+}
+
+func TestTermControl(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      10,
+			IndexNextBytes: 6,
+		},
+		LineSeperator: []byte("\n"),
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	// Each "^A" takes two columns, so 40 of them fill a row.
+	writer.Write([]byte("a\rb\x00c\xe6d\x1b[31m\n" + strings.Repeat("\x01", 41) + "\n"))
+	writer.Close()
+	assertScreen(t, screen, []lineMatch{
+		{0, `^a\^Mb\^@c<E6>d\^\[\[31m$`},
+		{1, `^(\^A){40}$`},
+		{2, `^\^A$`},
+	})
+
+	plain, control := meno.style, meno.controlStyle
+	assertStyles(t, screen, []cellStyle{
+		{0, 0, plain},
+		{0, 1, control},
+		{0, 2, control},
+		{0, 3, plain},
+		{0, 7, control},
+		{0, 10, control},
+		{0, 11, plain},
+	})
+
+	// A match is highlighted over the escaped bytes in it.
+	screen.InjectKeyBytes([]byte("/re:c.d\r"))
+	current := meno.currentMatchStyle
+	assertStyles(t, screen, []cellStyle{
+		{0, 5, control},
+		{0, 6, current},
+		{0, 7, current},
+		{0, 10, current},
+		{0, 11, current},
+		{0, 12, control},
+	})
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestTermSeparator(t *testing.T) {
+	for _, tc := range []struct {
+		sep   string
+		input string
+		want  []lineMatch
+	}{
+		// Without a "^M" at the end of each line.
+		{"\r\n", "one\r\ntwo\nstill two\r\n", []lineMatch{
+			{0, `^ +1 one$`},
+			{1, `^ +2 two\^Jstill two$`},
+			{2, `^$`},
+		}},
+		// Like the output of `find -print0`.
+		{"\x00", "a.txt\x00b\nc.txt\x00", []lineMatch{
+			{0, `^ +1 a.txt$`},
+			{1, `^ +2 b\^Jc.txt$`},
+		}},
+		{"\n--\n", "first\nrecord\n--\nsecond\n--\n", []lineMatch{
+			{0, `^ +1 first\^Jrecord$`},
+			{1, `^ +2 second$`},
+		}},
+	} {
+		reader, writer := io.Pipe()
+
+		config := MenoConfig{
+			Config: blocks.Config{
+				Source: blocks.ConfigSource{
+					Input: reader,
+				},
+				BlockSize:      4,
+				IndexNextBytes: 2,
+			},
+			LineSeperator: []byte(tc.sep),
+			LineNumbers:   true,
+		}
+
+		screen := tcell.NewSimulationScreen("")
+		meno, err := NewMeno(config, screen)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			meno.Run()
+			wg.Done()
+		}()
+
+		writer.Write([]byte(tc.input))
+		writer.Close()
+		assertScreen(t, screen, tc.want)
+
+		screen.InjectKeyBytes([]byte("q"))
+		wg.Wait()
+	}
+}
+
+func TestTermHex(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      10,
+			IndexNextBytes: 4,
+		},
+		LineSeperator: []byte("\n"),
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	// The NUL byte makes it a hex dump.
+	writer.Write([]byte("hello\x00world\x01\x02\x03\x04\xde\xad\xbe\xef tail\n"))
+	writer.Close()
+	assertScreen(t, screen, []lineMatch{
+		{0, `^00000000  68 65 6c 6c 6f 00 77 6f  72 6c 64 01 02 03 04 de  \|hello\.world\.{5}\|$`},
+		{1, `^00000010  ad be ef 20 74 61 69 6c  0a +\|\.{3} tail\.\|$`},
+	})
+
+	// The bytes are found across the rows. The keys are sent in two parts,
+	// since the screen only queues 10 events.
+	screen.InjectKeyBytes([]byte("/de ad"))
+	assertScreen(t, screen, []lineMatch{{24, `^/de ad$`}})
+	screen.InjectKeyBytes([]byte(" be ef\r"))
+	current, plain := meno.currentMatchStyle, meno.style
+	assertStyles(t, screen, []cellStyle{
+		{0, 55, plain},
+		{0, 56, current},
+		{0, 57, current},
+		{0, 58, plain},
+		{0, 76, current},
+		{1, 10, current},
+		{1, 12, current},
+		{1, 17, current},
+		{1, 18, plain},
+		{1, 61, current},
+		{1, 63, current},
+		{1, 64, plain},
+	})
+
+	// Back to text, where "\xde\xad" is U+07AD.
+	screen.InjectKeyBytes([]byte("-H"))
+	assertScreen(t, screen, []lineMatch{
+		{0, `^hello\^@world\^A\^B\^C\^D<U\+07AD><BE><EF> tail$`},
+	})
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestTermFilter(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      8,
+			IndexNextBytes: 4,
+		},
+		LineSeperator: []byte("\n"),
+		LineNumbers:   true,
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	writer.Write([]byte("error: 1\nok\nERROR: 2\nok\n"))
+	writer.Close()
+	assertScreen(t, screen, []lineMatch{
+		{0, `^ +1 error: 1$`},
+		{3, `^ +4 ok$`},
+	})
+
+	// The lines keep their numbers.
+	screen.InjectKeyBytes([]byte("&error\r"))
+	assertScreen(t, screen, []lineMatch{
+		{0, `^ +1 error: 1$`},
+		{1, `^ +3 ERROR: 2$`},
+		{2, `^$`},
+		{24, `&error  lines 1-3/4`},
+	})
+
+	screen.InjectKeyBytes([]byte("&!error\r"))
+	assertScreen(t, screen, []lineMatch{
+		{0, `^ +2 ok$`},
+		{1, `^ +4 ok$`},
+		{2, `^$`},
+	})
+
+	// Every line is shown again.
+	screen.InjectKeyBytes([]byte("&\r"))
+	assertScreen(t, screen, []lineMatch{
+		{0, `^ +1 error: 1$`},
+		{1, `^ +2 ok$`},
+		{3, `^ +4 ok$`},
+	})
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestTermSearchNext(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      10,
+			IndexNextBytes: 2,
+		},
+		LineSeperator: []byte("\n"),
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	for i := 0; i < 60; i++ {
+		word := "aaaa"
+		if i == 10 || i == 40 || i == 55 {
+			word = "foo!"
+		}
+		writer.Write([]byte(fmt.Sprintf("%03d: %s\n", i, word)))
+	}
+	writer.Close()
+	assertScreen(t, screen, []lineMatch{
+		{0, "000: aaaa"},
+	})
+
+	for _, tc := range []struct {
+		keys string
+		want []lineMatch
+	}{
+		{"/foo\r", []lineMatch{
+			{0, "010: foo!"},
+			{24, ":.*match 1 of 3 in 3 lines"},
+		}},
+		// The last page starts at line 36.
+		{"n", []lineMatch{
+			{0, "036: aaaa"},
+			{4, "040: foo!"},
+			{24, "match 2 of 3 in 3 lines"},
+		}},
+		{"n", []lineMatch{
+			{0, "036: aaaa"},
+			{19, "055: foo!"},
+		}},
+		{"n", []lineMatch{
+			{0, "010: foo!"},
+			{24, searchWrappedDown},
+		}},
+		{"N", []lineMatch{
+			{0, "036: aaaa"},
+			{24, searchWrappedUp},
+		}},
+		// The message is cleared by the next key.
+		{"k", []lineMatch{
+			{0, "035: aaaa"},
+			{24, ":"},
+		}},
+		// Scrolled away from the current result, so the search continues
+		// from the top line.
+		{"gN", []lineMatch{
+			{0, "036: aaaa"},
+			{24, searchWrappedUp},
+		}},
+		// Searching up starts above the top line.
+		{"?foo\r", []lineMatch{
+			{0, "010: foo!"},
+			{24, ":"},
+		}},
+		{"n", []lineMatch{
+			{0, "036: aaaa"},
+			{24, searchWrappedUp},
+		}},
+		{"N", []lineMatch{
+			{0, "010: foo!"},
+			{24, searchWrappedDown},
+		}},
+		{"/nope\r", []lineMatch{
+			{0, "010: foo!"},
+			{24, searchNotFound},
+		}},
+	} {
+		screen.InjectKeyBytes([]byte(tc.keys))
+		assertScreen(t, screen, tc.want)
+	}
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestTermIncSearch(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      10,
+			IndexNextBytes: 2,
+		},
+		LineSeperator: []byte("\n"),
+		IncSearch:     true,
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	for i := 0; i < 60; i++ {
+		word := "aaaa"
+		switch i {
+		case 5:
+			word = "fox!"
+		case 10, 40, 55:
+			word = "foo!"
+		}
+		writer.Write([]byte(fmt.Sprintf("%03d: %s\n", i, word)))
+	}
+	writer.Close()
+	assertScreen(t, screen, []lineMatch{
+		{0, "000: aaaa"},
+	})
+
+	for _, tc := range []struct {
+		keys string
+		want []lineMatch
+	}{
+		// Too short to search for.
+		{"/fo", []lineMatch{
+			{0, "000: aaaa"},
+			{24, "/fo"},
+		}},
+		{"x", []lineMatch{
+			{0, "005: fox!"},
+			{24, "/fox"},
+		}},
+		// Each search starts from where the view was.
+		{"\x7fo", []lineMatch{
+			{0, "010: foo!"},
+			{24, "/foo"},
+		}},
+		{"\x1b", []lineMatch{
+			{0, "000: aaaa"},
+			{24, ":"},
+		}},
+		// Nor is a regexp without enough of a literal to be looked up in
+		// the index.
+		{"/re:fo.", []lineMatch{
+			{0, "000: aaaa"},
+			{24, "/re:fo."},
+		}},
+		{"\x7fx", []lineMatch{
+			{0, "005: fox!"},
+			{24, "/re:fox"},
+		}},
+		{"\x1b", []lineMatch{
+			{0, "000: aaaa"},
+			{24, ":"},
+		}},
+		// Enter before the incremental search runs.
+		{"/foo\r", []lineMatch{
+			{0, "010: foo!"},
+			{24, "match 1 of 3 in 3 lines"},
+		}},
+		{"/fox", []lineMatch{
+			{0, "005: fox!"},
+		}},
+		// The last search is back.
+		{"\x1b", []lineMatch{
+			{0, "010: foo!"},
+			{24, "match 1 of 3 in 3 lines"},
+		}},
+		{"/nope", []lineMatch{
+			{0, "010: foo!"},
+			{24, "/nope"},
+		}},
+		{"\r", []lineMatch{
+			{0, "010: foo!"},
+			{24, searchNotFound},
+		}},
+		// The last page starts at line 36.
+		{"?foo", []lineMatch{
+			{0, "036: aaaa"},
+			{24, "[?]foo"},
+		}},
+		{"\r", []lineMatch{
+			{0, "036: aaaa"},
+			{24, searchWrappedUp},
+		}},
+		{"n", []lineMatch{
+			{0, "036: aaaa"},
+			{4, "040: foo!"},
+			{24, "match 2 of 3 in 3 lines"},
+		}},
+	} {
+		screen.InjectKeyBytes([]byte(tc.keys))
+		assertScreen(t, screen, tc.want)
+	}
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestTermSearchHistory(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	historyFile := filepath.Join(t.TempDir(), "history")
+	if err := os.WriteFile(historyFile, []byte("005\nfoo\nnope\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      10,
+			IndexNextBytes: 2,
+		},
+		LineSeperator: []byte("\n"),
+		HistoryFile:   historyFile,
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	for i := 0; i < 60; i++ {
+		word := "aaaa"
+		if i == 10 || i == 40 || i == 55 {
+			word = "foo!"
+		}
+		writer.Write([]byte(fmt.Sprintf("%03d: %s\n", i, word)))
+	}
+	writer.Close()
+	assertScreen(t, screen, []lineMatch{
+		{0, "000: aaaa"},
+	})
+
+	for _, tc := range []struct {
+		keys string
+		// Injected after the keys, if set.
+		key  tcell.Key
+		want []lineMatch
+	}{
+		{"/f", tcell.KeyUp, []lineMatch{
+			{24, "^/nope$"},
+		}},
+		{"", tcell.KeyUp, []lineMatch{
+			{24, "^/foo$"},
+		}},
+		{"", tcell.KeyUp, []lineMatch{
+			{24, "^/005$"},
+		}},
+		// There's nothing older.
+		{"", tcell.KeyUp, []lineMatch{
+			{24, "^/005$"},
+		}},
+		{"", tcell.KeyDown, []lineMatch{
+			{24, "^/foo$"},
+		}},
+		{"", tcell.KeyDown, []lineMatch{
+			{24, "^/nope$"},
+		}},
+		// What was typed.
+		{"", tcell.KeyDown, []lineMatch{
+			{24, "^/f$"},
+		}},
+		{"", tcell.KeyUp, []lineMatch{
+			{24, "^/nope$"},
+		}},
+		{"", tcell.KeyUp, []lineMatch{
+			{24, "^/foo$"},
+		}},
+		{"\r", 0, []lineMatch{
+			{0, "010: foo!"},
+			{24, "match 1 of 3 in 3 lines"},
+		}},
+		{"/\x120", 0, []lineMatch{
+			{24, "^[(]reverse-i-search[)]`0': 005$"},
+		}},
+		{"x", 0, []lineMatch{
+			{24, "^[(]failed reverse-i-search[)]`0x':$"},
+		}},
+		{"\x7f", 0, []lineMatch{
+			{24, "^[(]reverse-i-search[)]`0': 005$"},
+		}},
+		// Searching for the match, which is below the top line.
+		{"\r", 0, []lineMatch{
+			{0, "005: aaaa"},
+			{24, searchWrappedDown},
+		}},
+		{"/\x12o", 0, []lineMatch{
+			{24, "^[(]reverse-i-search[)]`o': foo$"},
+		}},
+		// An older match.
+		{"\x12", 0, []lineMatch{
+			{24, "^[(]reverse-i-search[)]`o': nope$"},
+		}},
+		// There's nothing older.
+		{"\x12", 0, []lineMatch{
+			{24, "^[(]reverse-i-search[)]`o': nope$"},
+		}},
+		// Another key goes back to the prompt with the match, and is then
+		// handled there: Down goes to the query after the match.
+		{"", tcell.KeyDown, []lineMatch{
+			{24, "^/foo$"},
+		}},
+		{"\x12005\x1b", 0, []lineMatch{
+			{24, "^/foo$"},
+		}},
+		// With nothing typed, CtrlR goes to the newest query, and then to
+		// older ones.
+		{"\x12\x12", 0, []lineMatch{
+			{24, "^[(]reverse-i-search[)]`': 005$"},
+		}},
+		{"\x12", 0, []lineMatch{
+			{24, "^[(]reverse-i-search[)]`': foo$"},
+		}},
+		{"\x1b", 0, []lineMatch{
+			{24, "^/foo$"},
+		}},
+		{"\x1b", 0, []lineMatch{
+			{0, "005: aaaa"},
+			{24, "^:"},
+		}},
+	} {
+		screen.InjectKeyBytes([]byte(tc.keys))
+		if tc.key != 0 {
+			screen.InjectKey(tc.key, 0, tcell.ModNone)
+		}
+		assertScreen(t, screen, tc.want)
+	}
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+
+	// The searches are saved, newest last.
+	got, err := os.ReadFile(historyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "nope\nfoo\n005\n"; string(got) != want {
+		t.Errorf("History: got %q, want %q", got, want)
+	}
+}
+
+func TestTermGoto(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      10,
+			IndexNextBytes: 2,
+		},
+		LineSeperator: []byte("\n"),
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	// Each line is 4 bytes.
+	for i := 0; i < 100; i++ {
+		writer.Write([]byte(fmt.Sprintf("%03d\n", i)))
+	}
+	writer.Close()
+	assertScreen(t, screen, []lineMatch{
+		{0, "000"},
+	})
+
+	for _, tc := range []struct {
+		keys string
+		want []lineMatch
+	}{
+		{":50\r", []lineMatch{
+			{0, "049"},
+			{24, "lines 50-73/100  73%$"},
+		}},
+		{":@8\r", []lineMatch{
+			{0, "002"},
+		}},
+		{":50%\r", []lineMatch{
+			{0, "050"},
+		}},
+		// The same, while paging.
+		{"g25%", []lineMatch{
+			{0, "025"},
+		}},
+		{"%", []lineMatch{
+			{0, "000"},
+		}},
+		// A count is forgotten by the next key.
+		{"75j%", []lineMatch{
+			{0, "000"},
+		}},
+		// Past the end goes to the last page.
+		{":1000\r", []lineMatch{
+			{0, "076"},
+		}},
+		{":abc\r", []lineMatch{
+			{0, "076"},
+			{24, `Invalid command "abc"`},
+		}},
+		{":1\r", []lineMatch{
+			{0, "000"},
+		}},
+	} {
+		screen.InjectKeyBytes([]byte(tc.keys))
+		assertScreen(t, screen, tc.want)
+	}
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestTermLineNumbers(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      10,
+			IndexNextBytes: 2,
+		},
+		LineSeperator: []byte("\n"),
+		LineNumbers:   true,
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	long := strings.Repeat("x", 100)
+	writer.Write([]byte("abc\n" + long + "\ndef\n"))
+	writer.Close()
+
+	// The gutter takes 7 of the 80 columns, so the long line is wrapped
+	// after 73.
+	assertScreen(t, screen, []lineMatch{
+		{0, "^     1 abc$"},
+		{1, "^     2 x{73}$"},
+		{2, "^       x{27}$"},
+		{3, "^     3 def$"},
+	})
+
+	screen.InjectKeyBytes([]byte("-N"))
+	assertScreen(t, screen, []lineMatch{
+		{0, "^abc$"},
+		{1, "^x{80}$"},
+		{2, "^x{20}$"},
+		{3, "^def$"},
+	})
+
+	screen.InjectKeyBytes([]byte("-N"))
+	assertScreen(t, screen, []lineMatch{
+		{0, "^     1 abc$"},
+		{3, "^     3 def$"},
+	})
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestTermChop(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	config := MenoConfig{
+		Config: blocks.Config{
+			Source: blocks.ConfigSource{
+				Input: reader,
+			},
+			BlockSize:      10,
+			IndexNextBytes: 2,
+		},
+		LineSeperator: []byte("\n"),
+		ChopLongLines: true,
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	meno, err := NewMeno(config, screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		meno.Run()
+		wg.Done()
+	}()
+
+	long := strings.Repeat("a", 40) + strings.Repeat("b", 40) + strings.Repeat("c", 40) + strings.Repeat("d", 40) + "FOO" + strings.Repeat("e", 10)
+	writer.Write([]byte("abc\n" + long + "\ndef\n"))
+	writer.Close()
+
+	for _, tc := range []struct {
+		keys string
+		// Arrow keys can't be injected as bytes.
+		arrow  tcell.Key
+		arrows int
+		want   []lineMatch
+	}{
+		{"", 0, 0, []lineMatch{
+			{0, "^abc$"},
+			{1, "^a{40}b{40}$"},
+			{2, "^def$"},
+		}},
+		// Right and left scroll by half a screen.
+		{"", tcell.KeyRight, 1, []lineMatch{
+			{0, "^$"},
+			{1, "^b{40}c{40}$"},
+			{2, "^$"},
+		}},
+		{"", tcell.KeyRight, 2, []lineMatch{
+			{1, "^d{40}FOOe{10}$"},
+		}},
+		{"", tcell.KeyLeft, 4, []lineMatch{
+			{0, "^abc$"},
+			{1, "^a{40}b{40}$"},
+		}},
+		// The view scrolls to a match.
+		{"/FOO\r", 0, 0, []lineMatch{
+			{0, "^$"},
+			{1, "^FOOe{10}$"},
+		}},
+		{"-S", 0, 0, []lineMatch{
+			{0, "^abc$"},
+			{1, "^a{40}b{40}$"},
+			{2, "^c{40}d{40}$"},
+			{3, "^FOOe{10}$"},
+		}},
+	} {
+		screen.InjectKeyBytes([]byte(tc.keys))
+		for i := 0; i < tc.arrows; i++ {
+			screen.InjectKey(tc.arrow, 0, tcell.ModNone)
+		}
+		assertScreen(t, screen, tc.want)
+	}
+
+	screen.InjectKeyBytes([]byte("q"))
+	wg.Wait()
+}
+
+func TestSearchRequestFor(t *testing.T) {
+	for _, tc := range []struct {
+		input     string
+		smartCase bool
+		want      wrapper.SearchRequest
+	}{
+		{"error", true, wrapper.SearchRequest{Query: "error", IgnoreCase: true}},
+		{"Error", true, wrapper.SearchRequest{Query: "Error"}},
+		{"error", false, wrapper.SearchRequest{Query: "error"}},
+		{"re:id=[0-9]+", true, wrapper.SearchRequest{Query: "id=[0-9]+", Regexp: true, IgnoreCase: true}},
+		{"re:\\S+", true, wrapper.SearchRequest{Query: "\\S+", Regexp: true, IgnoreCase: true}},
+		{"re:\\bErr\\W", true, wrapper.SearchRequest{Query: "\\bErr\\W", Regexp: true}},
+		{"re:a\\\\S", true, wrapper.SearchRequest{Query: "a\\\\S", Regexp: true}},
+		{"\\S", true, wrapper.SearchRequest{Query: "\\S"}},
+	} {
+		if got := searchRequestFor(tc.input, tc.smartCase, false); got != tc.want {
+			t.Errorf("searchRequestFor(%q, %v): got %v, want %v", tc.input, tc.smartCase, got, tc.want)
+		}
+	}
+}
+
+func TestSearchRequestForHex(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  wrapper.SearchRequest
+	}{
+		{"de ad be ef", wrapper.SearchRequest{Query: "\xde\xad\xbe\xef"}},
+		{"00FF", wrapper.SearchRequest{Query: "\x00\xff"}},
+		// Anything else is searched for as text.
+		{"dead beef!", wrapper.SearchRequest{Query: "dead beef!", IgnoreCase: true}},
+		{"abc", wrapper.SearchRequest{Query: "abc", IgnoreCase: true}},
+		{"re:ab+", wrapper.SearchRequest{Query: "ab+", Regexp: true, IgnoreCase: true}},
+	} {
+		if got := searchRequestFor(tc.input, true, true); got != tc.want {
+			t.Errorf("searchRequestFor(%q, true, true): got %v, want %v", tc.input, got, tc.want)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package trigram
 
-import "strings"
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
 
 // How many null characters to capture in trigram conversion.
 // Either 0, 1, or 2. For example, with 2, "a" would yield ("__a", "_a_", "a__").
@@ -32,6 +36,31 @@ func (t Trigram) LargestRune() rune {
 	return ret
 }
 
+// Fold returns the trigram with each rune case folded (see FoldRune).
+func (t Trigram) Fold() Trigram {
+	r := t.Runes()
+	return Trigram(uint64(FoldRune(r[0]))<<42 | uint64(FoldRune(r[1]))<<21 | uint64(FoldRune(r[2])))
+}
+
+// FoldRune returns a canonical rune for all the runes which are equivalent
+// under Unicode simple case folding. This is the smallest of them, except that
+// ASCII letters are lower case. For example, 'A' and 'a' fold to 'a', and the
+// Kelvin sign (U+212A) folds to 'k'.
+func FoldRune(r rune) rune {
+	min := r
+	if r >= 0x80 {
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+	}
+	if 'A' <= min && min <= 'Z' {
+		min += 'a' - 'A'
+	}
+	return min
+}
+
 func FromTrigrams(in []Trigram) string {
 	var b strings.Builder
 	last := len(in) - 1 - IncludeNulls
@@ -55,7 +84,10 @@ func ToTrigram(str string) []Trigram {
 	for _, r := range str {
 		runes = append(runes, r)
 	}
+	return trigrams(runes)
+}
 
+func trigrams(runes []rune) []Trigram {
 	var result []Trigram
 	// The first will be "\x00{first 2 chars}" and the last will be
 	// "{last 2 chars}\x00".
@@ -72,3 +104,38 @@ func ToTrigram(str string) []Trigram {
 
 	return result
 }
+
+// binaryRuneBase is added to each byte that isn't ASCII to make a rune of it
+// in ToBinaryTrigram. It's past unicode.MaxRune, so those runes are never the
+// runes of text.
+const binaryRuneBase = 0x110000
+
+// ToBinaryTrigram is like ToTrigram, but for the bytes of the string rather
+// than its runes: each byte that isn't ASCII is a rune of its own. A byte is
+// the same byte whatever is around it, unlike the rune it's decoded as, so the
+// trigrams of binary data (which may not be valid UTF-8, or may start or end
+// in the middle of a rune) are in every string that contains it.
+func ToBinaryTrigram(str string) []Trigram {
+	if len(str) == 0 {
+		return nil
+	}
+
+	runes := make([]rune, len(str))
+	for i := 0; i < len(str); i++ {
+		runes[i] = binaryRune(str[i])
+	}
+	return trigrams(runes)
+}
+
+func binaryRune(b byte) rune {
+	if b < utf8.RuneSelf {
+		return rune(b)
+	}
+	return binaryRuneBase + rune(b)
+}
+
+// IsBinary returns true if the trigram has a rune of ToBinaryTrigram for a
+// byte that isn't ASCII.
+func (t Trigram) IsBinary() bool {
+	return t.LargestRune() >= binaryRuneBase
+}
@@ -1,6 +1,7 @@
 package trigram
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -17,3 +18,48 @@ func TestToTrigram(t *testing.T) {
 		}
 	}
 }
+
+func TestFoldRune(t *testing.T) {
+	for _, test := range []struct {
+		input, want rune
+	}{
+		{'a', 'a'},
+		{'A', 'a'},
+		{'1', '1'},
+		{'K', 'k'},
+		{'\u212A', 'k'}, // Kelvin sign
+		{'ſ', 's'},
+		{'Σ', 'Σ'},
+		{'σ', 'Σ'},
+		{'ς', 'Σ'},
+	} {
+		if got := FoldRune(test.input); got != test.want {
+			t.Errorf("FoldRune(%q): got %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestToBinaryTrigram(t *testing.T) {
+	for _, test := range []struct {
+		input      string
+		wantBinary []bool
+	}{
+		{"abc", []bool{false}},
+		{"ab\xde\xad", []bool{true, true}},
+		// The bytes of a rune.
+		{"\xe6\x97\xa5", []bool{true}},
+		{"", nil},
+	} {
+		var got []bool
+		for _, tg := range ToBinaryTrigram(test.input) {
+			got = append(got, tg.IsBinary())
+		}
+		if !reflect.DeepEqual(got, test.wantBinary) {
+			t.Errorf("ToBinaryTrigram(%q): got binary %v, want %v", test.input, got, test.wantBinary)
+		}
+	}
+	// A byte is the same whatever is around it.
+	if got, want := ToBinaryTrigram("\xde\xad\xbe\xef")[1], ToBinaryTrigram("\xad\xbe\xef")[0]; got != want {
+		t.Errorf("ToBinaryTrigram(): got %v, want %v", got, want)
+	}
+}
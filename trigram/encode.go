@@ -0,0 +1,89 @@
+package trigram
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Encode writes the index to w in a compact binary form which DecodeIndex()
+// reads back. The posting lists are written as they are in memory.
+func (idx *Index) Encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, binary.MaxVarintLen64)
+	put := func(v uint64) {
+		n := binary.PutUvarint(buf, v)
+		bw.Write(buf[:n])
+	}
+
+	put(idx.nextID)
+	put(idx.maxID)
+	put(idx.docsAdded)
+
+	tgs := make([]Trigram, 0, len(idx.grams))
+	for tg := range idx.grams {
+		tgs = append(tgs, tg)
+	}
+	sort.Slice(tgs, func(i, j int) bool { return tgs[i] < tgs[j] })
+
+	put(uint64(len(tgs)))
+	for _, tg := range tgs {
+		tgData := idx.grams[tg]
+		put(uint64(tg))
+		put(uint64(tgData.count))
+		put(tgData.last)
+		put(uint64(len(tgData.buf)))
+		bw.Write(tgData.buf)
+	}
+	return bw.Flush()
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// DecodeIndex reads an index written by Encode(). If r isn't an
+// io.ByteReader, it may read past the end of the index.
+func DecodeIndex(r io.Reader) (*Index, error) {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	var err error
+	get := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		var v uint64
+		v, err = binary.ReadUvarint(br)
+		return v
+	}
+
+	idx := NewIndex()
+	idx.nextID = get()
+	idx.maxID = get()
+	idx.docsAdded = get()
+
+	count := get()
+	for i := uint64(0); i < count && err == nil; i++ {
+		tg := Trigram(get())
+		tgData := &TrigramData{
+			count: int(get()),
+			last:  get(),
+		}
+		size := get()
+		if err != nil {
+			break
+		}
+		tgData.buf = make([]byte, size)
+		_, err = io.ReadFull(br, tgData.buf)
+		idx.grams[tg] = tgData
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode index: %w", err)
+	}
+	return idx, nil
+}
@@ -0,0 +1,38 @@
+package trigram
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	idx := NewIndex()
+	for _, doc := range []string{"Eric Waters", "Eric Ward", "Abc Wyx"} {
+		idx.Add(doc)
+	}
+	idx.AddWithID("Water", 10)
+
+	var buf bytes.Buffer
+	if err := idx.Encode(&buf); err != nil {
+		t.Fatalf("Encode(): %v", err)
+	}
+	got, err := DecodeIndex(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeIndex(): %v", err)
+	}
+
+	for _, query := range []string{"Eric Wa", "c W", "ater", "xyz"} {
+		if got, want := got.Query(query), idx.Query(query); !reflect.DeepEqual(got, want) {
+			t.Errorf("Query(%q): got %v, want %v", query, got, want)
+		}
+	}
+	if got, want := got.Add("Next"), uint64(3); got != want {
+		t.Errorf("Add() after decoding: got ID %d, want %d", got, want)
+	}
+
+	// A truncated index is an error.
+	if _, err := DecodeIndex(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Errorf("DecodeIndex() of a truncated index: got no error")
+	}
+}
@@ -2,6 +2,7 @@ package trigram
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"sort"
 	"time"
@@ -126,61 +127,162 @@ func (qr QueryResult) String() string {
 	return fmt.Sprintf("doc: %d score %d", qr.DocID, qr.Score)
 }
 
+// TrigramData is the posting list of a trigram: the IDs of the docs that
+// contain it. They're kept sorted and stored as varint encoded deltas, which
+// is usually a byte per doc for a trigram in many docs.
 type TrigramData struct {
-	docs map[uint64]bool
+	buf   []byte
+	count int
+	last  uint64
 }
 
 func (d *TrigramData) String() string {
 	var b bytes.Buffer
 	fmt.Fprintf(&b, "size: %d", d.Size())
-	fmt.Fprintf(&b, "docs: [")
-	i := 0
-	for doc := range d.docs {
-		if i > 0 {
-			b.WriteString(", ")
-		}
-		fmt.Fprintf(&b, "%d", doc)
-	}
+	fmt.Fprintf(&b, " docs: %v", d.Docs())
 	return b.String()
 }
 
 func NewTrigramData() *TrigramData {
-	return &TrigramData{
-		docs: make(map[uint64]bool),
+	return &TrigramData{}
+}
+
+// newTrigramDataFrom returns a posting list of the sorted, unique IDs.
+func newTrigramDataFrom(ids []uint64) *TrigramData {
+	d := NewTrigramData()
+	for _, id := range ids {
+		d.Add(id)
 	}
+	return d
 }
 
-func (d *TrigramData) Size() int { return len(d.docs) }
+func (d *TrigramData) Size() int { return d.count }
 
 func (d *TrigramData) Add(id uint64) {
-	d.docs[id] = true
+	if d.count > 0 && id <= d.last {
+		if id == d.last {
+			return
+		}
+		// This is rare, so we don't mind building the list again.
+		*d = *newTrigramDataFrom(union(d.Docs(), []uint64{id}))
+		return
+	}
+	d.buf = binary.AppendUvarint(d.buf, id-d.last)
+	d.last = id
+	d.count++
 }
 
 func (d *TrigramData) AddFrom(rhs *TrigramData) {
-	for id := range rhs.docs {
-		d.docs[id] = true
+	if d.count == 0 || rhs.count == 0 {
+		d.AddAll(rhs.Docs())
+		return
+	}
+	*d = *newTrigramDataFrom(union(d.Docs(), rhs.Docs()))
+}
+
+// AddAll adds the sorted IDs.
+func (d *TrigramData) AddAll(ids []uint64) {
+	for _, id := range ids {
+		d.Add(id)
 	}
 }
 
+// each calls fn with each ID, in order, until it returns false.
+func (d *TrigramData) each(fn func(id uint64) bool) {
+	id := uint64(0)
+	for pos := 0; pos < len(d.buf); {
+		delta, n := binary.Uvarint(d.buf[pos:])
+		pos += n
+		id += delta
+		if !fn(id) {
+			return
+		}
+	}
+}
+
+// Docs returns the sorted IDs.
 func (d *TrigramData) Docs() []uint64 {
-	var result []uint64
-	for id := range d.docs {
+	result := make([]uint64, 0, d.count)
+	d.each(func(id uint64) bool {
 		result = append(result, id)
-	}
+		return true
+	})
+	return result
+}
+
+// Intersect returns the IDs from the sorted ids that are also in d.
+func (d *TrigramData) Intersect(ids []uint64) []uint64 {
+	var result []uint64
+	i := 0
+	d.each(func(id uint64) bool {
+		for i < len(ids) && ids[i] < id {
+			i++
+		}
+		if i == len(ids) {
+			return false
+		}
+		if ids[i] == id {
+			result = append(result, id)
+			i++
+		}
+		return true
+	})
 	return result
 }
 
 func (d *TrigramData) MostFrequentDocs() []QueryResult {
 	var ret []QueryResult
-	for id := range d.docs {
+	d.each(func(id uint64) bool {
 		ret = append(ret, QueryResult{
 			DocID: id,
 			Score: 1,
 		})
-	}
+		return true
+	})
 	return ret
 }
 
+// union returns the sorted IDs which are in either of the sorted a and b.
+func union(a, b []uint64) []uint64 {
+	result := make([]uint64, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			result = append(result, a[i])
+			i++
+		case a[i] > b[j]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+// intersect returns the sorted IDs which are in both of the sorted a and b.
+func intersect(a, b []uint64) []uint64 {
+	var result []uint64
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
 type Index struct {
 	nextID    uint64
 	maxID     uint64
@@ -211,12 +313,55 @@ func (idx *Index) Add(doc string) uint64 {
 	return docID
 }
 
+// AddWithID indexes the doc. The trigrams are case folded (see FoldRune) so
+// that the index can be used for case-insensitive queries; the caller is
+// expected to confirm a case-sensitive match in the docs returned from a query.
 func (idx *Index) AddWithID(doc string, docID uint64) {
 	idx.docsAdded++
 	if docID > idx.maxID {
 		idx.maxID = docID
 	}
 	for _, tg := range ToTrigram(doc) {
+		tg = tg.Fold()
+		tgData, ok := idx.grams[tg]
+		if !ok {
+			tgData = NewTrigramData()
+			idx.grams[tg] = tgData
+		}
+		tgData.Add(docID)
+	}
+}
+
+// Merge adds the docs of the other index, which may share doc IDs with this
+// one.
+func (idx *Index) Merge(other *Index) {
+	if other.nextID > idx.nextID {
+		idx.nextID = other.nextID
+	}
+	if other.maxID > idx.maxID {
+		idx.maxID = other.maxID
+	}
+	idx.docsAdded += other.docsAdded
+	for tg, otherData := range other.grams {
+		tgData, ok := idx.grams[tg]
+		if !ok {
+			tgData = NewTrigramData()
+			idx.grams[tg] = tgData
+		}
+		tgData.AddFrom(otherData)
+	}
+}
+
+// AddBinaryWithID indexes the trigrams of the bytes of the doc (see
+// ToBinaryTrigram), so that QueryBinary() finds it. Only the ones with a byte
+// that isn't ASCII are added: the others are added by AddWithID(), which must
+// be called for the doc too.
+func (idx *Index) AddBinaryWithID(doc string, docID uint64) {
+	for _, tg := range ToBinaryTrigram(doc) {
+		if !tg.IsBinary() {
+			continue
+		}
+		tg = tg.Fold()
 		tgData, ok := idx.grams[tg]
 		if !ok {
 			tgData = NewTrigramData()
@@ -227,35 +372,204 @@ func (idx *Index) AddWithID(doc string, docID uint64) {
 }
 
 func (idx *Index) Query(doc string) []QueryResult {
-	tgs := ToTrigram(doc)
+	return idx.query(doc, ToTrigram(doc))
+}
+
+// QueryBinary is like Query, but for the bytes of the doc (see
+// AddBinaryWithID), which may be binary data that isn't valid UTF-8.
+func (idx *Index) QueryBinary(doc string) []QueryResult {
+	return idx.query(doc, ToBinaryTrigram(doc))
+}
 
-	docScore := make(map[uint64]int)
+func (idx *Index) query(doc string, tgs []Trigram) []QueryResult {
+	var lists []*TrigramData
 	for _, tg := range tgs {
-		tgData, ok := idx.grams[tg]
+		tgData, ok := idx.grams[tg.Fold()]
 		if !ok {
 			glog.V(1).Infof("Trigram %v was not found in the index, so %q cannot be in it", tg, doc)
 			return nil
 		}
-		for _, docID := range tgData.Docs() {
-			docScore[docID]++
+		lists = append(lists, tgData)
+	}
+
+	var result []QueryResult
+	for _, docID := range intersectAll(lists) {
+		result = append(result, QueryResult{
+			DocID: docID,
+			Score: 1,
+		})
+	}
+
+	glog.Infof("Query %q (%v) may be in %d indexed docs (out of %d)", doc, tgs, len(result), idx.docsAdded)
+	return result
+}
+
+// intersectAll returns the sorted IDs which are in all the lists. The
+// shortest list is decoded and then narrowed down by the others.
+func intersectAll(lists []*TrigramData) []uint64 {
+	if len(lists) == 0 {
+		return nil
+	}
+	sort.Slice(lists, func(i, j int) bool { return lists[i].Size() < lists[j].Size() })
+	ids := lists[0].Docs()
+	for _, list := range lists[1:] {
+		if len(ids) == 0 {
+			break
 		}
+		ids = list.Intersect(ids)
 	}
+	return ids
+}
 
+// QueryPlan returns the documents which satisfy the plan (see RegexpQuery()).
+// It assumes that document IDs are contiguous from 0, which is the case when
+// using Add().
+func (idx *Index) QueryPlan(plan *QueryPlan) []QueryResult {
 	var result []QueryResult
-	for docID, score := range docScore {
-		if score == len(tgs) {
-			result = append(result, QueryResult{
-				DocID: docID,
-				Score: 1,
-			})
+	for _, docID := range idx.evaluate(plan) {
+		result = append(result, QueryResult{
+			DocID: docID,
+			Score: 1,
+		})
+	}
+
+	glog.Infof("Query plan %v may be in %d indexed docs (out of %d)", plan, len(result), idx.docsAdded)
+	return result
+}
+
+// evaluate returns the sorted IDs of the documents which satisfy the plan.
+func (idx *Index) evaluate(plan *QueryPlan) []uint64 {
+	switch plan.Op {
+	case QNone:
+		return nil
+	case QAll:
+		if idx.docsAdded == 0 {
+			return nil
 		}
+		docs := make([]uint64, 0, idx.maxID+1)
+		for id := uint64(0); id <= idx.maxID; id++ {
+			docs = append(docs, id)
+		}
+		return docs
 	}
 
-	sort.SliceStable(result, func(i, j int) bool {
-		return result[i].DocID < result[j].DocID
-	})
+	if plan.Op == QAnd {
+		var lists []*TrigramData
+		for _, tg := range plan.Trigrams {
+			tgData, ok := idx.grams[tg]
+			if !ok {
+				return nil
+			}
+			lists = append(lists, tgData)
+		}
+		var result []uint64
+		if len(lists) > 0 {
+			result = intersectAll(lists)
+		}
+		for i, sub := range plan.Sub {
+			docs := idx.evaluate(sub)
+			if i == 0 && len(lists) == 0 {
+				result = docs
+			} else {
+				result = intersect(result, docs)
+			}
+			if len(result) == 0 {
+				return nil
+			}
+		}
+		return result
+	}
 
-	glog.Infof("Query %q (%v) may be in %d indexed docs (out of %d)", doc, tgs, len(result), idx.docsAdded)
+	var result []uint64
+	for _, tg := range plan.Trigrams {
+		if tgData, ok := idx.grams[tg]; ok {
+			result = union(result, tgData.Docs())
+		}
+	}
+	for _, sub := range plan.Sub {
+		result = union(result, idx.evaluate(sub))
+	}
+	return result
+}
+
+// Docs returns the sorted IDs of the documents with the trigram.
+func (idx *Index) Docs(tg Trigram) []uint64 {
+	if tgData, ok := idx.grams[tg]; ok {
+		return tgData.Docs()
+	}
+	return nil
+}
+
+// QueryPlanSpans is like QueryPlan, but for matches that may go on from the
+// document they start in into the ones after it (like a line that's split
+// across documents). A match that starts in a document can only reach as far
+// as the documents that first(id) is at most that document for, so the
+// trigrams of document id count for the documents from first(id) to id.
+// docs returns the IDs of the documents with the trigram (in any order), and
+// the IDs returned are less than n.
+func QueryPlanSpans(plan *QueryPlan, n int, docs func(tg Trigram) []uint64, first func(id int) int) []uint64 {
+	var result []uint64
+	for id, ok := range evaluateSpans(plan, n, docs, first) {
+		if ok {
+			result = append(result, uint64(id))
+		}
+	}
+	return result
+}
+
+// evaluateSpans returns whether each of the n documents satisfies the plan
+// (see QueryPlanSpans).
+func evaluateSpans(plan *QueryPlan, n int, docs func(tg Trigram) []uint64, first func(id int) int) []bool {
+	switch plan.Op {
+	case QNone:
+		return make([]bool, n)
+	case QAll:
+		result := make([]bool, n)
+		for i := range result {
+			result[i] = true
+		}
+		return result
+	}
+
+	var result []bool
+	combine := func(set []bool) {
+		if result == nil {
+			result = set
+			return
+		}
+		for i := range result {
+			if plan.Op == QAnd {
+				result[i] = result[i] && set[i]
+			} else {
+				result[i] = result[i] || set[i]
+			}
+		}
+	}
+	for _, tg := range plan.Trigrams {
+		// How many documents with the trigram each document reaches, by
+		// adding one at first(id) and taking it away after id.
+		counts := make([]int, n+1)
+		for _, id := range docs(tg) {
+			if id >= uint64(n) {
+				continue
+			}
+			counts[first(int(id))]++
+			counts[id+1]--
+		}
+		set := make([]bool, n)
+		reached := 0
+		for i := range set {
+			reached += counts[i]
+			set[i] = reached > 0
+		}
+		combine(set)
+	}
+	for _, sub := range plan.Sub {
+		combine(evaluateSpans(sub, n, docs, first))
+	}
+	if result == nil {
+		return make([]bool, n)
+	}
 	return result
 }
 
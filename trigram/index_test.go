@@ -1,6 +1,7 @@
 package trigram
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -42,6 +43,36 @@ func TestAdd(t *testing.T) {
 	}
 }
 
+func TestQueryBinary(t *testing.T) {
+	idx := NewIndex()
+	data := []string{"\x00\xde\xad\xbe\xef", "Caf\xc3\xa9 \xe6\x97\xa5", "abc"}
+	for _, str := range data {
+		id := idx.Add(str)
+		idx.AddBinaryWithID(str, id)
+	}
+
+	for _, test := range []struct {
+		input  string
+		expect []string
+	}{
+		{"\xad\xbe\xef", data[:1]},
+		{"\xde\xad\xbe\xee", nil},
+		{"\xe6\x97\xa5", data[1:2]},
+		{"CAF\xc3", data[1:2]},
+		// Only the ASCII letters are case folded.
+		{"f\xc3\x89", nil},
+		{"abc", data[2:]},
+	} {
+		var got []string
+		for _, result := range idx.QueryBinary(test.input) {
+			got = append(got, data[result.DocID])
+		}
+		if strings.Join(got, ":") != strings.Join(test.expect, ":") {
+			t.Errorf("QueryBinary(%q) got %q, wanted %q", test.input, got, test.expect)
+		}
+	}
+}
+
 func TestSortedMaxResults(t *testing.T) {
 	const max = 10
 	s := NewSortedMaxResults(10)
@@ -70,6 +101,62 @@ func TestSortedMaxResults(t *testing.T) {
 }
 
 func TestTrigramData(t *testing.T) {
-	//td := NewTrigramData()
+	td := NewTrigramData()
+	for _, id := range []uint64{1, 5, 5, 300, 2, 1} {
+		td.Add(id)
+	}
+	if got, want := td.Docs(), []uint64{1, 2, 5, 300}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Docs(): got %v, want %v", got, want)
+	}
+	if got, want := td.Size(), 4; got != want {
+		t.Errorf("Size(): got %d, want %d", got, want)
+	}
+
+	td.AddFrom(newTrigramDataFrom([]uint64{0, 5, 400}))
+	if got, want := td.Docs(), []uint64{0, 1, 2, 5, 300, 400}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Docs() after AddFrom(): got %v, want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		ids, want []uint64
+	}{
+		{nil, nil},
+		{[]uint64{3, 4}, nil},
+		{[]uint64{0, 3, 300, 500}, []uint64{0, 300}},
+		{[]uint64{400}, []uint64{400}},
+	} {
+		if got := td.Intersect(tc.ids); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Intersect(%v): got %v, want %v", tc.ids, got, tc.want)
+		}
+	}
+}
 
+func TestUnionIntersect(t *testing.T) {
+	a, b := []uint64{1, 3, 5, 7}, []uint64{2, 3, 7, 8}
+	if got, want := union(a, b), []uint64{1, 2, 3, 5, 7, 8}; !reflect.DeepEqual(got, want) {
+		t.Errorf("union(): got %v, want %v", got, want)
+	}
+	if got, want := intersect(a, b), []uint64{3, 7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("intersect(): got %v, want %v", got, want)
+	}
+	lists := []*TrigramData{newTrigramDataFrom(a), newTrigramDataFrom(b), newTrigramDataFrom([]uint64{7})}
+	if got, want := intersectAll(lists), []uint64{7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("intersectAll(): got %v, want %v", got, want)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := NewIndex(), NewIndex()
+	a.AddWithID("Eric Waters", 0)
+	b.AddWithID("Eric Ward", 1)
+	a.AddWithID("Abc Wyx", 2)
+	a.Merge(b)
+
+	var got []uint64
+	for _, result := range a.Query("Eric W") {
+		got = append(got, result.DocID)
+	}
+	if want := []uint64{0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Query() after Merge(): got %v, want %v", got, want)
+	}
 }
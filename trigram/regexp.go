@@ -0,0 +1,473 @@
+package trigram
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// The regular expression analysis below is a simplified version of the one
+// described in https://swtch.com/~rsc/regexp/regexp4.html. A regular expression
+// is reduced to a QueryPlan of trigrams that any matching text must contain.
+//
+// Since the index is case folded, every string in the analysis is case folded
+// as well, and so case-insensitive expressions need no special handling.
+
+// QueryOp is the operation of a QueryPlan node.
+type QueryOp int
+
+const (
+	// QAll matches every document.
+	QAll QueryOp = iota
+	// QNone matches no document.
+	QNone
+	// QAnd matches documents containing all of the trigrams and subqueries.
+	QAnd
+	// QOr matches documents containing any of the trigrams or subqueries.
+	QOr
+)
+
+// A QueryPlan is a boolean combination of trigrams which must be present in a
+// document for it to possibly match.
+type QueryPlan struct {
+	Op       QueryOp
+	Trigrams []Trigram
+	Sub      []*QueryPlan
+}
+
+var (
+	allPlan  = &QueryPlan{Op: QAll}
+	nonePlan = &QueryPlan{Op: QNone}
+)
+
+func (q *QueryPlan) String() string {
+	switch q.Op {
+	case QAll:
+		return "+"
+	case QNone:
+		return "-"
+	}
+	var parts []string
+	for _, tg := range q.Trigrams {
+		parts = append(parts, fmt.Sprintf("%q", tg.String()))
+	}
+	for _, sub := range q.Sub {
+		parts = append(parts, "("+sub.String()+")")
+	}
+	sep := " "
+	if q.Op == QOr {
+		sep = "|"
+	}
+	return strings.Join(parts, sep)
+}
+
+func (q *QueryPlan) and(r *QueryPlan) *QueryPlan { return q.andOr(r, QAnd) }
+func (q *QueryPlan) or(r *QueryPlan) *QueryPlan  { return q.andOr(r, QOr) }
+
+func (q *QueryPlan) andOr(r *QueryPlan, op QueryOp) *QueryPlan {
+	// The identity and the absorbing element for `op`.
+	identity, absorb := QAll, QNone
+	if op == QOr {
+		identity, absorb = QNone, QAll
+	}
+	if q.Op == absorb || r.Op == identity {
+		return q
+	}
+	if r.Op == absorb || q.Op == identity {
+		return r
+	}
+	if isTrigramsOnly(q, op) && isTrigramsOnly(r, op) {
+		return &QueryPlan{Op: op, Trigrams: mergeTrigrams(q.Trigrams, r.Trigrams)}
+	}
+	result := &QueryPlan{Op: op}
+	for _, x := range []*QueryPlan{q, r} {
+		if x.Op == op {
+			result.Trigrams = mergeTrigrams(result.Trigrams, x.Trigrams)
+			result.Sub = append(result.Sub, x.Sub...)
+		} else {
+			result.Sub = append(result.Sub, x)
+		}
+	}
+	return result
+}
+
+// isTrigramsOnly returns true if q can be flattened into a node of `op`.
+func isTrigramsOnly(q *QueryPlan, op QueryOp) bool {
+	return len(q.Sub) == 0 && (q.Op == op || len(q.Trigrams) == 1)
+}
+
+func mergeTrigrams(a, b []Trigram) []Trigram {
+	seen := make(map[Trigram]bool)
+	var result []Trigram
+	for _, list := range [][]Trigram{a, b} {
+		for _, tg := range list {
+			if !seen[tg] {
+				seen[tg] = true
+				result = append(result, tg)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// andTrigrams requires that one of the strings in `set` be present in the
+// document. If any string is shorter than a trigram, nothing is required.
+func (q *QueryPlan) andTrigrams(set stringSet) *QueryPlan {
+	if set.minLen() < 3 {
+		return q
+	}
+	// Factor out the trigrams common to every string:
+	// (A and B) or (A and C) == A and (B or C).
+	var perString [][]Trigram
+	count := make(map[Trigram]int)
+	for _, str := range set {
+		tgs := mergeTrigrams(trigramsOf(str), nil)
+		perString = append(perString, tgs)
+		for _, tg := range tgs {
+			count[tg]++
+		}
+	}
+	var common []Trigram
+	for tg, n := range count {
+		if n == len(set) {
+			common = append(common, tg)
+		}
+	}
+	or := nonePlan
+	for _, tgs := range perString {
+		var rest []Trigram
+		for _, tg := range tgs {
+			if count[tg] != len(set) {
+				rest = append(rest, tg)
+			}
+		}
+		if len(rest) == 0 {
+			// This string only requires the common trigrams.
+			or = allPlan
+			break
+		}
+		or = or.or(&QueryPlan{Op: QAnd, Trigrams: rest})
+	}
+	if len(common) > 0 {
+		q = q.and(&QueryPlan{Op: QAnd, Trigrams: mergeTrigrams(common, nil)})
+	}
+	return q.and(or)
+}
+
+// trigramsOf returns every trigram in str, without the null padding of
+// ToTrigram(). The str is expected to be case folded already.
+func trigramsOf(str string) []Trigram {
+	runes := []rune(str)
+	var result []Trigram
+	for i := 0; i+2 < len(runes); i++ {
+		result = append(result, Trigram(uint64(runes[i])<<42|uint64(runes[i+1])<<21|uint64(runes[i+2])))
+	}
+	return result
+}
+
+const (
+	// Maximum number of strings in an exact set before it is reduced to
+	// prefix and suffix sets.
+	maxExact = 7
+	// Maximum number of strings in a prefix or suffix set.
+	maxSet = 20
+	// Maximum number of runes in a character class to enumerate it.
+	maxClass = 16
+)
+
+// A stringSet is a sorted, deduplicated set of strings.
+type stringSet []string
+
+func (s stringSet) have() bool { return s != nil }
+
+func (s stringSet) minLen() int {
+	if len(s) == 0 {
+		return 0
+	}
+	min := -1
+	for _, str := range s {
+		if l := len([]rune(str)); min == -1 || l < min {
+			min = l
+		}
+	}
+	return min
+}
+
+func (s *stringSet) add(str string) { *s = append(*s, str) }
+
+func (s stringSet) clean() stringSet {
+	if len(s) == 0 {
+		return s
+	}
+	sort.Strings(s)
+	w := 1
+	for _, str := range s[1:] {
+		if str != s[w-1] {
+			s[w] = str
+			w++
+		}
+	}
+	return s[:w]
+}
+
+func (s stringSet) union(t stringSet) stringSet {
+	result := append(stringSet{}, s...)
+	return append(result, t...).clean()
+}
+
+func (s stringSet) cross(t stringSet) stringSet {
+	result := stringSet{}
+	for _, x := range s {
+		for _, y := range t {
+			result.add(x + y)
+		}
+	}
+	return result.clean()
+}
+
+// regexpInfo summarizes what is known about the strings matched by a regular
+// expression.
+type regexpInfo struct {
+	// Whether the expression can match the empty string.
+	canEmpty bool
+	// If non-nil, the exact set of strings matched.
+	exact stringSet
+	// If exact is nil, the possible prefixes and suffixes of matched strings.
+	prefix, suffix stringSet
+	// Trigrams that must be present in any match.
+	match *QueryPlan
+}
+
+// RegexpQuery returns a QueryPlan that every document matching re satisfies.
+// The regexp should be simplified (see syntax.Regexp.Simplify()).
+func RegexpQuery(re *syntax.Regexp) *QueryPlan {
+	info := analyze(re)
+	info.simplify(true)
+	info.addExact()
+	return info.match
+}
+
+func anyMatch() regexpInfo {
+	return regexpInfo{
+		canEmpty: true,
+		prefix:   stringSet{""},
+		suffix:   stringSet{""},
+		match:    allPlan,
+	}
+}
+
+func anyChar() regexpInfo {
+	return regexpInfo{
+		prefix: stringSet{""},
+		suffix: stringSet{""},
+		match:  allPlan,
+	}
+}
+
+func noMatch() regexpInfo {
+	return regexpInfo{match: nonePlan}
+}
+
+func emptyString() regexpInfo {
+	return regexpInfo{
+		canEmpty: true,
+		exact:    stringSet{""},
+		match:    allPlan,
+	}
+}
+
+func literal(runes []rune) regexpInfo {
+	var sb strings.Builder
+	for _, r := range runes {
+		sb.WriteRune(FoldRune(r))
+	}
+	return regexpInfo{
+		exact: stringSet{sb.String()},
+		match: allPlan,
+	}
+}
+
+func charClass(ranges []rune) regexpInfo {
+	if len(ranges) == 0 {
+		return noMatch()
+	}
+	var chars stringSet
+	for i := 0; i < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		if int(hi-lo)+len(chars) >= maxClass {
+			return anyChar()
+		}
+		for r := lo; r <= hi; r++ {
+			chars.add(string(FoldRune(r)))
+		}
+	}
+	return regexpInfo{exact: chars.clean(), match: allPlan}
+}
+
+func analyze(re *syntax.Regexp) regexpInfo {
+	var info regexpInfo
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return noMatch()
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine,
+		syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return emptyString()
+	case syntax.OpLiteral:
+		return literal(re.Rune)
+	case syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		return anyChar()
+	case syntax.OpCharClass:
+		return charClass(re.Rune)
+	case syntax.OpCapture:
+		return analyze(re.Sub[0])
+	case syntax.OpStar:
+		return anyMatch()
+	case syntax.OpQuest:
+		return alternate(analyze(re.Sub[0]), emptyString())
+	case syntax.OpPlus:
+		// The match is the same as the subexpression, but it may repeat so
+		// the exact set is no longer exact.
+		info = analyze(re.Sub[0])
+		if info.exact.have() {
+			info.prefix = info.exact
+			info.suffix = append(stringSet{}, info.exact...)
+			info.exact = nil
+		}
+		return info
+	case syntax.OpConcat:
+		info = emptyString()
+		for _, sub := range re.Sub {
+			info = concat(info, analyze(sub))
+		}
+		return info
+	case syntax.OpAlternate:
+		info = analyze(re.Sub[0])
+		for _, sub := range re.Sub[1:] {
+			info = alternate(info, analyze(sub))
+		}
+		return info
+	}
+	// OpRepeat should have been removed by Simplify(). Assume the worst.
+	return anyMatch()
+}
+
+func concat(x, y regexpInfo) regexpInfo {
+	var xy regexpInfo
+	xy.match = x.match.and(y.match)
+	if x.exact.have() && y.exact.have() {
+		xy.exact = x.exact.cross(y.exact)
+	} else {
+		if x.exact.have() {
+			xy.prefix = x.exact.cross(y.prefix)
+		} else {
+			xy.prefix = x.prefix
+			if x.canEmpty {
+				xy.prefix = xy.prefix.union(y.prefix)
+			}
+		}
+		if y.exact.have() {
+			xy.suffix = x.suffix.cross(y.exact)
+		} else {
+			xy.suffix = y.suffix
+			if y.canEmpty {
+				xy.suffix = xy.suffix.union(x.suffix)
+			}
+		}
+	}
+
+	// If every string in the cross product of x.suffix and y.prefix is long
+	// enough, one of their trigrams must be present, which may not be
+	// accounted for in xy.prefix or xy.suffix.
+	if !x.exact.have() && !y.exact.have() &&
+		len(x.suffix) <= maxSet && len(y.prefix) <= maxSet &&
+		x.suffix.minLen()+y.prefix.minLen() >= 3 {
+		xy.match = xy.match.andTrigrams(x.suffix.cross(y.prefix))
+	}
+
+	xy.canEmpty = x.canEmpty && y.canEmpty
+	xy.simplify(false)
+	return xy
+}
+
+func alternate(x, y regexpInfo) regexpInfo {
+	var xy regexpInfo
+	if x.exact.have() && y.exact.have() {
+		xy.exact = x.exact.union(y.exact)
+	} else if x.exact.have() {
+		xy.prefix = x.exact.union(y.prefix)
+		xy.suffix = x.exact.union(y.suffix)
+		x.addExact()
+	} else if y.exact.have() {
+		xy.prefix = x.prefix.union(y.exact)
+		xy.suffix = x.suffix.union(y.exact)
+		y.addExact()
+	} else {
+		xy.prefix = x.prefix.union(y.prefix)
+		xy.suffix = x.suffix.union(y.suffix)
+	}
+	xy.canEmpty = x.canEmpty || y.canEmpty
+	xy.match = x.match.or(y.match)
+	xy.simplify(false)
+	return xy
+}
+
+// addExact requires that one of the exact strings be present.
+func (info *regexpInfo) addExact() {
+	if info.exact.have() {
+		info.match = info.match.andTrigrams(info.exact)
+	}
+}
+
+// simplify reduces the exact set to prefix and suffix sets once it grows too
+// large (or if forced), and keeps the prefix and suffix sets small.
+func (info *regexpInfo) simplify(force bool) {
+	info.exact = info.exact.clean()
+	if len(info.exact) > maxExact || (force && info.exact.minLen() >= 3) {
+		info.addExact()
+		for _, str := range info.exact {
+			runes := []rune(str)
+			if n := len(runes); n < 3 {
+				info.prefix.add(str)
+				info.suffix.add(str)
+			} else {
+				info.prefix.add(string(runes[:2]))
+				info.suffix.add(string(runes[n-2:]))
+			}
+		}
+		info.exact = nil
+	}
+	if !info.exact.have() {
+		info.prefix = info.simplifySet(info.prefix, true)
+		info.suffix = info.simplifySet(info.suffix, false)
+	}
+}
+
+// simplifySet adds the set to the match and then trims each string to at most
+// two runes (or fewer to keep the set small): the part that may combine with
+// a neighbouring expression to form a trigram.
+func (info *regexpInfo) simplifySet(set stringSet, isPrefix bool) stringSet {
+	set = set.clean()
+	info.match = info.match.andTrigrams(set)
+	for n := 2; n == 2 || len(set) > maxSet; n-- {
+		result := stringSet{}
+		for _, str := range set {
+			runes := []rune(str)
+			if len(runes) > n {
+				if isPrefix {
+					runes = runes[:n]
+				} else {
+					runes = runes[len(runes)-n:]
+				}
+			}
+			result.add(string(runes))
+		}
+		set = result.clean()
+		if n == 0 {
+			break
+		}
+	}
+	return set
+}
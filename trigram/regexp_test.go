@@ -0,0 +1,107 @@
+package trigram
+
+import (
+	"reflect"
+	"regexp/syntax"
+	"strings"
+	"testing"
+)
+
+func regexpQuery(t *testing.T, expr string) *QueryPlan {
+	t.Helper()
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", expr, err)
+	}
+	return RegexpQuery(re.Simplify())
+}
+
+func TestRegexpQuery(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		want string
+	}{
+		{`abc`, `"abc"`},
+		{`abcd`, `"abc" "bcd"`},
+		{`a.c`, `+`},
+		{`ab`, `+`},
+		{`abc|def`, `"abc"|"def"`},
+		{`abc.*def`, `"abc" "def"`},
+		{`(abc|xyz)123`, `"123" (("abc" "bc1" "c12")|("xyz" "yz1" "z12"))`},
+		{`req_id=[0-9a-f]{8}`, `"_id" "eq_" "id=" "q_i" "req" ("d=0"|"d=1"|"d=2"|"d=3"|"d=4"|"d=5"|"d=6"|"d=7"|"d=8"|"d=9"|"d=a"|"d=b"|"d=c"|"d=d"|"d=e"|"d=f")`},
+		{`[ab]cd`, `"acd"|"bcd"`},
+		{`abc?`, `+`},
+		{`a+bcd`, `"abc" "bcd"`},
+		{`ABC`, `"abc"`},
+		{`(?i)aBc`, `"abc"`},
+		{`[aA]bc`, `"abc"`},
+	} {
+		got := regexpQuery(t, tc.expr).String()
+		if got != tc.want {
+			t.Errorf("RegexpQuery(%q): got %s, want %s", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestQueryPlan(t *testing.T) {
+	idx := NewIndex()
+	data := []string{"req_id=deadbeef", "req_id=missing", "error: abc", "warn: xyz"}
+	for _, str := range data {
+		idx.Add(str)
+	}
+
+	for _, tc := range []struct {
+		expr   string
+		expect []string
+	}{
+		{`req_id=[0-9a-f]{8}`, []string{"req_id=deadbeef"}},
+		{`req_id=`, []string{"req_id=deadbeef", "req_id=missing"}},
+		{`(error|warn): `, []string{"error: abc", "warn: xyz"}},
+		{`abc|xyz`, []string{"error: abc", "warn: xyz"}},
+		{`not present`, nil},
+		{`.`, data},
+		{`(?i)ERROR`, []string{"error: abc"}},
+	} {
+		var got []string
+		for _, result := range idx.QueryPlan(regexpQuery(t, tc.expr)) {
+			got = append(got, data[result.DocID])
+		}
+		if strings.Join(got, ":") != strings.Join(tc.expect, ":") {
+			t.Errorf("QueryPlan(%q) got %v, wanted %v", tc.expr, got, tc.expect)
+		}
+	}
+}
+
+func TestQueryPlanSpans(t *testing.T) {
+	idx := NewIndex()
+	// A line split across the first three documents, and another one in the
+	// last. Like the blocks of a Reader, each document has the first bytes of
+	// the next one too.
+	data := []string{"start req_id", "id=deadbe", "beef end\nre", "req_id=x\n"}
+	for _, str := range data {
+		idx.Add(str)
+	}
+	// The line in progress at the start of each document began in this one.
+	firsts := []int{0, 0, 0, 3}
+	first := func(id int) int { return firsts[id] }
+
+	for _, tc := range []struct {
+		expr string
+		want []uint64
+	}{
+		{`req_id=[0-9a-f]{8}`, []uint64{0}},
+		{`start.*end`, []uint64{0}},
+		{`dead|id=x`, []uint64{0, 1, 3}},
+		{`not present`, nil},
+		{`.`, []uint64{0, 1, 2, 3}},
+	} {
+		got := QueryPlanSpans(regexpQuery(t, tc.expr), len(data), idx.Docs, first)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("QueryPlanSpans(%q): got %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+	// No document on its own has all the trigrams.
+	if got := idx.QueryPlan(regexpQuery(t, `start.*end`)); len(got) != 0 {
+		t.Errorf("QueryPlan(`start.*end`): got %v, want none", got)
+	}
+}
@@ -0,0 +1,216 @@
+package wrapper
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ewaters/meno/ansi"
+	"github.com/rivo/uniseg"
+)
+
+// A Cell is a grapheme cluster of a line (one or more runes which are shown as
+// one character, like "e" followed by a combining accent), along with the
+// number of columns it takes on screen.
+type Cell struct {
+	// The offset of the cluster in the line, in bytes.
+	Offset int
+	Text   string
+	// Usually 1, but 2 for wide characters (like CJK and emoji), 0 for
+	// escape sequences, up to the tab width for a tab and the length of Shown
+	// if it's set.
+	Width int
+	// If set, what is shown instead of Text, which can't be written to the
+	// terminal as is: caret notation (like "^M") for a control character,
+	// "<U+0085>" for one that has no caret notation (or for a combining mark
+	// that has nothing to combine with), and "<E6>" for a byte that isn't
+	// valid UTF-8.
+	Shown string
+}
+
+// The default number of columns between tab stops.
+const DefaultTabWidth = 8
+
+// How the text of lines is laid out in cells.
+type Layout struct {
+	// The number of columns between tab stops.
+	TabWidth int
+	// If true, ANSI escape sequences (see the ansi package) are each one
+	// cell, which takes no columns, and are left out of searches. The
+	// blocks.Reader should be configured with IgnoreEscapes to match.
+	Escapes bool
+	// If > 0, the input is shown as a hex dump instead of as text: each
+	// visible line is the next HexBytes bytes of the input, regardless of
+	// line separators (and the rest of the layout).
+	HexBytes int
+}
+
+// DefaultLayout is the layout of a Driver until SetLayout() is called.
+var DefaultLayout = Layout{TabWidth: DefaultTabWidth}
+
+// cell returns what is shown for the cluster (see Cell.Shown) and its width
+// (which uniseg says is `width`) at the column. A tab takes the columns up to
+// the next tab stop.
+func (l Layout) cell(cluster string, width, column int) (string, int) {
+	if cluster == "\t" && l.TabWidth > 0 {
+		return "", l.TabWidth - column%l.TabWidth
+	}
+	if shown := shownAs(cluster); shown != "" {
+		return shown, len(shown)
+	}
+	if r, _ := utf8.DecodeRuneInString(cluster); width == 0 && unicode.Is(unicode.M, r) {
+		// A combining mark with nothing to combine with (like after a
+		// control character, or in binary data) would be lost. Other
+		// clusters that take no columns, like a zero width space, a soft
+		// hyphen or a byte order mark, are meant to be invisible.
+		var sb strings.Builder
+		for _, r := range cluster {
+			fmt.Fprintf(&sb, "<U+%04X>", r)
+		}
+		return sb.String(), sb.Len()
+	}
+	return "", width
+}
+
+// shownAs returns what is shown for the cluster instead of its text (see
+// Cell.Shown), or "" if it's shown as is.
+func shownAs(cluster string) string {
+	r, size := utf8.DecodeRuneInString(cluster)
+	if r == utf8.RuneError && size <= 1 {
+		return fmt.Sprintf("<%02X>", cluster[0])
+	}
+	if !isControl(r) {
+		return ""
+	}
+	// Controls are clusters of their own, except for "\r\n".
+	var sb strings.Builder
+	for _, r := range cluster {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			sb.WriteByte('^')
+			sb.WriteRune(r ^ 0x40)
+		default:
+			fmt.Fprintf(&sb, "<U+%04X>", r)
+		}
+	}
+	return sb.String()
+}
+
+// isControl returns true if the rune can't be written to the terminal as is,
+// like a control character, or a line separator that may be taken as one.
+func isControl(r rune) bool {
+	return unicode.IsControl(r) || r == '\u2028' || r == '\u2029'
+}
+
+// Cells splits the line into the cells that it's shown in.
+func Cells(line string, layout Layout) []Cell {
+	var cells []Cell
+	offset, column := 0, 0
+	state := -1
+	for rest := line; len(rest) > 0; {
+		if n := layout.escapeLen(rest); n > 0 {
+			cells = append(cells, Cell{
+				Offset: offset,
+				Text:   rest[:n],
+			})
+			offset += n
+			rest = rest[n:]
+			state = -1
+			continue
+		}
+		var cluster string
+		var width int
+		cluster, rest, width, state = uniseg.FirstGraphemeClusterInString(rest, state)
+		var shown string
+		shown, width = layout.cell(cluster, width, column)
+		cells = append(cells, Cell{
+			Offset: offset,
+			Text:   cluster,
+			Width:  width,
+			Shown:  shown,
+		})
+		offset += len(cluster)
+		column += width
+	}
+	return cells
+}
+
+// Columns returns the number of columns the text takes on screen.
+func Columns(text string, layout Layout) int {
+	columns := 0
+	for _, cell := range Cells(text, layout) {
+		columns += cell.Width
+	}
+	return columns
+}
+
+// wrapPoint returns how many bytes of the line go on a visible line that is
+// wrapped at the width, or -1 if the line fits (with room for the line
+// separator). A grapheme cluster (or tab) is never split, and one that is wider
+// than the width gets a visible line to itself.
+//
+// If the line is partial (it continues in a block that hasn't been read yet),
+// its last cluster is not used if it may continue in the next block (like a
+// UTF-8 sequence that was cut); the line is wrapped again once more of it has
+// been read.
+func wrapPoint(line []byte, width int, layout Layout, partial bool) int {
+	fit, columns := 0, 0
+	state := -1
+	for rest := line; len(rest) > 0; {
+		if layout.Escapes {
+			if n, complete := ansi.Len(rest); n > 0 {
+				if partial && !complete {
+					return -1
+				}
+				fit += n
+				rest, state = rest[n:], -1
+				continue
+			}
+		}
+		if partial && !utf8.FullRune(rest) {
+			// A UTF-8 sequence that was cut, which would be shown as the
+			// (wider) escaped bytes of it.
+			return -1
+		}
+		cluster, next, w, newState := uniseg.FirstGraphemeCluster(rest, state)
+		_, w = layout.cell(string(cluster), w, columns)
+		if partial && len(next) == 0 && mayContinue(cluster) {
+			return -1
+		}
+		if columns+w > width {
+			if fit == 0 {
+				return len(cluster)
+			}
+			return fit
+		}
+		columns += w
+		fit += len(cluster)
+		rest, state = next, newState
+	}
+	if columns >= width {
+		return fit
+	}
+	return -1
+}
+
+// escapeLen returns the length of the escape sequence at the start of s, or 0
+// if there is none (or escape sequences aren't cells of their own).
+func (l Layout) escapeLen(s string) int {
+	if !l.Escapes {
+		return 0
+	}
+	n, _ := ansi.Len(s)
+	return n
+}
+
+// The zero width joiner, which joins the runes before and after it into one
+// cluster (like in some emoji).
+const zeroWidthJoiner = '\u200d'
+
+// mayContinue returns true if the cluster at the end of the bytes read so far
+// may continue in the bytes after it.
+func mayContinue(cluster []byte) bool {
+	r, size := utf8.DecodeLastRune(cluster)
+	return r == utf8.RuneError && size <= 1 || r == zeroWidthJoiner
+}
@@ -0,0 +1,85 @@
+package wrapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCells(t *testing.T) {
+	for _, tc := range []struct {
+		line   string
+		layout Layout
+		want   []Cell
+	}{
+		{"", DefaultLayout, nil},
+		{"ab", DefaultLayout, []Cell{{0, "a", 1, ""}, {1, "b", 1, ""}}},
+		{"日本", DefaultLayout, []Cell{{0, "日", 2, ""}, {3, "本", 2, ""}}},
+		// "e" and a combining acute accent are one cell.
+		{"e\u0301x", DefaultLayout, []Cell{{0, "e\u0301", 1, ""}, {3, "x", 1, ""}}},
+		// Control characters and bytes that aren't valid UTF-8 are shown
+		// escaped.
+		{"a\rb\x00", DefaultLayout, []Cell{{0, "a", 1, ""}, {1, "\r", 2, "^M"}, {2, "b", 1, ""}, {3, "\x00", 2, "^@"}}},
+		{"\r\n\x7f", DefaultLayout, []Cell{{0, "\r\n", 4, "^M^J"}, {2, "\x7f", 2, "^?"}}},
+		{"a\xe6\x97b", DefaultLayout, []Cell{{0, "a", 1, ""}, {1, "\xe6", 4, "<E6>"}, {2, "\x97", 4, "<97>"}, {3, "b", 1, ""}}},
+		{"\u0085\u2028", DefaultLayout, []Cell{{0, "\u0085", 8, "<U+0085>"}, {2, "\u2028", 8, "<U+2028>"}}},
+		// As is a combining mark that has nothing to combine with, which
+		// would be lost otherwise.
+		{"\x04\u07ad\u0301", DefaultLayout, []Cell{{0, "\x04", 2, "^D"}, {1, "\u07ad\u0301", 16, "<U+07AD><U+0301>"}}},
+		// But not the characters that are meant to be invisible.
+		{"\ufeffa\u200bb\u00adc", DefaultLayout, []Cell{{0, "\ufeff", 0, ""}, {3, "a", 1, ""}, {4, "\u200b", 0, ""}, {7, "b", 1, ""}, {8, "\u00ad", 0, ""}, {10, "c", 1, ""}}},
+		// A tab goes to the next tab stop.
+		{"\ta\tb", DefaultLayout, []Cell{{0, "\t", 8, ""}, {1, "a", 1, ""}, {2, "\t", 7, ""}, {3, "b", 1, ""}}},
+		{"abc\t日\t", Layout{TabWidth: 4}, []Cell{{0, "a", 1, ""}, {1, "b", 1, ""}, {2, "c", 1, ""}, {3, "\t", 1, ""}, {4, "日", 2, ""}, {7, "\t", 2, ""}}},
+		// An escape sequence is one cell that takes no columns, if enabled.
+		{"\x1b[31mab", Layout{TabWidth: 8, Escapes: true}, []Cell{{0, "\x1b[31m", 0, ""}, {5, "a", 1, ""}, {6, "b", 1, ""}}},
+		{"\x1b[31m", DefaultLayout, []Cell{{0, "\x1b", 2, "^["}, {1, "[", 1, ""}, {2, "3", 1, ""}, {3, "1", 1, ""}, {4, "m", 1, ""}}},
+	} {
+		if got := Cells(tc.line, tc.layout); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Cells(%q, %+v): got %v, want %v", tc.line, tc.layout, got, tc.want)
+		}
+	}
+}
+
+func TestWrapPoint(t *testing.T) {
+	for _, tc := range []struct {
+		line    string
+		width   int
+		partial bool
+		want    int
+	}{
+		{"abc", 5, false, -1},
+		// There must be room for the line separator.
+		{"abcde", 5, false, 5},
+		{"abcdefg", 5, false, 5},
+		{"日本語", 5, false, 6},
+		{"日本", 4, false, 6},
+		{"日本", 5, false, -1},
+		// Wider than the width, so it's on its own.
+		{"日本", 1, false, 3},
+		{"e\u0301e\u0301e\u0301", 2, false, 6},
+		// The end of a UTF-8 sequence may be in the next block.
+		{"abcd\xe6\x97", 5, true, -1},
+		// Otherwise each byte is shown as "<XX>".
+		{"abcd\xe6\x97", 5, false, 4},
+		{"ab\x00", 3, false, 2},
+		{"abcdef", 5, true, 5},
+		// So may the emoji after a zero width joiner.
+		{"abcd\U0001F468\u200d", 5, true, -1},
+		// A tab takes the columns up to the next tab stop (every 4 columns
+		// here), and isn't split.
+		{"a\tb", 6, false, -1},
+		{"a\tbc", 6, false, 4},
+		{"ab\tc", 3, false, 2},
+		{"\t\t", 6, false, 1},
+		// Escape sequences take no columns, and aren't split.
+		{"\x1b[31mabc\x1b[0m", 5, false, -1},
+		{"\x1b[31mabcdef", 5, false, 10},
+		{"ab\x1b[31", 5, true, -1},
+		{"abcde\x1b[0mf", 5, false, 9},
+	} {
+		layout := Layout{TabWidth: 4, Escapes: true}
+		if got := wrapPoint([]byte(tc.line), tc.width, layout, tc.partial); got != tc.want {
+			t.Errorf("wrapPoint(%q, %d, %v): got %d, want %d", tc.line, tc.width, tc.partial, got, tc.want)
+		}
+	}
+}
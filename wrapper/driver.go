@@ -1,11 +1,17 @@
 package wrapper
 
 import (
+	"context"
 	"fmt"
+	"regexp"
+	"regexp/syntax"
 	"strings"
 	"sync"
+	"sync/atomic"
 
+	"github.com/ewaters/meno/ansi"
 	"github.com/ewaters/meno/blocks"
+	"github.com/ewaters/meno/trigram"
 	"github.com/golang/glog"
 )
 
@@ -28,14 +34,20 @@ func (ef eventFilter) wantLine(num int) bool {
 
 // The lineWrapCall encapsulates a lineWrapper connected to a block.Reader.
 type lineWrapCall struct {
-	d       *Driver
-	width   int
-	wrapper *lineWrapper
-	quitC   chan bool
+	d *Driver
+	// The width lines are wrapped at, or 0 if they aren't.
+	width      int
+	layout     Layout
+	lineFilter LineFilter
+	wrapper    *lineWrapper
+	quitC      chan bool
 	// The doneC is passed the last block ID read from the blockeEventC (passed
 	// to run). This is to permit another lineWrapCall to backfill up to that
 	// point before resuming the read.
 	doneC chan int
+	// Closed once the lines of the blocks read before run() was called have
+	// been backfilled, so that searches see all of them.
+	backfilledC chan struct{}
 
 	lastWrapEventMu sync.Mutex
 	lastWrapEvent   *wrapEvent
@@ -53,14 +65,26 @@ func (lwc *lineWrapCall) SetLastWrapEvent(event wrapEvent) {
 	lwc.lastWrapEvent = &event
 }
 
-func (d *Driver) newLineWrapCall(width int) *lineWrapCall {
-	return &lineWrapCall{
-		d:       d,
-		width:   width,
-		wrapper: newLineWrapper(width, d.lineSep),
-		quitC:   make(chan bool),
-		doneC:   make(chan int),
+func (d *Driver) newLineWrapCall(width int) (*lineWrapCall, error) {
+	lwc := &lineWrapCall{
+		d:          d,
+		width:      width,
+		layout:     d.layout,
+		lineFilter: d.lineFilter,
+		wrapper:    newLineWrapper(width, d.layout, d.lineSep),
+		quitC:      make(chan bool),
+		doneC:      make(chan int),
+
+		backfilledC: make(chan struct{}),
+	}
+	if d.lineFilter.active() {
+		lm, err := newLineMatcher(d, d.lineFilter, d.layout)
+		if err != nil {
+			return nil, fmt.Errorf("newLineMatcher(%v): %w", d.lineFilter, err)
+		}
+		lwc.wrapper.keep = lm.keep
 	}
+	return lwc, nil
 }
 
 // run starts the lineWrapper and, if requested, backfills from the
@@ -100,6 +124,7 @@ func (lwc *lineWrapCall) run(lastID int) {
 			select {
 			case <-lwc.quitC:
 				glog.Infof("[lwc: %d] Backfill quit; aborting", lwc.width)
+				close(lwc.backfilledC)
 				close(blockC)
 				wg.Wait()
 				lwc.doneC <- lastID
@@ -107,10 +132,27 @@ func (lwc *lineWrapCall) run(lastID int) {
 			case blockC <- *block:
 			}
 		}
+		if err := lwc.wrapper.WaitForBlock(lastID); err != nil {
+			glog.Errorf("[lwc: %d] WaitForBlock(%d): %v", lwc.width, lastID, err)
+		}
 		glog.Infof("[lwc: %d] Backfill to ID %d done", lwc.width, lastID)
 	}
+	close(lwc.backfilledC)
+
+	// Set once the input was reset (see blocks.Event), after which no more
+	// blocks are read until the Driver is restarted, which is what the Event
+	// sent on eventC asks for.
+	blockEventC := lwc.d.blockEventC
+	var eventC chan Event
 
 	blockClosed := false
+	if lwc.d.ReadStatus().RemainingBytes == 0 {
+		// The input was read completely before we started, so there are no
+		// more blocks; this wraps the last line if it doesn't end with a
+		// line separator.
+		close(blockC)
+		blockClosed = true
+	}
 outer:
 	for {
 		select {
@@ -119,14 +161,25 @@ outer:
 				close(blockC)
 			}
 			break outer
-		case blockEvent := <-lwc.d.blockEventC:
+		case eventC <- Event{Reset: true}:
+			eventC = nil
+		case blockEvent := <-blockEventC:
 			glog.V(1).Infof("[lwc: %d] -> blockEventC %v", lwc.width, blockEvent)
+			lwc.d.setReadStatus(blockEvent.Status)
+			if blockEvent.Reset {
+				glog.Infof("[lwc: %d] The input was reset; waiting for Restart()", lwc.width)
+				// None of the blocks we wrapped are to be backfilled.
+				lastID = -1
+				blockEventC = nil
+				eventC = lwc.d.eventC
+				continue
+			}
 			if blockEvent.NewBlock != nil {
 				glog.V(1).Infof("[lwc: %d] <- blockC %d", lwc.width, blockEvent.NewBlock.ID)
 				blockC <- *blockEvent.NewBlock
 				lastID = blockEvent.NewBlock.ID
 			}
-			if blockEvent.Status.RemainingBytes == 0 {
+			if blockEvent.Status.RemainingBytes == 0 && !blockClosed {
 				glog.V(1).Infof("[lwc: %d] Closing blockC since no remaining bytes", lwc.width)
 				close(blockC)
 				blockClosed = true
@@ -152,8 +205,26 @@ type Driver struct {
 	wrapCall *lineWrapCall
 	filter   *eventFilter
 
+	// The width of the window, and whether long lines are chopped at the
+	// edge of it (and scrolled horizontally) instead of being wrapped.
+	width  int
+	chop   bool
+	layout Layout
+	// Which lines are shown (see SetLineFilter).
+	lineFilter LineFilter
+
 	eventC      chan Event
 	blockEventC chan blocks.Event
+	// Closed by Stop(), after which no more events are sent by searches.
+	quitC     chan struct{}
+	stoppedMu sync.Mutex
+	stopped   bool
+
+	readStatusMu sync.Mutex
+	readStatus   blocks.ReadStatus
+
+	// The ID of the last search.
+	lastSearchID atomic.Int32
 }
 
 func NewDriver(reader *blocks.Reader, lineSep []byte) (*Driver, error) {
@@ -162,12 +233,21 @@ func NewDriver(reader *blocks.Reader, lineSep []byte) (*Driver, error) {
 		reader:      reader,
 		eventC:      make(chan Event),
 		blockEventC: make(chan blocks.Event, 1),
+		quitC:       make(chan struct{}),
+		layout:      DefaultLayout,
+		// We don't know anything until the reader sends its first event.
+		readStatus: blocks.ReadStatus{RemainingBytes: -1},
 	}, nil
 }
 
 type VisibleLine struct {
 	Number int
 	Line   string
+	// The (0-based) number of the line of the input that this is part of.
+	LogicalLine int
+	// Whether this continues the logical line of the visible line before it
+	// (which was wrapped).
+	Continuation bool
 }
 
 func (vl VisibleLine) String() string { return fmt.Sprintf("[%d] %q", vl.Number, vl.Line) }
@@ -178,6 +258,14 @@ type LineOffset struct {
 
 func (lo LineOffset) String() string { return fmt.Sprintf("line: %d, offset: %d", lo.Line, lo.Offset) }
 
+// Before returns true if lo comes before other.
+func (lo LineOffset) Before(other LineOffset) bool {
+	if lo.Line != other.Line {
+		return lo.Line < other.Line
+	}
+	return lo.Offset < other.Offset
+}
+
 type LineOffsetRange struct {
 	From, To LineOffset
 }
@@ -188,34 +276,106 @@ func (lor LineOffsetRange) String() string {
 
 type SearchRequest struct {
 	Query string
+
+	// If true, Query is a regular expression (see the regexp package). The
+	// (?m) flag is always set, so ^ and $ match at line boundaries.
+	Regexp bool
+
+	// If true, letters match regardless of their case.
+	IgnoreCase bool
 }
 
 func (sr SearchRequest) String() string {
-	return fmt.Sprintf("query: %q", sr.Query)
+	var sb strings.Builder
+	if sr.Regexp {
+		fmt.Fprintf(&sb, "regexp: %q", sr.Query)
+	} else {
+		fmt.Fprintf(&sb, "query: %q", sr.Query)
+	}
+	if sr.IgnoreCase {
+		sb.WriteString(" (ignore case)")
+	}
+	return sb.String()
+}
+
+// compile returns the regexp for the request, or nil if it's a plain,
+// case-sensitive query. A case-insensitive plain query is compiled into an
+// equivalent regexp, which queries the (case folded) index the same way.
+func (sr SearchRequest) compile() (*regexp.Regexp, error) {
+	if !sr.Regexp && !sr.IgnoreCase {
+		return nil, nil
+	}
+	flags := "(?m)"
+	if sr.IgnoreCase {
+		flags = "(?mi)"
+	}
+	expr := sr.Query
+	if !sr.Regexp {
+		expr = regexp.QuoteMeta(expr)
+	}
+	re, err := regexp.Compile(flags + expr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid regexp %q: %w", sr.Query, err)
+	}
+	return re, nil
+}
+
+// Indexed returns true if the index narrows down the blocks that are read for
+// the request: a plain query must be at least minSearchLength long, and a
+// regexp must have a literal part that long, or else every block is read.
+func (sr SearchRequest) Indexed() bool {
+	if !sr.Regexp {
+		return len(sr.Query) >= minSearchLength
+	}
+	re, err := sr.compile()
+	if err != nil {
+		return false
+	}
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return false
+	}
+	return trigram.RegexpQuery(parsed.Simplify()).Op != trigram.QAll
 }
 
 type SearchStatus struct {
+	// The ID that Search() returned.
+	ID       int
 	Request  SearchRequest
 	Complete bool
-	Results  []LineOffsetRange
+	// The results found so far, in the order of the input. Later statuses of
+	// the same search only add to them.
+	Results []LineOffsetRange
+	// The number of lines of the input (not visible lines) that the results
+	// are in.
+	Lines int
+	// Why the search failed, if it did. The status is Complete, without the
+	// results.
+	Err error
 }
 
 func (ss SearchStatus) String() string {
 	var sb strings.Builder
-	fmt.Fprintf(&sb, "request { %v }", ss.Request)
+	fmt.Fprintf(&sb, "search %d request { %v }", ss.ID, ss.Request)
 	if ss.Complete {
 		sb.WriteString(" -- complete")
 	}
-	fmt.Fprintf(&sb, "; %d results", len(ss.Results))
+	fmt.Fprintf(&sb, "; %d results in %d lines", len(ss.Results), ss.Lines)
 	if len(ss.Results) > 0 {
 		fmt.Fprintf(&sb, ", first result { %v }", ss.Results[0])
 	}
+	if ss.Err != nil {
+		fmt.Fprintf(&sb, "; failed: %v", ss.Err)
+	}
 	return sb.String()
 }
 
 type Event struct {
 	Line   *VisibleLine
 	Search *SearchStatus
+	// The input was truncated or replaced (in follow mode). No more lines
+	// are wrapped until Restart() is called.
+	Reset bool
 }
 
 func (d *Driver) Events() chan Event { return d.eventC }
@@ -230,7 +390,46 @@ func (d *Driver) Stop() {
 	if d.wrapCall != nil {
 		d.wrapCall.stop()
 	}
+	d.reader.Stop()
+	close(d.quitC)
+	d.stoppedMu.Lock()
+	d.stopped = true
 	close(d.eventC)
+	d.stoppedMu.Unlock()
+}
+
+// sendEvent sends the event on eventC, unless Stop() was called or the
+// context is done (in which case it returns false). It's used by goroutines
+// which may outlive the Driver.
+func (d *Driver) sendEvent(ctx context.Context, ev Event) bool {
+	d.stoppedMu.Lock()
+	defer d.stoppedMu.Unlock()
+	if d.stopped {
+		return false
+	}
+	select {
+	case d.eventC <- ev:
+		return true
+	case <-d.quitC:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// trySendEvent is like sendEvent, but it doesn't wait for eventC to be read.
+func (d *Driver) trySendEvent(ev Event) bool {
+	d.stoppedMu.Lock()
+	defer d.stoppedMu.Unlock()
+	if d.stopped {
+		return false
+	}
+	select {
+	case d.eventC <- ev:
+		return true
+	default:
+		return false
+	}
 }
 
 func (d *Driver) closeActiveFilter() error {
@@ -247,6 +446,26 @@ func (d *Driver) closeActiveFilter() error {
 	return nil
 }
 
+// Block returns the block of the input with the ID, if it has been read.
+func (d *Driver) Block(id int) (*blocks.Block, error) {
+	return d.reader.GetBlock(id)
+}
+
+// ReadStatus returns the status of the blocks.Reader as of the last block
+// that was wrapped. RemainingBytes is 0 once the input has been read
+// completely.
+func (d *Driver) ReadStatus() blocks.ReadStatus {
+	d.readStatusMu.Lock()
+	defer d.readStatusMu.Unlock()
+	return d.readStatus
+}
+
+func (d *Driver) setReadStatus(status blocks.ReadStatus) {
+	d.readStatusMu.Lock()
+	defer d.readStatusMu.Unlock()
+	d.readStatus = status
+}
+
 func (d *Driver) TotalLines() int {
 	if d.wrapCall == nil {
 		return 0
@@ -258,6 +477,19 @@ func (d *Driver) TotalLines() int {
 	return lastWrapEvent.lines
 }
 
+// TotalLogicalLines returns the number of lines of the input (as opposed to
+// TotalLines(), the number of visible lines they're wrapped into) so far.
+func (d *Driver) TotalLogicalLines() int {
+	if d.wrapCall == nil {
+		return 0
+	}
+	lastWrapEvent := d.wrapCall.GetLastWrapEvent()
+	if lastWrapEvent == nil {
+		return 0
+	}
+	return lastWrapEvent.logicalLines
+}
+
 func (d *Driver) WatchLines(top, height int) error {
 	// Close the previous filter first.
 	if err := d.closeActiveFilter(); err != nil {
@@ -320,10 +552,68 @@ func (d *Driver) ResizeWindow(width int) error {
 	if width < 1 {
 		return fmt.Errorf("Invalid width %d", width)
 	}
-	if d.wrapCall != nil && d.wrapCall.width == width {
-		glog.Infof("ResizeWindow width %d same as before; doing nothing", width)
+	d.width = width
+	return d.rewrap()
+}
+
+// Chop sets whether each line of the input is one visible line, chopped at
+// the edge of the window, instead of being wrapped (like `less -S`). The lines
+// read so far are wrapped again without reading the input again. This will
+// cancel any active WatchLines() calls.
+func (d *Driver) Chop(chop bool) error {
+	if d.width == 0 {
+		return fmt.Errorf("Can't Chop() without ResizeWindow() being called")
+	}
+	d.chop = chop
+	return d.rewrap()
+}
+
+// SetLayout sets how the text of lines is laid out (DefaultLayout until it's
+// called). If ResizeWindow() was called, the lines read so far are wrapped
+// again, which will cancel any active WatchLines() calls.
+func (d *Driver) SetLayout(layout Layout) error {
+	if layout.TabWidth < 1 {
+		return fmt.Errorf("Invalid tab width %d", layout.TabWidth)
+	}
+	d.layout = layout
+	if d.wrapCall == nil {
+		return nil
+	}
+	return d.rewrap()
+}
+
+// SetLineFilter sets which lines of the input are shown (every line, until
+// it's called with an active filter). Lines that are hidden don't have visible
+// lines, but the visible lines of the others keep the LogicalLine of the line
+// of the input. The lines read so far are filtered again (without reading the
+// input again) and the lines read later are filtered as they're read, which
+// will cancel any active WatchLines() calls.
+func (d *Driver) SetLineFilter(filter LineFilter) error {
+	if _, err := filter.compile(); err != nil {
+		return err
+	}
+	d.lineFilter = filter
+	if d.wrapCall == nil {
 		return nil
 	}
+	return d.rewrap()
+}
+
+// rewrap replaces the lineWrapCall if the width the lines are wrapped at (or
+// the layout, or the line filter) has changed.
+func (d *Driver) rewrap() error {
+	width := d.width
+	if d.chop {
+		width = 0
+	}
+	if d.wrapCall != nil && d.wrapCall.width == width && d.wrapCall.layout == d.layout && d.wrapCall.lineFilter == d.lineFilter {
+		glog.Infof("Wrap width %d same as before; doing nothing", width)
+		return nil
+	}
+	wrapCall, err := d.newLineWrapCall(width)
+	if err != nil {
+		return err
+	}
 	d.closeActiveFilter()
 
 	backfillToID := -1
@@ -332,61 +622,254 @@ func (d *Driver) ResizeWindow(width int) error {
 		backfillToID = d.wrapCall.stop()
 	}
 
-	d.wrapCall = d.newLineWrapCall(width)
+	d.wrapCall = wrapCall
 	go d.wrapCall.run(backfillToID)
 	return nil
 }
 
-func (d *Driver) Search(req SearchRequest) error {
+// Follow puts the reader into follow mode (see blocks.Config.Follow). This
+// will cancel any active WatchLines() calls.
+func (d *Driver) Follow() error {
 	if d.wrapCall == nil {
-		return fmt.Errorf("Can't run Search without ResizeWindow() being called")
+		return fmt.Errorf("Can't Follow() without ResizeWindow() being called")
 	}
-	if l := len(req.Query); l < minSearchLength {
-		return fmt.Errorf("Query %q is shorter than min length %d", req.Query, minSearchLength)
+	// If the input was read completely, the lineWrapper has been told that
+	// there are no more blocks, so we replace it (like in ResizeWindow()).
+	wrapCall, err := d.newLineWrapCall(d.wrapCall.width)
+	if err != nil {
+		return err
 	}
+	d.closeActiveFilter()
+
+	backfillToID := d.wrapCall.stop()
+	d.reader.Follow()
+	status := d.ReadStatus()
+	status.RemainingBytes = -1
+	d.setReadStatus(status)
+
+	d.wrapCall = wrapCall
+	go d.wrapCall.run(backfillToID)
+	return nil
+}
+
+// Restart wraps the input again from its start, after an Event with Reset.
+// This will cancel any active WatchLines() calls.
+func (d *Driver) Restart() error {
+	if d.wrapCall == nil {
+		return fmt.Errorf("Can't Restart() without ResizeWindow() being called")
+	}
+	wrapCall, err := d.newLineWrapCall(d.wrapCall.width)
+	if err != nil {
+		return err
+	}
+	d.closeActiveFilter()
+
+	// The lineWrapCall stopped at the reset, so only the blocks read since
+	// (if it was replaced in between) are backfilled.
+	backfillToID := d.wrapCall.stop()
+	d.wrapCall = wrapCall
+	go d.wrapCall.run(backfillToID)
+	return nil
+}
+
+// Line returns the visible line with the number.
+func (d *Driver) Line(number int) (*VisibleLine, error) {
+	if d.wrapCall == nil {
+		return nil, fmt.Errorf("Can't get a line without ResizeWindow() being called")
+	}
+	line, err := d.wrapCall.wrapper.GetLine(number)
+	if err != nil {
+		return nil, err
+	}
+	return d.readVisibleLine(line)
+}
+
+// LogicalLine returns the number of the first visible line of the line of the
+// input with the (0-based) index (or the line of a hex dump, see
+// Layout.HexBytes).
+func (d *Driver) LogicalLine(idx int) (int, error) {
+	if d.wrapCall == nil {
+		return 0, fmt.Errorf("Can't find a line without ResizeWindow() being called")
+	}
+	if n := d.wrapCall.layout.HexBytes; n > 0 {
+		// Each line of a hex dump is the same number of bytes.
+		return d.LineAtOffset(idx * n)
+	}
+	loc, err := d.reader.GetLine(idx)
+	if err != nil {
+		return 0, err
+	}
+	return d.lineContaining(d.wrapCall, loc.Start)
+}
+
+// LineAtOffset returns the number of the visible line with the byte at the
+// offset in the input.
+func (d *Driver) LineAtOffset(offset int) (int, error) {
+	if d.wrapCall == nil {
+		return 0, fmt.Errorf("Can't find a line without ResizeWindow() being called")
+	}
+	bio, err := d.reader.GetOffset(offset)
+	if err != nil {
+		return 0, err
+	}
+	return d.lineContaining(d.wrapCall, *bio)
+}
+
+// lineContaining returns the number of the visible line with the byte at the
+// location, once its block has been wrapped.
+func (d *Driver) lineContaining(wrapCall *lineWrapCall, bio blocks.BlockIDOffset) (int, error) {
+	<-wrapCall.backfilledC
+	if err := wrapCall.wrapper.WaitForBlock(bio.BlockID); err != nil {
+		return 0, err
+	}
+	lines, err := wrapCall.wrapper.LinesInBlock(bio.BlockID)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range lines {
+		if line.loc.Contains(bio) {
+			return line.number, nil
+		}
+	}
+	if wrapCall.lineFilter.active() {
+		// The line may be hidden, so go to the next one that's shown.
+		line, err := wrapCall.wrapper.LineFrom(bio)
+		if err != nil {
+			return 0, fmt.Errorf("No line from { %v } is shown by the filter", bio)
+		}
+		return line.number, nil
+	}
+	// The last line is only wrapped once it ends (or the input does).
+	return 0, fmt.Errorf("The line at { %v } hasn't been read completely", bio)
+}
+
+// Search starts a search, and returns the ID of the SearchStatus events it
+// sends. As results are found (from the start of the input to the end), they
+// are sent in events that aren't Complete, but only if the events are read
+// right away: the results of the ones that aren't sent are in the next one.
+// The last event, which has every result, is Complete. Once the context is
+// canceled, the search stops and no more events are sent for it.
+func (d *Driver) Search(ctx context.Context, req SearchRequest) (int, error) {
+	if d.wrapCall == nil {
+		return 0, fmt.Errorf("Can't run Search without ResizeWindow() being called")
+	}
+	re, err := req.compile()
+	if err != nil {
+		return 0, err
+	}
+	if l := len(req.Query); !req.Regexp && l < minSearchLength {
+		return 0, fmt.Errorf("Query %q is shorter than min length %d", req.Query, minSearchLength)
+	}
+	id := int(d.lastSearchID.Add(1))
 	go func() {
-		d.eventC <- Event{
-			Search: &SearchStatus{
-				Request: req,
-			},
+		// The number of results in the last status that was sent.
+		sent := 0
+		progress := func(results []LineOffsetRange, lines int) {
+			if len(results) == sent || ctx.Err() != nil {
+				return
+			}
+			// The results are only ever appended to, so the status can
+			// share them.
+			if d.trySendEvent(Event{
+				Search: &SearchStatus{
+					ID:      id,
+					Request: req,
+					Results: results,
+					Lines:   lines,
+				},
+			}) {
+				sent = len(results)
+			}
 		}
-		lor, err := d.runSearch(req)
+		lor, lines, err := d.runSearch(ctx, req, re, progress)
 		if err != nil {
-			glog.Fatal(err)
+			select {
+			case <-d.quitC:
+				// The line wrapper was stopped under us.
+				return
+			default:
+			}
+			if ctx.Err() != nil {
+				glog.Infof("Search %d (%v) canceled", id, req)
+				return
+			}
+			// Like when the input was truncated (in follow mode) while
+			// searching it.
+			glog.Errorf("Search %d (%v): %v", id, req, err)
+			d.sendEvent(ctx, Event{
+				Search: &SearchStatus{
+					ID:       id,
+					Request:  req,
+					Complete: true,
+					Err:      err,
+				},
+			})
+			return
 		}
-		d.eventC <- Event{
+		d.sendEvent(ctx, Event{
 			Search: &SearchStatus{
+				ID:       id,
 				Request:  req,
 				Complete: true,
 				Results:  lor,
+				Lines:    lines,
 			},
-		}
-
+		})
 	}()
-	return nil
+	return id, nil
 }
 
-func (d *Driver) runSearch(req SearchRequest) ([]LineOffsetRange, error) {
-	blockIDs, err := d.reader.BlockIDsContaining(req.Query)
-	if err != nil {
-		return nil, err
+// runSearch finds the blocks containing the query (or matching `re`, if set)
+// and then finds the exact locations in the visible lines of those blocks. It
+// also returns how many logical lines they're in. After each block, progress
+// is called with the results so far. It stops (with the error of the context)
+// once the context is done.
+func (d *Driver) runSearch(ctx context.Context, req SearchRequest, re *regexp.Regexp, progress func([]LineOffsetRange, int)) ([]LineOffsetRange, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The blocks are found (in the order of the input) while the lines of the
+	// ones already found are searched.
+	resultC := make(chan blocks.BlockIDOffset)
+	errC := make(chan error, 1)
+	go func() {
+		if re != nil {
+			errC <- d.reader.StreamBlockIDsMatching(ctx, re, resultC)
+		} else {
+			errC <- d.reader.StreamBlockIDsContaining(ctx, req.Query, resultC)
+		}
+	}()
+
+	// After a resize, the lines are still being rewrapped.
+	wrapCall := d.wrapCall
+	select {
+	case <-wrapCall.backfilledC:
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
 	}
-	glog.Infof("runSearch(%q) Found block IDs %v", req.Query, blockIDs)
+	// A hex dump shows the escape sequences.
+	escapes := wrapCall.layout.Escapes && wrapCall.layout.HexBytes == 0
 
 	var results []LineOffsetRange
 	dedupeLor := make(map[string]bool)
-	for _, bio := range blockIDs {
+	matchedLines := make(map[int]bool)
+	for bio := range resultC {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
 		var lines []visibleLine
 		var lineNumbers []int
 		seenNumbers := make(map[int]bool)
 
 		// We only know that the block started the query; we don't know if it
 		// ended it, so we fetch the next block's lines as well.
-		// This assumes that the block size > len(req.Query)
-		for i := bio.BlockID; i <= bio.BlockID+1; i++ {
-			tmpLines, err := d.wrapCall.wrapper.LinesInBlock(bio.BlockID)
+		// This assumes that the block size > len(req.Query). A match of a
+		// regexp may go on to the end of its line, so the lines are fetched
+		// until one ends.
+		for i := bio.BlockID; ; i++ {
+			tmpLines, err := wrapCall.wrapper.LinesInBlock(i)
 			if err != nil {
-				return nil, err
+				return nil, 0, err
 			}
 			for _, line := range tmpLines {
 				if _, ok := seenNumbers[line.number]; ok {
@@ -396,15 +879,27 @@ func (d *Driver) runSearch(req SearchRequest) ([]LineOffsetRange, error) {
 				lineNumbers = append(lineNumbers, line.number)
 				seenNumbers[line.number] = true
 			}
+			if i > bio.BlockID && (re == nil || len(tmpLines) == 0 || lines[len(lines)-1].endsWithLineSep) {
+				break
+			}
 		}
 
 		vlines, err := d.readVisibleLines(lines)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
+		}
+		logicalLines := make(map[int]int)
+		for _, vl := range vlines {
+			logicalLines[vl.Number] = vl.LogicalLine
 		}
 
 		//glog.Infof("Query %q in block %d is in lines %v", req.Query, bio.BlockID, lineNumbers)
-		lors := lineOffsetRangeForQueryIn(vlines, req.Query)
+		var lors []LineOffsetRange
+		if re != nil {
+			lors = lineOffsetRangeForRegexpIn(vlines, re, escapes)
+		} else {
+			lors = lineOffsetRangeForQueryIn(vlines, req.Query, escapes)
+		}
 		for _, lor := range lors {
 			// We may see the same lor twice since we're loading the next block
 			key := lor.String()
@@ -413,10 +908,15 @@ func (d *Driver) runSearch(req SearchRequest) ([]LineOffsetRange, error) {
 			}
 			dedupeLor[key] = true
 			results = append(results, lor)
+			matchedLines[logicalLines[lor.From.Line]] = true
 		}
+		progress(results, len(matchedLines))
 		//glog.Infof("Query %q starting at { %v } is at { %v }", req.Query, bio, lor)
 	}
-	return results, nil
+	if err := <-errC; err != nil {
+		return nil, 0, err
+	}
+	return results, len(matchedLines), nil
 }
 
 func (d *Driver) readVisibleLine(line visibleLine) (*VisibleLine, error) {
@@ -425,8 +925,10 @@ func (d *Driver) readVisibleLine(line visibleLine) (*VisibleLine, error) {
 		return nil, fmt.Errorf("GetBytes(%v): %v", line, err)
 	}
 	return &VisibleLine{
-		Number: line.number,
-		Line:   string(buf),
+		Number:       line.number,
+		Line:         string(buf),
+		LogicalLine:  line.logicalLine,
+		Continuation: line.continuation,
 	}, nil
 }
 
@@ -442,21 +944,53 @@ func (d *Driver) readVisibleLines(lines []visibleLine) ([]*VisibleLine, error) {
 	return vlines, nil
 }
 
-func lineOffsetRangeForQueryIn(lines []*VisibleLine, query string) []LineOffsetRange {
+// combineLines concatenates the lines and returns the LineOffset of each byte
+// in the result. If escapes is set, the escape sequences of the lines are left
+// out (they're never split across visible lines).
+func combineLines(lines []*VisibleLine, escapes bool) (string, []LineOffset) {
 	var sb strings.Builder
 
 	// This is very much a brute force method but I'm good with that.
 	var lorPerIndex []LineOffset
 	for _, line := range lines {
-		sb.WriteString(line.Line)
-		for i := range line.Line {
+		text, offsets := line.Line, []int(nil)
+		if escapes {
+			text, offsets = ansi.Strip(text)
+		}
+		sb.WriteString(text)
+		for i := 0; i < len(text); i++ {
+			offset := i
+			if offsets != nil {
+				offset = offsets[i]
+			}
 			lorPerIndex = append(lorPerIndex, LineOffset{
 				Line:   line.Number,
-				Offset: i,
+				Offset: offset,
 			})
 		}
 	}
-	combined := sb.String()
+	return sb.String(), lorPerIndex
+}
+
+func lineOffsetRangeForRegexpIn(lines []*VisibleLine, re *regexp.Regexp, escapes bool) []LineOffsetRange {
+	combined, lorPerIndex := combineLines(lines, escapes)
+
+	var result []LineOffsetRange
+	for _, loc := range re.FindAllStringIndex(combined, -1) {
+		if loc[0] == loc[1] {
+			// Empty matches (like /^/) can't be shown.
+			continue
+		}
+		result = append(result, LineOffsetRange{
+			From: lorPerIndex[loc[0]],
+			To:   lorPerIndex[loc[1]-1],
+		})
+	}
+	return result
+}
+
+func lineOffsetRangeForQueryIn(lines []*VisibleLine, query string, escapes bool) []LineOffsetRange {
+	combined, lorPerIndex := combineLines(lines, escapes)
 	parts := strings.Split(combined, query)
 	if len(parts) == 1 {
 		return nil
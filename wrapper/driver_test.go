@@ -1,9 +1,14 @@
 package wrapper
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strings"
 	"sync"
 	"testing"
@@ -99,6 +104,38 @@ func assertNoEventsWaiting(t *testing.T, d *Driver) {
 	}
 }
 
+// waitForSearch returns the Complete status of the search with the ID, after
+// the statuses before it (which must be for the same search, and have the
+// results of the last one and more).
+func waitForSearch(t *testing.T, d *Driver, id int) *SearchStatus {
+	t.Helper()
+	var prev []LineOffsetRange
+	for event := range d.Events() {
+		status := event.Search
+		if status == nil {
+			continue
+		}
+		if status.ID != id {
+			t.Fatalf("Got status %v, want search %d", status, id)
+		}
+		if len(status.Results) < len(prev) || (len(prev) > 0 && !reflect.DeepEqual(status.Results[:len(prev)], prev)) {
+			t.Errorf("Got results %v after %v", status.Results, prev)
+		}
+		for i := 1; i < len(status.Results); i++ {
+			if status.Results[i].From.Before(status.Results[i-1].From) {
+				t.Errorf("Got results %v out of order", status.Results)
+				break
+			}
+		}
+		if status.Complete {
+			return status
+		}
+		prev = status.Results
+	}
+	t.Fatalf("Events closed before search %d was complete", id)
+	return nil
+}
+
 func assertResizeWindow(t *testing.T, d *Driver, width int) {
 	t.Helper()
 	if err := d.ResizeWindow(width); err != nil {
@@ -177,6 +214,100 @@ func TestDriver(t *testing.T) {
 	// line numbers.
 }
 
+func TestDriverLogicalLine(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	reader := newReader(t, "abcdefg\n1\n2\n3\n4\n5")
+	d, err := NewDriver(reader, []byte("\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.Run()
+	defer d.Stop()
+	assertResizeWindow(t, d, 5)
+	assertWatchedLines(t, d, 0, 10, []string{"abcde", "fg\n", "1\n", "2\n", "3\n", "4\n", "5"})
+
+	for _, tc := range []struct {
+		logical int
+		want    int
+	}{
+		{0, 0},
+		{1, 2},
+		{5, 6},
+	} {
+		if got, err := d.LogicalLine(tc.logical); err != nil {
+			t.Errorf("LogicalLine(%d): %v", tc.logical, err)
+		} else if got != tc.want {
+			t.Errorf("LogicalLine(%d): got %d, want %d", tc.logical, got, tc.want)
+		}
+	}
+	if got, err := d.LogicalLine(6); err == nil {
+		t.Errorf("LogicalLine(6): got %d, wanted err", got)
+	}
+
+	for _, tc := range []struct {
+		offset int
+		want   int
+	}{
+		{0, 0},
+		{6, 1},
+		{8, 2},
+		{16, 6},
+	} {
+		if got, err := d.LineAtOffset(tc.offset); err != nil {
+			t.Errorf("LineAtOffset(%d): %v", tc.offset, err)
+		} else if got != tc.want {
+			t.Errorf("LineAtOffset(%d): got %d, want %d", tc.offset, got, tc.want)
+		}
+	}
+	if got, err := d.LineAtOffset(17); err == nil {
+		t.Errorf("LineAtOffset(17): got %d, wanted err", got)
+	}
+
+	// After a resize, the lines are rewrapped before they're looked up.
+	assertResizeWindow(t, d, 10)
+	if got, err := d.LogicalLine(5); err != nil {
+		t.Errorf("LogicalLine(5) after resize: %v", err)
+	} else if want := 5; got != want {
+		t.Errorf("LogicalLine(5) after resize: got %d, want %d", got, want)
+	}
+}
+
+func TestDriverChop(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	reader := newReader(t, "abcdefg\n1\n2")
+	d, err := NewDriver(reader, []byte("\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.Run()
+	defer d.Stop()
+	if err := d.Chop(true); err == nil {
+		t.Errorf("Chop() before ResizeWindow(): got no err")
+	}
+	assertResizeWindow(t, d, 5)
+	assertWatchedLines(t, d, 0, 10, []string{"abcde", "fg\n", "1\n", "2"})
+
+	if err := d.Chop(true); err != nil {
+		t.Fatal(err)
+	}
+	assertWatchedLines(t, d, 0, 10, []string{"abcdefg\n", "1\n", "2"})
+
+	// The width doesn't matter while the lines are chopped.
+	assertResizeWindow(t, d, 3)
+	assertWatchedLines(t, d, 0, 10, []string{"abcdefg\n", "1\n", "2"})
+
+	if err := d.Chop(false); err != nil {
+		t.Fatal(err)
+	}
+	assertWatchedLines(t, d, 0, 10, []string{"abc", "def", "g\n", "1\n", "2"})
+}
+
 func TestDriverSTDIN(t *testing.T) {
 	defer func(prev bool) { enableLogger = prev }(enableLogger)
 	enableLogger = false
@@ -223,14 +354,109 @@ func TestDriverSTDIN(t *testing.T) {
 	// Screen height is 3 but we only get two lines.
 	assertWatchedLines(t, d, 0, 3, []string{"ab", "cd"})
 
+	if got := d.ReadStatus().RemainingBytes; got != -1 {
+		t.Errorf("ReadStatus() has %d remaining bytes, want -1", got)
+	}
+
 	writer.Close()
 
 	// The writer closed, so the rest of the lines are now visible.
 	assertWatchedLines(t, d, 0, 10, []string{"ab", "cd", "ef", "g\n"})
 
+	if got := d.ReadStatus().RemainingBytes; got != 0 {
+		t.Errorf("ReadStatus() has %d remaining bytes, want 0", got)
+	}
+
 	d.Stop()
 }
 
+func TestDriverFollow(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	path := filepath.Join(t.TempDir(), "follow.log")
+	if err := os.WriteFile(path, []byte("abc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	reader, err := blocks.NewReader(blocks.Config{
+		BlockSize:      5,
+		IndexNextBytes: 1,
+		Source: blocks.ConfigSource{
+			Input: f,
+			Size:  4,
+			Path:  path,
+		},
+		PollInterval: 5 * time.Millisecond,
+		FlushAfter:   5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDriver(reader, []byte("\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.Run()
+	defer d.Stop()
+
+	assertResizeWindow(t, d, 80)
+	assertWatchedLines(t, d, 0, 10, []string{"abc\n"})
+
+	// The file was read completely; now it grows.
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if _, err := out.WriteString("def\nghi\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Follow(); err != nil {
+		t.Fatal(err)
+	}
+	assertWatchedLines(t, d, 0, 10, []string{"abc\n", "def\n", "ghi\n"})
+
+	// The file is truncated, and grows again.
+	if err := os.WriteFile(path, []byte("jk\nl\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for event := range d.Events() {
+		if event.Reset {
+			break
+		}
+	}
+
+	// Until Restart() is called, the lines are those of the input from
+	// before, so a search of the new input fails rather than killing the
+	// process.
+	for {
+		if block, err := reader.GetBlock(0); err == nil && string(block.Bytes) == "jk\nl\n" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	id, err := d.Search(context.Background(), SearchRequest{Query: "jk\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := waitForSearch(t, d, id); status.Err == nil {
+		t.Errorf("Search() after the input was truncated: got %v, want an error", status)
+	}
+
+	if err := d.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	assertWatchedLines(t, d, 0, 10, []string{"jk\n", "l\n"})
+}
+
 func TestSearch(t *testing.T) {
 	defer func(prev bool) { enableLogger = prev }(enableLogger)
 	enableLogger = false
@@ -257,31 +483,313 @@ func TestSearch(t *testing.T) {
 	req := SearchRequest{
 		Query: "orge",
 	}
-	if err := d.Search(req); err != nil {
+	id, err := d.Search(context.Background(), req)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	{
-		event := <-d.Events()
-		want := SearchStatus{
-			Request: req,
+	want := SearchStatus{
+		ID:       id,
+		Request:  req,
+		Complete: true,
+		Results: []LineOffsetRange{
+			lor(1, 2, 1, 5),
+		},
+		Lines: 1,
+	}
+	if got := waitForSearch(t, d, id); got.String() != want.String() {
+		t.Fatalf("Search complete; got %v want %v", got, want)
+	}
+	assertNoEventsWaiting(t, d)
+}
+
+func TestSearchRegexp(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	reader := newReader(t, "id=12\nid=ab\nid=34\n")
+	d, err := NewDriver(reader, []byte("\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.Run()
+	defer d.Stop()
+
+	assertResizeWindow(t, d, 80)
+	assertWatchedLines(t, d, 0, 10, []string{"id=12\n", "id=ab\n", "id=34\n"})
+
+	if _, err := d.Search(context.Background(), SearchRequest{Query: "id=[", Regexp: true}); err == nil {
+		t.Errorf("Search() with an invalid regexp should fail")
+	}
+
+	req := SearchRequest{
+		Query:  "^id=[0-9]+$",
+		Regexp: true,
+	}
+	id, err := d.Search(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SearchStatus{
+		ID:       id,
+		Request:  req,
+		Complete: true,
+		Results: []LineOffsetRange{
+			lor(0, 0, 0, 4),
+			lor(2, 0, 2, 4),
+		},
+		Lines: 2,
+	}
+	if got := waitForSearch(t, d, id); got.String() != want.String() {
+		t.Fatalf("Search complete; got %v want %v", got, want)
+	} else {
+		assertSameLors(t, "Search results", got.Results, want.Results)
+	}
+	assertNoEventsWaiting(t, d)
+}
+
+func TestSearchRegexpAcrossBlocks(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	// The match on the first line starts in the first block and ends in the
+	// fourth.
+	reader := newReader(t, "a req_id=deadbeef b\nreq_id=x\nok\n")
+	d, err := NewDriver(reader, []byte("\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.Run()
+	defer d.Stop()
+
+	assertResizeWindow(t, d, 80)
+	assertWatchedLines(t, d, 0, 10, []string{"a req_id=deadbeef b\n", "req_id=x\n", "ok\n"})
+
+	req := SearchRequest{Query: "req_id=[0-9a-f]{8}", Regexp: true}
+	id, err := d.Search(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := waitForSearch(t, d, id)
+	assertSameLors(t, "Search results", status.Results, []LineOffsetRange{lor(0, 2, 0, 16)})
+
+	// Nor does the filter leave out the line.
+	if err := d.SetLineFilter(LineFilter{SearchRequest: req}); err != nil {
+		t.Fatal(err)
+	}
+	assertWatchedLines(t, d, 0, 10, []string{"a req_id=deadbeef b\n"})
+}
+
+func TestSearchLines(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	reader := newReader(t, "abcabc abc\nabc\nxyz\n")
+	d, err := NewDriver(reader, []byte("\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.Run()
+	defer d.Stop()
+
+	assertResizeWindow(t, d, 4)
+	assertWatchedLines(t, d, 0, 10, []string{"abca", "bc a", "bc\n", "abc\n", "xyz\n"})
+
+	id, err := d.Search(context.Background(), SearchRequest{Query: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first three results are in the same (wrapped) line.
+	if got := waitForSearch(t, d, id); len(got.Results) != 4 || got.Lines != 2 {
+		t.Errorf("Search(): got %d results in %d lines, want 4 in 2", len(got.Results), got.Lines)
+	}
+}
+
+func TestSearchRequestIndexed(t *testing.T) {
+	for _, tc := range []struct {
+		req  SearchRequest
+		want bool
+	}{
+		{SearchRequest{Query: "ab"}, false},
+		{SearchRequest{Query: "abc"}, true},
+		{SearchRequest{Query: "ABC", IgnoreCase: true}, true},
+		{SearchRequest{Query: "a", Regexp: true}, false},
+		{SearchRequest{Query: ".", Regexp: true}, false},
+		{SearchRequest{Query: "ab.", Regexp: true}, false},
+		{SearchRequest{Query: "abc|.", Regexp: true}, false},
+		{SearchRequest{Query: "abc.", Regexp: true}, true},
+		{SearchRequest{Query: "(abc|def)+", Regexp: true, IgnoreCase: true}, true},
+		{SearchRequest{Query: "(", Regexp: true}, false},
+	} {
+		if got := tc.req.Indexed(); got != tc.want {
+			t.Errorf("%v: Indexed() got %v, want %v", tc.req, got, tc.want)
 		}
-		if got := event.Search; got == nil || got.String() != want.String() {
-			t.Fatalf("First event after search; got %v want %v", got, want)
+	}
+}
+
+func TestSearchCanceled(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	reader := newReader(t, "abc abc abc\nabc\nxyz abc\n")
+	d, err := NewDriver(reader, []byte("\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.Run()
+	defer d.Stop()
+
+	assertResizeWindow(t, d, 4)
+	assertWatchedLines(t, d, 0, 10, []string{"abc ", "abc ", "abc\n", "abc\n", "xyz ", "abc\n"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.Search(ctx, SearchRequest{Query: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	// Only the events of the second search are sent.
+	id, err := d.Search(context.Background(), SearchRequest{Query: "xyz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := waitForSearch(t, d, id); len(got.Results) != 1 {
+		t.Errorf("Search(): got %d results, want 1", len(got.Results))
+	}
+}
+
+func TestSearchCanceledMidSearch(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	reader := newReader(t, strings.Repeat("abc\n", 20))
+	d, err := NewDriver(reader, []byte("\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.Run()
+	defer d.Stop()
+
+	assertResizeWindow(t, d, 80)
+	assertWatchedLines(t, d, 18, 10, []string{"abc\n", "abc\n"})
+
+	// The search stops after the block that the progress is reported for.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls := 0
+	progress := func(results []LineOffsetRange, lines int) {
+		calls++
+		cancel()
+	}
+	if _, _, err := d.runSearch(ctx, SearchRequest{Query: "abc"}, nil, progress); err != context.Canceled {
+		t.Errorf("runSearch(): got err %v, want %v", err, context.Canceled)
+	}
+	if calls != 1 {
+		t.Errorf("runSearch(): got %d calls of progress, want 1", calls)
+	}
+}
+
+func TestSearchPartial(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	reader := newReader(t, strings.Repeat("abc\n", 100))
+	d, err := NewDriver(reader, []byte("\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.Run()
+	defer d.Stop()
+
+	assertResizeWindow(t, d, 80)
+	assertWatchedLines(t, d, 98, 10, []string{"abc\n", "abc\n"})
+
+	id, err := d.Search(context.Background(), SearchRequest{Query: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The results are reported as the blocks are searched, before the search
+	// is complete.
+	partial := 0
+	for event := range d.Events() {
+		status := event.Search
+		if status == nil {
+			continue
+		}
+		if status.ID != id {
+			t.Fatalf("Got status %v, want search %d", status, id)
 		}
+		if status.Complete {
+			if got, want := len(status.Results), 100; got != want {
+				t.Errorf("Complete status: got %d results, want %d", got, want)
+			}
+			break
+		}
+		if len(status.Results) == 0 {
+			t.Errorf("Partial status: got no results")
+		}
+		partial++
 	}
-	{
-		event := <-d.Events()
-		want := SearchStatus{
-			Request:  req,
-			Complete: true,
-			Results: []LineOffsetRange{
-				lor(1, 2, 1, 5),
+	if partial == 0 {
+		t.Errorf("Got no partial status before the complete one")
+	}
+}
+
+func TestSearchIgnoreCase(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	reader := newReader(t, "Error\nerror\nERROR\nerr\n")
+	d, err := NewDriver(reader, []byte("\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.Run()
+	defer d.Stop()
+
+	assertResizeWindow(t, d, 80)
+	assertWatchedLines(t, d, 0, 10, []string{"Error\n", "error\n", "ERROR\n", "err\n"})
+
+	for _, tc := range []struct {
+		req  SearchRequest
+		want []LineOffsetRange
+	}{
+		{
+			req: SearchRequest{Query: "error"},
+			want: []LineOffsetRange{
+				lor(1, 0, 1, 4),
 			},
+		},
+		{
+			req: SearchRequest{Query: "error", IgnoreCase: true},
+			want: []LineOffsetRange{
+				lor(0, 0, 0, 4),
+				lor(1, 0, 1, 4),
+				lor(2, 0, 2, 4),
+			},
+		},
+		{
+			req: SearchRequest{Query: "^E.r", Regexp: true, IgnoreCase: true},
+			want: []LineOffsetRange{
+				lor(0, 0, 0, 2),
+				lor(1, 0, 1, 2),
+				lor(2, 0, 2, 2),
+				lor(3, 0, 3, 2),
+			},
+		},
+	} {
+		id, err := d.Search(context.Background(), tc.req)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if got := event.Search; got == nil || got.String() != want.String() {
-			t.Fatalf("First event after search; got %v want %v", got, want)
-		}
+		got := waitForSearch(t, d, id)
+		assertSameLors(t, fmt.Sprintf("Search(%v)", tc.req), got.Results, tc.want)
 	}
 	assertNoEventsWaiting(t, d)
 }
@@ -292,7 +800,7 @@ func TestLineWrapper(t *testing.T) {
 
 	blockC := make(chan blocks.Block)
 
-	lw := newLineWrapper(5, []byte("\n"))
+	lw := newLineWrapper(5, DefaultLayout, []byte("\n"))
 	go lw.Run(blockC, nil)
 
 	blockC <- blocks.Block{
@@ -309,11 +817,15 @@ func TestLineWrapper(t *testing.T) {
 	var subID int
 
 	gotLines, wantLines := 0, 4
+	var logicalLines []int
+	var continuations []bool
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		for range lineC {
+		for line := range lineC {
 			//t.Logf("Got line %v", line)
+			logicalLines = append(logicalLines, line.logicalLine)
+			continuations = append(continuations, line.continuation)
 			gotLines++
 			if gotLines == wantLines {
 				// Have the lineWrapper close lineC and clean up the
@@ -335,6 +847,13 @@ func TestLineWrapper(t *testing.T) {
 	if gotLines != wantLines {
 		t.Errorf("SubscribeLines() delivered %d, wanted %d", gotLines, wantLines)
 	}
+	// "abcde", "fghi\n", "12345", "67"
+	if want := []int{0, 0, 1, 1}; !reflect.DeepEqual(logicalLines, want) {
+		t.Errorf("SubscribeLines() delivered logical lines %v, wanted %v", logicalLines, want)
+	}
+	if want := []bool{false, true, false, true}; !reflect.DeepEqual(continuations, want) {
+		t.Errorf("SubscribeLines() delivered continuations %v, wanted %v", continuations, want)
+	}
 
 	/*
 		if got, want := lw.LineCount(), 3; got != want {
@@ -345,6 +864,97 @@ func TestLineWrapper(t *testing.T) {
 	lw.Stop()
 }
 
+func TestLineWrapperKeep(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	blockC := make(chan blocks.Block)
+
+	lw := newLineWrapper(5, DefaultLayout, []byte("\n"))
+	// Hide the lines that start in block 1.
+	lw.keep = func(lines []visibleLine) bool {
+		return lines[0].loc.Start.BlockID != 1
+	}
+	go lw.Run(blockC, nil)
+	defer lw.Stop()
+
+	for i, str := range []string{"a\n", "b\n", "c\n"} {
+		blockC <- blocks.Block{
+			ID:    i,
+			Bytes: []byte(str),
+		}
+	}
+	close(blockC)
+
+	lineC := make(chan visibleLine)
+	subID, err := lw.SubscribeLines(0, 1, lineC)
+	if err != nil {
+		t.Fatalf("SubscribeLines(): %v", err)
+	}
+	var logicalLines []int
+	for line := range lineC {
+		logicalLines = append(logicalLines, line.logicalLine)
+		if len(logicalLines) == 2 {
+			if err := lw.CancelSubscription(subID); err != nil {
+				t.Fatalf("CancelSubscription(%d): %v", subID, err)
+			}
+		}
+	}
+	// The hidden line is still counted, without a wrapEventC.
+	if want := []int{0, 2}; !reflect.DeepEqual(logicalLines, want) {
+		t.Errorf("SubscribeLines() delivered logical lines %v, wanted %v", logicalLines, want)
+	}
+}
+
+func TestLineWrapperWaitForBlock(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	blockC := make(chan blocks.Block)
+
+	lw := newLineWrapper(5, DefaultLayout, []byte("\n"))
+	go lw.Run(blockC, nil)
+	defer lw.Stop()
+
+	blockC <- blocks.Block{
+		ID:    0,
+		Bytes: []byte("abcdefgh"),
+	}
+	if err := lw.WaitForBlock(0); err != nil {
+		t.Fatalf("WaitForBlock(0): %v", err)
+	}
+	// "fgh" continues in the next block.
+	if lines, err := lw.LinesInBlock(0); err != nil {
+		t.Fatalf("LinesInBlock(0): %v", err)
+	} else if got, want := len(lines), 1; got != want {
+		t.Errorf("LinesInBlock(0): got %d lines, want %d", got, want)
+	}
+
+	doneC := make(chan error)
+	go func() {
+		doneC <- lw.WaitForBlock(1)
+	}()
+	select {
+	case err := <-doneC:
+		t.Fatalf("WaitForBlock(1) returned %v before block 1 was sent", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	blockC <- blocks.Block{
+		ID:    1,
+		Bytes: []byte("i\n"),
+	}
+	if err := <-doneC; err != nil {
+		t.Fatalf("WaitForBlock(1): %v", err)
+	}
+	if lines, err := lw.LinesInBlock(1); err != nil {
+		t.Fatalf("LinesInBlock(1): %v", err)
+	} else if got, want := len(lines), 1; got != want {
+		t.Errorf("LinesInBlock(1): got %d lines, want %d", got, want)
+	}
+	close(blockC)
+}
+
 func TestGenerateVisibleLines(t *testing.T) {
 	defer func(prev bool) { enableLogger = prev }(enableLogger)
 	enableLogger = false
@@ -364,7 +974,7 @@ func TestGenerateVisibleLines(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		generateVisibleLines([]byte("\n"), width, blockC, lineC)
+		generateVisibleLines([]byte("\n"), width, DefaultLayout, blockC, lineC, nil)
 		wg.Done()
 	}()
 
@@ -434,7 +1044,7 @@ func TestGenerateVisibleLinesBlocksSameSizeAsWidth(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		generateVisibleLines([]byte("\n"), width, blockC, lineC)
+		generateVisibleLines([]byte("\n"), width, DefaultLayout, blockC, lineC, nil)
 		wg.Done()
 	}()
 
@@ -494,12 +1104,186 @@ func lor(al, ao, bl, bo int) LineOffsetRange {
 	}
 }
 
+func TestGenerateVisibleLinesSeparatorSplit(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	blockC := make(chan blocks.Block)
+	lineC := make(chan visibleLine, 10)
+
+	assertNextLine := func(want visibleLine) {
+		t.Helper()
+		got := <-lineC
+		if got.String() != want.String() {
+			t.Errorf("\n got %v\nwant %v", got, want)
+		}
+	}
+
+	// "abcd\r" (with the "\r" shown as "^M") fills the width.
+	const width = 6
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		generateVisibleLines([]byte("\r\n"), width, DefaultLayout, blockC, lineC, nil)
+		wg.Done()
+	}()
+
+	// The "\r\n" is split across the blocks.
+	blockC <- blocks.Block{
+		ID: 0,
+		//             01234
+		Bytes: []byte("abcd\r"),
+	}
+	select {
+	case got := <-lineC:
+		t.Fatalf("There shouldn't be a line yet; got %v", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	blockC <- blocks.Block{
+		ID: 1,
+		//             0 1 2 3 4
+		Bytes: []byte("\nef\r\n"),
+	}
+	assertNextLine(visibleLine{
+		loc:             blockRange(0, 0, 1, 0), // "abcd\r\n"
+		endsWithLineSep: true,
+	})
+	assertNextLine(visibleLine{
+		loc:             blockRange(1, 1, 1, 4), // "ef\r\n"
+		endsWithLineSep: true,
+	})
+
+	close(blockC)
+	for line := range lineC {
+		t.Errorf("Got %v", line)
+	}
+
+	wg.Wait()
+}
+
+func TestGenerateVisibleLinesUTF8(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	for _, tc := range []struct {
+		desc   string
+		blocks []string
+		width  int
+		want   []visibleLine
+	}{
+		{
+			desc: "wide characters",
+			//                012345678901234567 8
+			blocks: []string{"日本語のログ\n"},
+			width:  5,
+			want: []visibleLine{
+				{loc: blockRange(0, 0, 0, 5)},                          // "日本"
+				{loc: blockRange(0, 6, 0, 11)},                         // "語の"
+				{loc: blockRange(0, 12, 0, 18), endsWithLineSep: true}, // "ログ\n"
+			},
+		},
+		{
+			desc: "UTF-8 sequence split across blocks",
+			//                01 2   3      0   12
+			blocks: []string{"ab\xe6\x97", "\xa5c\n"},
+			width:  3,
+			want: []visibleLine{
+				{loc: blockRange(0, 0, 0, 1)},                        // "ab"
+				{loc: blockRange(0, 2, 1, 1)},                        // "日c"
+				{loc: blockRange(1, 2, 1, 2), endsWithLineSep: true}, // "\n"
+			},
+		},
+		{
+			desc:   "last line across blocks",
+			blocks: []string{"abcde", "fghij", "k"},
+			width:  80,
+			want: []visibleLine{
+				{loc: blockRange(0, 0, 2, 0)},
+			},
+		},
+	} {
+		blockC := make(chan blocks.Block)
+		lineC := make(chan visibleLine, 10)
+		go generateVisibleLines([]byte("\n"), tc.width, DefaultLayout, blockC, lineC, nil)
+		for i, b := range tc.blocks {
+			blockC <- blocks.Block{ID: i, Bytes: []byte(b)}
+		}
+		close(blockC)
+
+		var got []visibleLine
+		for line := range lineC {
+			got = append(got, line)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s:\n got %v\nwant %v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestGenerateVisibleLinesChop(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	for _, tc := range []struct {
+		desc   string
+		sep    string
+		blocks []string
+		want   []visibleLine
+	}{
+		{
+			desc:   "line across blocks",
+			sep:    "\n",
+			blocks: []string{"abc", "def", "g\nh", "ij"},
+			want: []visibleLine{
+				{loc: blockRange(0, 0, 2, 1), endsWithLineSep: true}, // "abcdefg\n"
+				{loc: blockRange(2, 2, 3, 1)},                        // "hij"
+			},
+		},
+		{
+			desc:   "line ends with a block",
+			sep:    "\n",
+			blocks: []string{"abc", "de\n", "fg"},
+			want: []visibleLine{
+				{loc: blockRange(0, 0, 1, 2), endsWithLineSep: true}, // "abcde\n"
+				{loc: blockRange(2, 0, 2, 1)},                        // "fg"
+			},
+		},
+		{
+			desc:   "separator split across blocks",
+			sep:    "\r\n",
+			blocks: []string{"abc", "def\r", "\ngh", "\r", "\r\n"},
+			want: []visibleLine{
+				{loc: blockRange(0, 0, 2, 0), endsWithLineSep: true}, // "abcdef\r\n"
+				{loc: blockRange(2, 1, 4, 1), endsWithLineSep: true}, // "gh\r\r\n"
+			},
+		},
+	} {
+		blockC := make(chan blocks.Block)
+		lineC := make(chan visibleLine, 10)
+		go generateVisibleLines([]byte(tc.sep), 0, DefaultLayout, blockC, lineC, nil)
+		for i, b := range tc.blocks {
+			blockC <- blocks.Block{ID: i, Bytes: []byte(b)}
+		}
+		close(blockC)
+
+		var got []visibleLine
+		for line := range lineC {
+			got = append(got, line)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s:\n got %v\nwant %v", tc.desc, got, tc.want)
+		}
+	}
+}
+
 func TestLineOffsetRangeForQueryIn(t *testing.T) {
 	vlines := []*VisibleLine{
 		//   012345
-		{3, "abcdef"},
-		{4, "ghi\n"},
-		{5, "123\n"},
+		{Number: 3, Line: "abcdef"},
+		{Number: 4, Line: "ghi\n"},
+		{Number: 5, Line: "123\n"},
 	}
 
 	for _, tc := range []struct {
@@ -523,7 +1307,7 @@ func TestLineOffsetRangeForQueryIn(t *testing.T) {
 			want:  lor(3, 4, 5, 1),
 		},
 	} {
-		lor := lineOffsetRangeForQueryIn(vlines, tc.query)
+		lor := lineOffsetRangeForQueryIn(vlines, tc.query, false)
 		if len(lor) == 0 || lor[0].String() != tc.want.String() {
 			t.Errorf("lineOffsetRangeForQueryIn(%q)\n got %v\nwant %v", tc.query, lor[0], tc.want)
 		}
@@ -533,12 +1317,12 @@ func TestLineOffsetRangeForQueryIn(t *testing.T) {
 func TestLineOffsetRangeForQueryInMultiple(t *testing.T) {
 	vlines := []*VisibleLine{
 		//   0123456789
-		{3, "1. abc def\n"},
-		{4, "2. def ghi\n"},
-		{5, "3. bla bla\n"},
-		{6, "ㄱㄴㄷ"},
-		{7, "ㄱㄴㄷ"},
-		{8, "ㄱㄴㄷ"},
+		{Number: 3, Line: "1. abc def\n"},
+		{Number: 4, Line: "2. def ghi\n"},
+		{Number: 5, Line: "3. bla bla\n"},
+		{Number: 6, Line: "ㄱㄴㄷ"},
+		{Number: 7, Line: "ㄱㄴㄷ"},
+		{Number: 8, Line: "ㄱㄴㄷ"},
 	}
 
 	for _, tc := range []struct {
@@ -567,14 +1351,18 @@ func TestLineOffsetRangeForQueryInMultiple(t *testing.T) {
 		},
 		{
 			query: "ㄷ",
-			want:  []LineOffsetRange{},
+			want: []LineOffsetRange{
+				lor(6, 6, 6, 8),
+				lor(7, 6, 7, 8),
+				lor(8, 6, 8, 8),
+			},
 		},
 		{
 			query: "not found",
 			want:  []LineOffsetRange{},
 		},
 	} {
-		lor := lineOffsetRangeForQueryIn(vlines, tc.query)
+		lor := lineOffsetRangeForQueryIn(vlines, tc.query, false)
 		if got, want := len(lor), len(tc.want); got != want {
 			t.Errorf("lineOffsetRangeForQueryIn(%q)\n got %v\nwant %v", tc.query, lor, tc.want)
 			continue
@@ -587,3 +1375,97 @@ func TestLineOffsetRangeForQueryInMultiple(t *testing.T) {
 		}
 	}
 }
+
+func TestLineOffsetRangeForRegexpIn(t *testing.T) {
+	vlines := []*VisibleLine{
+		//   0123456789
+		{Number: 3, Line: "req_id=1a\n"},
+		{Number: 4, Line: "req_id=zz\n"},
+		{Number: 5, Line: "req_id=2b"},
+		{Number: 6, Line: "\n"},
+	}
+
+	for _, tc := range []struct {
+		expr string
+		want []LineOffsetRange
+	}{
+		{
+			expr: `req_id=[0-9a-f]{2}`,
+			want: []LineOffsetRange{
+				lor(3, 0, 3, 8),
+				lor(5, 0, 5, 8),
+			},
+		},
+		{
+			expr: `(?m)z$`,
+			want: []LineOffsetRange{
+				lor(4, 8, 4, 8),
+			},
+		},
+		{
+			expr: `b\n`,
+			want: []LineOffsetRange{
+				lor(5, 8, 6, 0),
+			},
+		},
+		{
+			expr: `^`,
+			want: []LineOffsetRange{},
+		},
+	} {
+		got := lineOffsetRangeForRegexpIn(vlines, regexp.MustCompile(tc.expr), false)
+		assertSameLors(t, fmt.Sprintf("lineOffsetRangeForRegexpIn(%q)", tc.expr), got, tc.want)
+	}
+}
+
+func TestLineOffsetRangeInEscapes(t *testing.T) {
+	vlines := []*VisibleLine{
+		// "F" is at 5, "L" at 12 and "\n" at 17.
+		{Number: 3, Line: "\x1b[31mFA\x1b[1mIL\x1b[0m\n"},
+		// "o" is at 5.
+		{Number: 4, Line: "\x1b[32mok\n"},
+	}
+
+	for _, tc := range []struct {
+		query   string
+		escapes bool
+		want    []LineOffsetRange
+	}{
+		{"FAIL", true, []LineOffsetRange{lor(3, 5, 3, 12)}},
+		{"FAIL", false, []LineOffsetRange{}},
+		{"\nok", true, []LineOffsetRange{lor(3, 17, 4, 6)}},
+		{"[31m", true, []LineOffsetRange{}},
+		{"[31m", false, []LineOffsetRange{lor(3, 1, 3, 4)}},
+	} {
+		got := lineOffsetRangeForQueryIn(vlines, tc.query, tc.escapes)
+		assertSameLors(t, fmt.Sprintf("lineOffsetRangeForQueryIn(%q, %v)", tc.query, tc.escapes), got, tc.want)
+
+		re := regexp.MustCompile(regexp.QuoteMeta(tc.query))
+		got = lineOffsetRangeForRegexpIn(vlines, re, tc.escapes)
+		assertSameLors(t, fmt.Sprintf("lineOffsetRangeForRegexpIn(%q, %v)", tc.query, tc.escapes), got, tc.want)
+	}
+}
+
+func TestGenerateHexLines(t *testing.T) {
+	blockC := make(chan blocks.Block)
+	lineC := make(chan visibleLine, 10)
+	go generateHexLines(4, blockC, lineC, nil)
+	for i, b := range []string{"abcde", "fg", "", "hijklmn"} {
+		blockC <- blocks.Block{ID: i, Bytes: []byte(b)}
+	}
+	close(blockC)
+
+	var got []visibleLine
+	for line := range lineC {
+		got = append(got, line)
+	}
+	want := []visibleLine{
+		{loc: blockRange(0, 0, 0, 3), endsWithLineSep: true}, // "abcd"
+		{loc: blockRange(0, 4, 3, 0), endsWithLineSep: true}, // "efgh"
+		{loc: blockRange(3, 1, 3, 4), endsWithLineSep: true}, // "ijkl"
+		{loc: blockRange(3, 5, 3, 6), endsWithLineSep: true}, // "mn"
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("\n got %v\nwant %v", got, want)
+	}
+}
@@ -0,0 +1,138 @@
+package wrapper
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/ewaters/meno/ansi"
+	"github.com/ewaters/meno/blocks"
+	"github.com/golang/glog"
+)
+
+// A LineFilter shows only the lines of the input that match a search (or,
+// with Invert, only the ones that don't), like `less`'s `&pattern`. The zero
+// value shows every line.
+type LineFilter struct {
+	SearchRequest
+	Invert bool
+}
+
+func (lf LineFilter) String() string {
+	if lf.Invert {
+		return "not " + lf.SearchRequest.String()
+	}
+	return lf.SearchRequest.String()
+}
+
+// active returns true if the filter hides any lines.
+func (lf LineFilter) active() bool {
+	return lf.Query != ""
+}
+
+// lineMatcher decides which logical lines a LineFilter shows. The index of the
+// blocks.Reader tells it which blocks may have a match, so only the lines in
+// those blocks are read and matched.
+type lineMatcher struct {
+	filter  LineFilter
+	re      *regexp.Regexp
+	reader  *blocks.Reader
+	lineSep []byte
+	escapes bool
+	// Returns the status of the reader, which says how many blocks have been
+	// indexed.
+	readStatus func() blocks.ReadStatus
+
+	// Of the first searchedBlocks blocks, the ones that may have a match (nil
+	// until the index has been queried).
+	candidates     map[int]bool
+	searchedBlocks int
+}
+
+func newLineMatcher(d *Driver, filter LineFilter, layout Layout) (*lineMatcher, error) {
+	re, err := filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	return &lineMatcher{
+		filter:     filter,
+		re:         re,
+		reader:     d.reader,
+		lineSep:    d.lineSep,
+		escapes:    layout.Escapes && layout.HexBytes == 0,
+		readStatus: d.ReadStatus,
+	}, nil
+}
+
+// keep returns true if the logical line, which was wrapped into the lines,
+// is shown.
+func (lm *lineMatcher) keep(lines []visibleLine) bool {
+	loc := blocks.BlockIDOffsetRange{
+		Start: lines[0].loc.Start,
+		End:   lines[len(lines)-1].loc.End,
+	}
+	match, err := lm.matches(loc)
+	if err != nil {
+		// Like when the reader was stopped under us.
+		glog.Errorf("Matching the line at { %v }: %v", loc, err)
+		return false
+	}
+	return match != lm.filter.Invert
+}
+
+// matches returns true if the line at the location matches the search.
+func (lm *lineMatcher) matches(loc blocks.BlockIDOffsetRange) (bool, error) {
+	// A match that starts in the line starts in one of its blocks.
+	candidate, err := lm.mayMatch(loc.Start.BlockID, loc.End.BlockID)
+	if err != nil || !candidate {
+		return false, err
+	}
+	buf, err := lm.reader.GetBytes(loc)
+	if err != nil {
+		return false, err
+	}
+	text := strings.TrimSuffix(string(buf), string(lm.lineSep))
+	if lm.escapes {
+		text, _ = ansi.Strip(text)
+	}
+	if lm.re != nil {
+		return lm.re.MatchString(text), nil
+	}
+	return strings.Contains(text, lm.filter.Query), nil
+}
+
+// mayMatch returns true if any of the blocks from the first to the last ID
+// may have a match. The index is queried for the blocks read before the first
+// call. The lines of the blocks read after that are matched without it (as
+// they're wrapped, so each is only read once), as are those of the last block
+// before it, since its last line may go on in the blocks after it.
+func (lm *lineMatcher) mayMatch(first, last int) (bool, error) {
+	if lm.candidates == nil {
+		// Blocks are indexed before they're counted.
+		indexed := lm.readStatus().Blocks
+		var bios []blocks.BlockIDOffset
+		var err error
+		if lm.re != nil {
+			bios, err = lm.reader.BlockIDsMatching(lm.re)
+		} else {
+			bios, err = lm.reader.BlockIDsContaining(lm.filter.Query)
+		}
+		if err != nil {
+			return false, err
+		}
+		lm.candidates = make(map[int]bool)
+		for _, bio := range bios {
+			lm.candidates[bio.BlockID] = true
+		}
+		lm.searchedBlocks = indexed - 1
+		glog.V(1).Infof("Filter %v: %d of %d blocks may match", lm.filter, len(lm.candidates), indexed)
+	}
+	if last >= lm.searchedBlocks {
+		return true, nil
+	}
+	for id := first; id <= last; id++ {
+		if lm.candidates[id] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,79 @@
+package wrapper
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDriverLineFilter(t *testing.T) {
+	defer func(prev bool) { enableLogger = prev }(enableLogger)
+	enableLogger = false
+
+	reader := newReader(t, "error: a\nok\nerror: bbbbbbb\nOK\nlast error")
+	d, err := NewDriver(reader, []byte("\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.Run()
+	defer d.Stop()
+	assertResizeWindow(t, d, 5)
+
+	if err := d.SetLineFilter(LineFilter{SearchRequest: SearchRequest{Query: "error"}}); err != nil {
+		t.Fatal(err)
+	}
+	assertWatchedLines(t, d, 0, 10, []string{"error", ": a\n", "error", ": bbb", "bbbb\n", "last ", "error"})
+	// The lines keep the numbers of the lines of the input.
+	for _, tc := range []struct {
+		number      int
+		wantLogical int
+	}{
+		{0, 0},
+		{2, 2},
+		{4, 2},
+		{5, 4},
+	} {
+		if line, err := d.Line(tc.number); err != nil {
+			t.Errorf("Line(%d): %v", tc.number, err)
+		} else if line.LogicalLine != tc.wantLogical {
+			t.Errorf("Line(%d): got logical line %d, want %d", tc.number, line.LogicalLine, tc.wantLogical)
+		}
+	}
+	if got, want := d.TotalLogicalLines(), 5; got != want {
+		t.Errorf("TotalLogicalLines(): got %d, want %d", got, want)
+	}
+	// A line that isn't shown goes to the next one that is.
+	if got, err := d.LogicalLine(1); err != nil {
+		t.Errorf("LogicalLine(1): %v", err)
+	} else if want := 2; got != want {
+		t.Errorf("LogicalLine(1): got %d, want %d", got, want)
+	}
+
+	// Searches only find what's shown.
+	id, err := d.Search(context.Background(), SearchRequest{Query: "bbb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := waitForSearch(t, d, id)
+	assertSameLors(t, "Search(bbb)", status.Results, []LineOffsetRange{lor(3, 2, 3, 4), lor(4, 0, 4, 2)})
+
+	if err := d.SetLineFilter(LineFilter{SearchRequest: SearchRequest{Query: "error"}, Invert: true}); err != nil {
+		t.Fatal(err)
+	}
+	assertWatchedLines(t, d, 0, 10, []string{"ok\n", "OK\n"})
+
+	if err := d.SetLineFilter(LineFilter{SearchRequest: SearchRequest{Query: "^ok|a$", Regexp: true, IgnoreCase: true}}); err != nil {
+		t.Fatal(err)
+	}
+	assertWatchedLines(t, d, 0, 10, []string{"error", ": a\n", "ok\n", "OK\n"})
+
+	if err := d.SetLineFilter(LineFilter{SearchRequest: SearchRequest{Query: "(", Regexp: true}}); err == nil {
+		t.Errorf("SetLineFilter() with an invalid regexp: got no err")
+	}
+
+	// Every line is shown again.
+	if err := d.SetLineFilter(LineFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	assertWatchedLines(t, d, 0, 20, []string{"error", ": a\n", "ok\n", "error", ": bbb", "bbbb\n", "OK\n", "last ", "error"})
+}
@@ -3,6 +3,7 @@ package wrapper
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/ewaters/meno/blocks"
@@ -30,24 +31,33 @@ func (ls *lineSubscription) lineWanted(idx int) bool {
 
 type wrapEvent struct {
 	lines int
+	// The number of lines of the input (which may each have been wrapped
+	// into many visible lines).
+	logicalLines int
 }
 
 func (we wrapEvent) String() string {
-	return fmt.Sprintf("total lines: %d", we.lines)
+	return fmt.Sprintf("total lines: %d, logical lines: %d", we.lines, we.logicalLines)
 }
 
 type lineWrapper struct {
 	width   int
+	layout  Layout
 	lineSep []byte
+	// If set, only the logical lines (given as the visible lines they're
+	// wrapped into) that it returns true for are kept, but they keep the
+	// numbers of the logical lines of the input (see LineFilter).
+	keep func([]visibleLine) bool
 
 	reqC  chan chanRequest
 	doneC chan bool
 	quitC chan bool
 }
 
-func newLineWrapper(width int, lineSep []byte) *lineWrapper {
+func newLineWrapper(width int, layout Layout, lineSep []byte) *lineWrapper {
 	return &lineWrapper{
 		width:   width,
+		layout:  layout,
 		lineSep: lineSep,
 		reqC:    make(chan chanRequest),
 		doneC:   make(chan bool, 1),
@@ -58,47 +68,110 @@ func newLineWrapper(width int, lineSep []byte) *lineWrapper {
 // Runs until Stop is called. Make sure to close blockC before calling stop.
 func (lw *lineWrapper) Run(blockC chan blocks.Block, wrapEventC chan wrapEvent) {
 	lineC := make(chan visibleLine)
+	blockDoneC := make(chan int)
 
 	var lines []visibleLine
+	// The number of logical lines that have ended so far.
+	endedLines := 0
+	// With keep, the lines of the logical line that hasn't ended yet.
+	var pending []visibleLine
 	lastSubID := 0
 	subsByID := make(map[int]*lineSubscription)
 	linesByBlock := make(map[int][]int)
 
+	// The ID of the last block whose lines were all sent on lineC, and the
+	// requests waiting for later blocks.
+	wrappedBlockID := -1
+	var blockWaiters []chanRequest
+
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		generateVisibleLines(lw.lineSep, lw.width, blockC, lineC)
+		if lw.layout.HexBytes > 0 {
+			generateHexLines(lw.layout.HexBytes, blockC, lineC, blockDoneC)
+		} else {
+			generateVisibleLines(lw.lineSep, lw.width, lw.layout, blockC, lineC, blockDoneC)
+		}
 		wg.Done()
 	}()
 
+	// Set to nil once lineC is closed.
+	recvLineC := lineC
 outer:
 	for {
 		select {
-		case line, ok := <-lineC:
-			if !ok {
-				continue
-			}
-			line.number = len(lines)
-			glog.V(1).Infof("got line %v", line)
-			lines = append(lines, line)
-			for id := line.loc.Start.BlockID; id <= line.loc.End.BlockID; id++ {
-				linesByBlock[id] = append(linesByBlock[id], line.number)
+		case line, ok := <-recvLineC:
+			var newLines []visibleLine
+			switch {
+			case !ok:
+				// The last logical line ended with the input.
+				recvLineC = nil
+				if len(pending) == 0 {
+					continue
+				}
+			case lw.keep == nil:
+				newLines = []visibleLine{line}
+			default:
+				pending = append(pending, line)
+				if !line.endsWithLineSep {
+					continue
+				}
 			}
-			// Not sure if this is a good idea or not.
-			if wrapEventC != nil {
-				glog.V(1).Infof("<- wrapEventC lines: %d", len(lines))
-				wrapEventC <- wrapEvent{
-					lines: len(lines),
+			if len(pending) > 0 {
+				if lw.keep(pending) {
+					newLines = pending
+				} else {
+					// The lines of the input are still counted.
+					endedLines++
+					if wrapEventC != nil {
+						wrapEventC <- wrapEvent{
+							lines:        len(lines),
+							logicalLines: endedLines,
+						}
+					}
 				}
+				pending = nil
 			}
+			for _, line := range newLines {
+				line.number = len(lines)
+				line.logicalLine = endedLines
+				line.continuation = len(lines) > 0 && !lines[len(lines)-1].endsWithLineSep
+				if line.endsWithLineSep {
+					endedLines++
+				}
+				glog.V(1).Infof("got line %v", line)
+				lines = append(lines, line)
+				for id := line.loc.Start.BlockID; id <= line.loc.End.BlockID; id++ {
+					linesByBlock[id] = append(linesByBlock[id], line.number)
+				}
+				// Not sure if this is a good idea or not.
+				if wrapEventC != nil {
+					glog.V(1).Infof("<- wrapEventC lines: %d", len(lines))
+					wrapEventC <- wrapEvent{
+						lines:        len(lines),
+						logicalLines: line.logicalLine + 1,
+					}
+				}
 
-			for _, sub := range subsByID {
-				if !sub.lineWanted(line.number) {
+				for _, sub := range subsByID {
+					if !sub.lineWanted(line.number) {
+						continue
+					}
+					glog.V(1).Infof("<- respC sending line %d to subscription", line.number)
+					sub.respC <- line
+				}
+			}
+		case id := <-blockDoneC:
+			wrappedBlockID = id
+			var waiting []chanRequest
+			for _, req := range blockWaiters {
+				if *req.waitForBlock > wrappedBlockID {
+					waiting = append(waiting, req)
 					continue
 				}
-				glog.V(1).Infof("<- respC sending line %d to subscription", line.number)
-				sub.respC <- line
+				req.respC <- chanResponse{}
 			}
+			blockWaiters = waiting
 		case <-lw.quitC:
 			break outer
 		case req := <-lw.reqC:
@@ -149,12 +222,55 @@ outer:
 				req.respC <- resp
 				continue
 			}
+			if n := req.getLine; n != nil {
+				if *n < 0 || *n >= len(lines) {
+					resp.err = fmt.Errorf("Invalid line %d; there are %d", *n, len(lines))
+				} else {
+					resp.lines = []visibleLine{lines[*n]}
+				}
+				req.respC <- resp
+				continue
+			}
+			if bio := req.lineFrom; bio != nil {
+				// The lines are in the order of the input.
+				i := sort.Search(len(lines), func(i int) bool {
+					return lines[i].loc.End.GTE(*bio)
+				})
+				if i == len(lines) {
+					resp.err = fmt.Errorf("No line from { %v }; there are %d", *bio, len(lines))
+				} else {
+					resp.lines = []visibleLine{lines[i]}
+				}
+				req.respC <- resp
+				continue
+			}
+			if id := req.waitForBlock; id != nil {
+				if *id > wrappedBlockID {
+					blockWaiters = append(blockWaiters, req)
+					continue
+				}
+				req.respC <- resp
+				continue
+			}
 			resp.err = fmt.Errorf("Unhandled req %v", req)
 			req.respC <- resp
 		}
 	}
+	for _, req := range blockWaiters {
+		req.respC <- chanResponse{
+			err: fmt.Errorf("Stopped before block %d was wrapped", *req.waitForBlock),
+		}
+	}
 	// Drain lineC
-	for range lineC {
+drain:
+	for {
+		select {
+		case _, ok := <-lineC:
+			if !ok {
+				break drain
+			}
+		case <-blockDoneC:
+		}
 	}
 	if wrapEventC != nil {
 		close(wrapEventC)
@@ -174,6 +290,9 @@ type chanRequest struct {
 	newSub       *lineSubscription
 	cancelSub    *int
 	linesInBlock *int
+	waitForBlock *int
+	getLine      *int
+	lineFrom     *blocks.BlockIDOffset
 
 	respC chan chanResponse
 }
@@ -189,7 +308,16 @@ func (cr chanRequest) String() string {
 		return fmt.Sprintf("cancel subscription %d", *sub)
 	}
 	if block := cr.linesInBlock; block != nil {
-		return fmt.Sprintf("lines in block %d", block)
+		return fmt.Sprintf("lines in block %d", *block)
+	}
+	if block := cr.waitForBlock; block != nil {
+		return fmt.Sprintf("wait for block %d", *block)
+	}
+	if n := cr.getLine; n != nil {
+		return fmt.Sprintf("get line %d", *n)
+	}
+	if bio := cr.lineFrom; bio != nil {
+		return fmt.Sprintf("line from { %v }", *bio)
 	}
 	return "unknown"
 }
@@ -250,39 +378,131 @@ func (lw *lineWrapper) LinesInBlock(id int) ([]visibleLine, error) {
 	return resp.lines, resp.err
 }
 
+// LineFrom returns the first line that has the byte at the location or one
+// after it (like when the line with it was left out, see keep).
+func (lw *lineWrapper) LineFrom(bio blocks.BlockIDOffset) (visibleLine, error) {
+	resp := lw.sendRequest(chanRequest{
+		lineFrom: &bio,
+	})
+	if resp.err != nil {
+		return visibleLine{}, resp.err
+	}
+	return resp.lines[0], nil
+}
+
+// GetLine returns the line with the number, if it has been wrapped.
+func (lw *lineWrapper) GetLine(n int) (visibleLine, error) {
+	resp := lw.sendRequest(chanRequest{
+		getLine: &n,
+	})
+	if resp.err != nil {
+		return visibleLine{}, resp.err
+	}
+	return resp.lines[0], nil
+}
+
+// WaitForBlock returns once the lines of the block with the given ID (and all
+// the blocks before it) have been wrapped. The last line of the block may
+// not be among them if it continues in the next block.
+func (lw *lineWrapper) WaitForBlock(id int) error {
+	resp := lw.sendRequest(chanRequest{
+		waitForBlock: &id,
+	})
+	return resp.err
+}
+
 type visibleLine struct {
-	number          int
+	number int
+	// The (0-based) number of the line of the input that this is part of.
+	logicalLine int
+	// Whether this continues the logical line of the visible line before it
+	// (which was wrapped).
+	continuation    bool
 	loc             blocks.BlockIDOffsetRange
 	endsWithLineSep bool
 }
 
 func (vl visibleLine) String() string {
-	return fmt.Sprintf("[%d] loc %v, ends with line sep %v", vl.number, vl.loc, vl.endsWithLineSep)
+	return fmt.Sprintf("[%d] logical line %d, loc %v, ends with line sep %v", vl.number, vl.logicalLine, vl.loc, vl.endsWithLineSep)
 }
 
-func generateVisibleLines(lineSep []byte, width int, blockC chan blocks.Block, lineC chan visibleLine) {
+// generateVisibleLines wraps the blocks from blockC into lines sent on lineC
+// until blockC is closed, when it closes lineC. If width is 0, lines aren't
+// wrapped. If blockDoneC is set, the ID of each block is sent on it once its
+// lines have been sent.
+func generateVisibleLines(lineSep []byte, width int, layout Layout, blockC chan blocks.Block, lineC chan visibleLine, blockDoneC chan int) {
+	// The bytes of the last line that haven't been sent yet, since it
+	// continues in the next block, and their position in the input. If lines
+	// aren't wrapped, only the end of the line that may start a line
+	// separator is kept, so that a long line isn't copied again with each
+	// block.
 	var leftOver []byte
-	var leftOverStart blocks.BlockIDOffset
-
-	endsWithNewline := false
+	leftOverPos := 0
+	// The position in the input of the first byte of the last line that
+	// hasn't been sent yet (leftOverPos, unless leftOver was cut).
+	lineStart := 0
+
+	// The (non-empty) blocks that leftOver started in and after, and their
+	// position in the input, to find the block + offset of a position.
+	type blockPos struct {
+		id, pos int
+	}
+	var spans []blockPos
+	nextPos := 0
+	locate := func(pos int) blocks.BlockIDOffset {
+		i := sort.Search(len(spans), func(i int) bool {
+			return spans[i].pos > pos
+		}) - 1
+		return blocks.BlockIDOffset{
+			BlockID: spans[i].id,
+			Offset:  pos - spans[i].pos,
+		}
+	}
+	// send sends the visible line of the bytes of the input from `from` up
+	// to (and not including) `to`.
+	send := func(from, to int, endsWithLineSep bool) {
+		vl := visibleLine{
+			loc: blocks.BlockIDOffsetRange{
+				Start: locate(from),
+				End:   locate(to - 1),
+			},
+			endsWithLineSep: endsWithLineSep,
+		}
+		glog.V(1).Infof("<- lineC %v", vl)
+		lineC <- vl
+	}
+	// wrap sends the visible lines of the line at pos that were wrapped,
+	// and returns the rest of it.
+	wrap := func(line []byte, pos int, partial bool) ([]byte, int) {
+		// A partial line may end with the start of a line separator (like
+		// the "\r" of "\r\n"), which isn't part of the line if the rest of
+		// the separator is in the next block.
+		held := 0
+		if partial {
+			held = sepPrefixLen(line, lineSep)
+		}
+		for width > 0 {
+			n := wrapPoint(line[:len(line)-held], width, layout, partial)
+			if n < 0 {
+				break
+			}
+			send(pos, pos+n, false)
+			line = line[n:]
+			pos += n
+		}
+		return line, pos
+	}
 
 	glog.V(1).Infof("Starting range over blockC")
 	for block := range blockC {
 		glog.V(1).Infof("<- blockC %d", block.ID)
-		start := blocks.BlockIDOffset{
-			BlockID: block.ID,
-			Offset:  0,
-		}
-		if len(leftOver) > 0 {
-			start = leftOverStart
-		}
-		end := blocks.BlockIDOffset{
-			BlockID: block.ID,
-			Offset:  0 - len(leftOver),
+		if len(block.Bytes) > 0 {
+			spans = append(spans, blockPos{block.ID, nextPos})
+			nextPos += len(block.Bytes)
 		}
-		glog.V(2).Infof("reset start: %v, end: %v", start, end)
 
 		combined := append(leftOver, block.Bytes...)
+		pos := leftOverPos
 		lines := bytes.Split(combined, lineSep)
 		if glog.V(1) {
 			var linesStr []string
@@ -291,69 +511,114 @@ func generateVisibleLines(lineSep []byte, width int, blockC chan blocks.Block, l
 			}
 			glog.V(1).Infof("Block [%d] %q, have lines %q", block.ID, string(block.Bytes), linesStr)
 		}
-		leftOver = nil
-		endsWithNewline = bytes.HasSuffix(combined, lineSep)
+		endsWithNewline := bytes.HasSuffix(combined, lineSep)
 		if endsWithNewline {
 			// The last element in the lines list is an empty string; let's
 			// pop it.
 			lines = lines[:len(lines)-1]
 		}
 
-		for i := 0; i < len(lines); i++ {
-			line := lines[i]
-			lastLine := i == len(lines)-1
-			for len(line) >= width {
-				//part := line[:width]
-				end.Offset += width - 1
-				vl := visibleLine{
-					// line:       part,
-					loc: blocks.BlockIDOffsetRange{
-						Start: start,
-						End:   end,
-					},
-					endsWithLineSep: false,
-				}
-				glog.V(1).Infof("<- lineC line: %q, sending vl %v (wrapped)", string(line[:width]), vl)
-				lineC <- vl
-				line = line[width:]
-				end.Offset++
-				start = end
-				glog.V(2).Infof("start: %v, end: %v", start, end)
+		leftOver = nil
+		for i, line := range lines {
+			partial := i == len(lines)-1 && !endsWithNewline
+			if i > 0 {
+				lineStart = pos
 			}
-			if !lastLine || endsWithNewline {
-				end.Offset += len(line) - 1 + len(lineSep)
-				vl := visibleLine{
-					loc: blocks.BlockIDOffsetRange{
-						Start: start,
-						End:   end,
-					},
-					endsWithLineSep: true,
+			line, pos = wrap(line, pos, partial)
+			if width > 0 {
+				lineStart = pos
+			}
+			if partial {
+				if width == 0 && len(line) >= len(lineSep) {
+					keep := len(lineSep) - 1
+					pos += len(line) - keep
+					line = line[len(line)-keep:]
 				}
-				glog.V(1).Infof("<- lineC %v", vl)
-				lineC <- vl
-				end.Offset++
-				start = end
-				glog.V(2).Infof("start: %v, end: %v", start, end)
-			} else {
-				leftOver = line
-				leftOverStart = start
+				leftOver = append([]byte{}, line...)
+				leftOverPos = pos
+				break
 			}
+			send(lineStart, pos+len(line)+len(lineSep), true)
+			pos += len(line) + len(lineSep)
+		}
+		if leftOver == nil {
+			leftOverPos = pos
+			lineStart = pos
+		}
+		// Forget the blocks before the one that the last line starts in.
+		for len(spans) > 1 && spans[1].pos <= lineStart {
+			spans = spans[1:]
+		}
+		if blockDoneC != nil {
+			blockDoneC <- block.ID
+		}
+	}
+	if end := leftOverPos + len(leftOver); end > lineStart {
+		// This is the end of the input, so the line is complete.
+		leftOver, leftOverPos = wrap(leftOver, leftOverPos, false)
+		if width > 0 {
+			lineStart = leftOverPos
+		}
+		if end > lineStart {
+			send(lineStart, end, false)
+		}
+	}
+	glog.V(1).Infof("close(lineC)")
+	close(lineC)
+}
+
+// sepPrefixLen returns the length of the longest start of sep (but not all of
+// it) that the line ends with.
+func sepPrefixLen(line, sep []byte) int {
+	for n := len(sep) - 1; n > 0; n-- {
+		if bytes.HasSuffix(line, sep[:n]) {
+			return n
 		}
 	}
-	if len(leftOver) > 0 {
-		end := leftOverStart
-		end.Offset += len(leftOver) - 1
+	return 0
+}
+
+// generateHexLines is like generateVisibleLines, but each visible line is the
+// next n bytes of the input (the last one may be shorter), for a hex dump.
+// Each of them is a logical line of its own.
+func generateHexLines(n int, blockC chan blocks.Block, lineC chan visibleLine, blockDoneC chan int) {
+	// The start of the line being filled, and how many bytes it has so far.
+	var start, end blocks.BlockIDOffset
+	count := 0
+	send := func() {
 		vl := visibleLine{
-			//line:       leftOver,
 			loc: blocks.BlockIDOffsetRange{
-				Start: leftOverStart,
+				Start: start,
 				End:   end,
 			},
-			endsWithLineSep: endsWithNewline,
+			endsWithLineSep: true,
 		}
-		glog.V(1).Infof("<- lineC leftover line: %q, sending vl %v", string(leftOver), vl)
+		glog.V(1).Infof("<- lineC %v", vl)
 		lineC <- vl
+		count = 0
+	}
+	for block := range blockC {
+		for offset := 0; offset < len(block.Bytes); {
+			if count == 0 {
+				start = blocks.BlockIDOffset{BlockID: block.ID, Offset: offset}
+			}
+			take := n - count
+			if rest := len(block.Bytes) - offset; take > rest {
+				take = rest
+			}
+			offset += take
+			count += take
+			end = blocks.BlockIDOffset{BlockID: block.ID, Offset: offset - 1}
+			if count == n {
+				send()
+			}
+		}
+		if blockDoneC != nil {
+			blockDoneC <- block.ID
+		}
+	}
+	if count > 0 {
+		send()
 	}
-	glog.V(1).Infof("close(lineC)")
 	close(lineC)
 }